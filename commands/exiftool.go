@@ -0,0 +1,74 @@
+/*
+Copyright © 2020 Rob Allen <rob@akrabat.com>
+
+Use of this source code is governed by the MIT
+license that can be found in the LICENSE file or at
+https://akrabat.com/license/mit.
+*/
+
+/*
+Package cmd implements the commands for the app. In this case, sharing one
+exiftool process between everything that a command does with exiftool.
+*/
+package commands
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	. "github.com/akrabat/rodeo/internal"
+)
+
+var (
+	exiftoolMutex   sync.Mutex
+	exiftoolSession *Exiftool
+)
+
+// Get the exiftool session that is shared by this run of Rodeo, or nil if cmd.exiftool is not configured. The
+// exiftool process is started when it is first used.
+func getExiftool(config *Config) *Exiftool {
+	exiftoolMutex.Lock()
+	defer exiftoolMutex.Unlock()
+
+	if config.Cmd.Exiftool == "" {
+		return nil
+	}
+	if exiftoolSession == nil {
+		exiftoolSession = NewExiftool(config.Cmd.Exiftool)
+	}
+	return exiftoolSession
+}
+
+// Stop the exiftool process, if it was started
+func closeExiftool() {
+	exiftoolMutex.Lock()
+	defer exiftoolMutex.Unlock()
+
+	if exiftoolSession == nil {
+		return
+	}
+	if err := exiftoolSession.Close(); err != nil {
+		fmt.Printf("Error: Failed to stop exiftool: %v\n", err)
+	}
+	exiftoolSession = nil
+}
+
+// Stop the exiftool process and exit with this status code. Use this rather than os.Exit() once exiftool may have
+// been started, as exiftool runs in its own process group and so would otherwise be left running.
+func exit(code int) {
+	closeExiftool()
+	os.Exit(code)
+}
+
+// On Ctrl-C, stop the exiftool process and exit. This is for the commands that don't handle Ctrl-C themselves.
+func exitOnInterrupt() {
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupted
+		exit(130)
+	}()
+}
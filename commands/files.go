@@ -0,0 +1,110 @@
+/*
+Copyright © 2020 Rob Allen <rob@akrabat.com>
+
+Use of this source code is governed by the MIT
+license that can be found in the LICENSE file or at
+https://akrabat.com/license/mit.
+*/
+
+/*
+Package cmd implements the commands for the app. In this case, selecting the
+files that a command works on.
+*/
+package commands
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/akrabat/rodeo/internal"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Register the command line options for selecting files on cmd
+func addFileSelectionFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolP("recursive", "r", false, "Find files in subdirectories of the directories given")
+	cmd.Flags().StringSlice("include", nil, "Only find files matching this glob pattern, e.g. --include 'IMG_*'")
+	cmd.Flags().StringSlice("exclude", nil, "Skip files matching this glob pattern, e.g. --exclude '*-web.*'")
+	cmd.Flags().StringSlice("ext", DefaultImageExtensions, "Extensions of the files to find in directories")
+}
+
+// Register the command line option for sorting the selected files on cmd
+func addSortFlag(cmd *cobra.Command) {
+	cmd.Flags().String("sort", "", "Sort the files by \"name\" or capture \"date\"")
+}
+
+// Read the file selection command line options
+func getFileSelection(cmd *cobra.Command) FileSelection {
+	var selection FileSelection
+
+	// Read the value of --recursive (if it is missing, the value is false)
+	selection.Recursive, _ = cmd.Flags().GetBool("recursive")
+	selection.Include, _ = cmd.Flags().GetStringSlice("include")
+	selection.Exclude, _ = cmd.Flags().GetStringSlice("exclude")
+	selection.Extensions, _ = cmd.Flags().GetStringSlice("ext")
+	selection.SortBy, _ = cmd.Flags().GetString("sort")
+
+	return selection
+}
+
+// Create the metadata reader that is set in the config
+func getMetadataReader(config *Config) MetadataReader {
+	metadata, err := NewMetadataReader(config, getExiftool(config))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		fmt.Println("Config file:", viper.ConfigFileUsed())
+		exit(2)
+	}
+	return metadata
+}
+
+// Create the metadata writer that is set in the config, or nil if exiftool isn't configured so metadata can't be
+// written
+func getMetadataWriter(config *Config) MetadataWriter {
+	exiftool := getExiftool(config)
+	if exiftool == nil {
+		return nil
+	}
+	writer, err := NewMetadataWriter(config, exiftool)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		fmt.Println("Config file:", viper.ConfigFileUsed())
+		exit(2)
+	}
+	return writer
+}
+
+// Expand the files, directories and glob patterns given on the command line into the list of files to process
+func selectFiles(cmd *cobra.Command, args []string) []string {
+	selection := getFileSelection(cmd)
+
+	switch selection.SortBy {
+	case "", "name":
+	case "date":
+		metadata := getMetadataReader(GetConfig())
+		selection.DateOf = func(filename string) *time.Time {
+			info, err := metadata.ReadMetadata(filename)
+			if err != nil {
+				return nil
+			}
+			return info.Date
+		}
+	default:
+		fmt.Printf("Error: Unknown sort order \"%s\". Use \"name\" or \"date\".\n", selection.SortBy)
+		exit(2)
+	}
+
+	files, err := selection.Expand(args)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		exit(2)
+	}
+
+	if len(files) == 0 {
+		fmt.Println("Error: No files found.")
+		exit(2)
+	}
+
+	return files
+}
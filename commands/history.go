@@ -0,0 +1,509 @@
+/*
+Copyright © 2020 Rob Allen <rob@akrabat.com>
+
+Use of this source code is governed by the MIT
+license that can be found in the LICENSE file or at
+https://akrabat.com/license/mit.
+*/
+
+/*
+Package cmd implements the commands for the app. In this case, querying and
+editing the history of uploaded images.
+*/
+package commands
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	. "github.com/akrabat/rodeo/internal"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+	historyCmd.AddCommand(historyListCmd)
+	historyCmd.AddCommand(historyShowCmd)
+	historyCmd.AddCommand(historyExportCmd)
+	historyCmd.AddCommand(historyRemoveCmd)
+	historyCmd.AddCommand(historyReassociateCmd)
+	historyCmd.AddCommand(historyImportCmd)
+
+	addHistoryFilterFlags(historyListCmd)
+	addHistoryFilterFlags(historyExportCmd)
+	historyExportCmd.Flags().String("format", "csv", "Export format: csv or json")
+	historyExportCmd.Flags().StringP("output", "o", "", "Write to this file instead of standard output")
+	historyReassociateCmd.Flags().String("file", "", "The image file that was uploaded as the photo")
+	historyReassociateCmd.Flags().String("photo-id", "", "The ID of the Flickr photo that the image was uploaded as")
+	historyImportCmd.Flags().BoolP("recursive", "r", false, "Also import the lists in subdirectories")
+}
+
+// historyCmd represents the history command
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Query and edit the history of uploaded images",
+	Long: `Query and edit the history of uploaded images
+
+Rodeo records each image that it uploads so that it is not uploaded again.
+`,
+}
+
+var historyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List uploaded images",
+	Long: `List uploaded images
+
+Dates can be given as YYYY-MM-DD or in RFC 3339 format. The --to date
+is inclusive.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		filter := getHistoryFilter(cmd)
+		records := getHistoryRecords(filter)
+
+		if len(records) == 0 {
+			fmt.Println("No uploads found")
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PHOTO ID\tUPLOADED\tFILE\tTITLE")
+		for _, record := range records {
+			file := record.Path
+			if file == "" {
+				file = record.Filename
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", record.PhotoId, formatHistoryDate(record.UploadedAt, "2006-01-02 15:04"),
+				file, record.Title)
+		}
+		w.Flush()
+		fmt.Printf("%d upload%s\n", len(records), PluralS(len(records)))
+	},
+}
+
+var historyShowCmd = &cobra.Command{
+	Use:   "show <photo id>",
+	Short: "Show the record of an uploaded photo",
+	Long:  `Show the record of an uploaded photo`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			fmt.Println("Error: A photo ID must be specified.")
+			exit(2)
+		}
+
+		record, err := getHistory().FindPhoto(args[0])
+		if err != nil {
+			fmt.Printf("Error: Photo %s: %v\n", args[0], err)
+			exit(1)
+		}
+
+		var albums []string
+		for _, album := range record.Albums {
+			albums = append(albums, album.String())
+		}
+
+		fmt.Printf("Photo ID:    %s\n", record.PhotoId)
+		fmt.Printf("Title:       %s\n", record.Title)
+		fmt.Printf("Filename:    %s\n", record.Filename)
+		fmt.Printf("Path:        %s\n", record.Path)
+		if record.Size != 0 {
+			fmt.Printf("Size:        %d bytes\n", record.Size)
+		}
+		fmt.Printf("Hash:        %s\n", record.Hash)
+		fmt.Printf("Date taken:  %s\n", formatHistoryDate(record.DateTaken, time.RFC3339))
+		fmt.Printf("Uploaded at: %s\n", formatHistoryDate(record.UploadedAt, time.RFC3339))
+		fmt.Printf("Albums:      %s\n", strings.Join(albums, ", "))
+		fmt.Printf("View this photo: %s\n", photoURL(record.PhotoId))
+	},
+}
+
+var historyExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the history of uploaded images as CSV or JSON",
+	Long: `Export the history of uploaded images as CSV or JSON
+
+The same filters as "rodeo history list" can be used to export some of the
+history.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Read the value of --format (if it is missing, the value is csv)
+		format, err := cmd.Flags().GetString("format")
+		if err != nil {
+			format = "csv"
+		}
+		format = strings.ToLower(format)
+		if format != "csv" && format != "json" {
+			fmt.Println("Error: --format must be csv or json.")
+			exit(2)
+		}
+
+		// Read the value of --output (if it is missing, the value is empty)
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			output = ""
+		}
+
+		records := getHistoryRecords(getHistoryFilter(cmd))
+
+		var out io.Writer = os.Stdout
+		var file *os.File
+		if output != "" {
+			file, err = os.Create(output)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				exit(1)
+			}
+			out = file
+		}
+
+		if format == "json" {
+			err = exportHistoryJson(out, records)
+		} else {
+			err = exportHistoryCsv(out, records)
+		}
+		if file != nil {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			fmt.Printf("Error: Unable to export the history: %v\n", err)
+			exit(1)
+		}
+	},
+}
+
+var historyRemoveCmd = &cobra.Command{
+	Use:   "remove <photo ids>...",
+	Short: "Remove uploaded photos from the history",
+	Long: `Remove uploaded photos from the history
+
+This does not delete the photos from Flickr. Once its record has been removed,
+an image is no longer recognised as having been uploaded and so it will be
+uploaded again by "rodeo upload".
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			fmt.Println("Error: At least one photo ID must be specified.")
+			exit(2)
+		}
+
+		history := getHistory()
+		failed := false
+		for _, photoId := range args {
+			if err := history.RemoveUpload(photoId); err != nil {
+				fmt.Printf("Error: Photo %s: %v\n", photoId, err)
+				failed = true
+				continue
+			}
+			fmt.Printf("Removed photo %s from the history\n", photoId)
+		}
+		if failed {
+			exit(1)
+		}
+	},
+}
+
+var historyReassociateCmd = &cobra.Command{
+	Use:   "reassociate <photo id>",
+	Short: "Change the image file or Flickr photo of an upload record",
+	Long: `Change the image file or Flickr photo of an upload record
+
+Use --file when the image has been edited or moved so that it is no longer
+recognised, or --photo-id when the photo has been uploaded again by another
+tool.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			fmt.Println("Error: A photo ID must be specified.")
+			exit(2)
+		}
+		photoId := args[0]
+
+		// Read the value of --file and --photo-id (if they are missing, the values are empty)
+		filename, err := cmd.Flags().GetString("file")
+		if err != nil {
+			filename = ""
+		}
+		newPhotoId, err := cmd.Flags().GetString("photo-id")
+		if err != nil {
+			newPhotoId = ""
+		}
+		if filename == "" && newPhotoId == "" {
+			fmt.Println("Error: --file or --photo-id must be specified.")
+			exit(2)
+		}
+
+		err = getHistory().UpdateUpload(photoId, func(record *UploadRecord) error {
+			if filename != "" {
+				if err := record.SetFile(filename); err != nil {
+					return err
+				}
+			}
+			if newPhotoId != "" {
+				record.PhotoId = newPhotoId
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Printf("Error: Photo %s: %v\n", photoId, err)
+			exit(1)
+		}
+
+		if filename != "" {
+			fmt.Printf("Photo %s is now associated with %s\n", photoId, filename)
+		}
+		if newPhotoId != "" {
+			fmt.Printf("The image uploaded as photo %s is now associated with photo %s\n", photoId, newPhotoId)
+		}
+	},
+}
+
+// Add the flags that select records from the history
+func addHistoryFilterFlags(cmd *cobra.Command) {
+	cmd.Flags().String("from", "", "Only uploads on or after this date")
+	cmd.Flags().String("to", "", "Only uploads on or before this date")
+	cmd.Flags().Bool("date-taken", false, "Filter --from and --to by the date the photo was taken rather than uploaded")
+	cmd.Flags().String("dir", "", "Only images within this directory")
+	cmd.Flags().String("album", "", "Only photos that were added to this album (name or ID)")
+	cmd.Flags().String("photo-id", "", "Only the photo with this ID")
+}
+
+// Read the history filter flags
+func getHistoryFilter(cmd *cobra.Command) UploadFilter {
+	var filter UploadFilter
+
+	from, _ := cmd.Flags().GetString("from")
+	if from != "" {
+		date, err := parseHistoryDate(from, false)
+		if err != nil {
+			fmt.Printf("Error: --from: %v\n", err)
+			exit(2)
+		}
+		filter.From = &date
+	}
+
+	to, _ := cmd.Flags().GetString("to")
+	if to != "" {
+		date, err := parseHistoryDate(to, true)
+		if err != nil {
+			fmt.Printf("Error: --to: %v\n", err)
+			exit(2)
+		}
+		filter.To = &date
+	}
+
+	filter.ByDateTaken, _ = cmd.Flags().GetBool("date-taken")
+	filter.Directory, _ = cmd.Flags().GetString("dir")
+	filter.Album, _ = cmd.Flags().GetString("album")
+	filter.PhotoId, _ = cmd.Flags().GetString("photo-id")
+
+	return filter
+}
+
+// Parse a date given on the command line. A date without a time is the start of that day in the local time zone, or
+// the end of it if endOfDay is set.
+func parseHistoryDate(value string, endOfDay bool) (time.Time, error) {
+	if date, err := time.Parse(time.RFC3339, value); err == nil {
+		return date, nil
+	}
+
+	date, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return date, fmt.Errorf("%s is not a date in the format YYYY-MM-DD", value)
+	}
+	if endOfDay {
+		date = date.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return date, nil
+}
+
+var historyImportCmd = &cobra.Command{
+	Use:   "import [directories...]",
+	Short: "Import the lists of uploaded images from earlier versions of Rodeo",
+	Long: `Import the lists of uploaded images from earlier versions of Rodeo
+
+The global list in the config directory is imported, along with the list in
+each directory given. Each imported list is renamed with an .imported suffix.
+"rodeo upload" and "rodeo watch" import the lists for the images that they
+upload, except in a dry run.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Read the value of --recursive (if it is missing, the value is false)
+		recursive, err := cmd.Flags().GetBool("recursive")
+		if err != nil {
+			recursive = false
+		}
+
+		filenames := []string{GlobalUploadedListFilename()}
+		for _, directory := range args {
+			err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !info.IsDir() {
+					return nil
+				}
+				if path != directory && (!recursive || info.Name()[0] == '.') {
+					return filepath.SkipDir
+				}
+				filenames = append(filenames, filepath.Join(path, "."+UploadedListBaseFilename))
+				return nil
+			})
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				exit(1)
+			}
+		}
+
+		if count := importUploadedLists(filenames); count == 0 {
+			fmt.Println("There are no uploads to import")
+		}
+	},
+}
+
+// The uploaded lists of earlier versions of Rodeo that have not been imported into the history: the global list and
+// those in the directories of these files, or in these directories
+func uploadedListsToImport(filenames []string) []string {
+	seen := make(map[string]bool)
+	var lists []string
+	add := func(filename string) {
+		if seen[filename] {
+			return
+		}
+		seen[filename] = true
+		if _, err := os.Stat(filename); err == nil {
+			lists = append(lists, filename)
+		}
+	}
+
+	add(GlobalUploadedListFilename())
+	for _, filename := range filenames {
+		if stat, err := os.Stat(filename); err == nil && stat.IsDir() {
+			add(filepath.Join(filename, "."+UploadedListBaseFilename))
+		} else {
+			add(UploadedListFilenameInImageDir(filename))
+		}
+	}
+	return lists
+}
+
+// Import these uploaded lists into the history and return the number of uploads imported
+func importUploadedLists(filenames []string) int {
+	history, err := GetHistory()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 0
+	}
+
+	total := 0
+	for _, filename := range filenames {
+		count, err := history.ImportUploadedList(filename)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			continue
+		}
+		if count > 0 {
+			fmt.Printf("Imported %d upload%s from %s\n", count, PluralS(count), filename)
+		}
+		total += count
+	}
+	return total
+}
+
+func getHistory() *History {
+	history, err := GetHistory()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		exit(1)
+	}
+	return history
+}
+
+// Get the records in the history that match the filter
+func getHistoryRecords(filter UploadFilter) []UploadRecord {
+	records, err := getHistory().Uploads()
+	if err != nil {
+		fmt.Printf("Error: Unable to read the history: %v\n", err)
+		exit(1)
+	}
+
+	var matched []UploadRecord
+	for _, record := range records {
+		if filter.Matches(record) {
+			matched = append(matched, record)
+		}
+	}
+	return matched
+}
+
+func exportHistoryJson(out io.Writer, records []UploadRecord) error {
+	if records == nil {
+		records = []UploadRecord{}
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(data))
+	return err
+}
+
+func exportHistoryCsv(out io.Writer, records []UploadRecord) error {
+	w := csv.NewWriter(out)
+	err := w.Write([]string{"photo_id", "url", "filename", "path", "size", "hash", "title", "date_taken",
+		"uploaded_at", "albums"})
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		var albums []string
+		for _, album := range record.Albums {
+			albums = append(albums, album.String())
+		}
+
+		size := ""
+		if record.Size != 0 {
+			size = strconv.FormatInt(record.Size, 10)
+		}
+
+		err := w.Write([]string{
+			record.PhotoId,
+			photoURL(record.PhotoId),
+			record.Filename,
+			record.Path,
+			size,
+			record.Hash,
+			record.Title,
+			formatHistoryDate(record.DateTaken, time.RFC3339),
+			formatHistoryDate(record.UploadedAt, time.RFC3339),
+			strings.Join(albums, "; "),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+func formatHistoryDate(date *time.Time, layout string) string {
+	if date == nil {
+		return ""
+	}
+	return date.Format(layout)
+}
+
+// The URL of the photo's page on Flickr
+func photoURL(photoId string) string {
+	return fmt.Sprintf("http://www.flickr.com/photos/%s/%s", GetConfig().Flickr.Username, photoId)
+}
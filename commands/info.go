@@ -16,7 +16,6 @@ import (
 	"fmt"
 	. "github.com/akrabat/rodeo/internal"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 	"os"
 	"path/filepath"
 	"sort"
@@ -26,6 +25,8 @@ import (
 
 func init() {
 	rootCmd.AddCommand(infoCmd)
+	addFileSelectionFlags(infoCmd)
+	addSortFlag(infoCmd)
 
 	// Here you will define your flags and configuration settings.
 
@@ -40,7 +41,7 @@ func init() {
 
 // infoCmd displays info about the image file
 var infoCmd = &cobra.Command{
-	Use:   "info <files>...",
+	Use:   "info <files or directories>...",
 	Short: "View information on these files",
 	Long: `View information on these files
 `,
@@ -50,36 +51,44 @@ var infoCmd = &cobra.Command{
 			fmt.Println("Error: At least one file must be specified.")
 			os.Exit(2)
 		}
+		args = selectFiles(cmd, args)
 
-		config := GetConfig()
-		exiftool := config.Cmd.Exiftool
-		if exiftool == "" {
-			fmt.Println("Error: cmd.exiftool needs to be configured.")
-			fmt.Println("Config file:", viper.ConfigFileUsed(), "\n")
-			os.Exit(2)
-		}
+		metadata := getMetadataReader(GetConfig())
+		exitOnInterrupt()
 
 		for _, filename := range args {
-			fileInfo(filename, exiftool)
+			fileInfo(filename, metadata)
 			fmt.Printf("\n")
 		}
 	},
 }
 
-func fileInfo(filename string, exiftool string) {
+func fileInfo(filename string, metadata MetadataReader) {
 	fmt.Printf("%v:\n", filepath.Base(filename))
 
-	info, err := GetImageInfo(filename, exiftool)
+	info, err := metadata.ReadMetadata(filename)
 	if err != nil {
+		fmt.Printf("  Error: %v\n", err)
 		return
 	}
 
+	if _, ok := metadata.(SidecarReader); ok {
+		if sidecar := FindSidecar(filename); sidecar != "" {
+			fmt.Printf("  Sidecar:     %v\n", filepath.Base(sidecar))
+		}
+	}
 	fmt.Printf("  Title:       %v\n", info.Title)
 	fmt.Printf("  Description: %v\n", info.Description)
 	fmt.Printf("  Date taken: %v\n", info.Date.Format(time.RFC1123Z))
 
 	sort.Sort(sort.StringSlice(info.Keywords[:]))
 	fmt.Printf("  Keywords:    %v\n", strings.Join(info.Keywords[:], ", "))
+	if len(info.HierarchicalSubject) > 0 {
+		fmt.Printf("  Hierarchy:\n")
+		for _, line := range info.KeywordTree(Keywords{}).Lines("  ") {
+			fmt.Printf("    %v\n", line)
+		}
+	}
 
 	fmt.Printf("  Dimensions:  width:%v, height:%v\n", info.Width, info.Height)
 	fmt.Printf("  Camera:      %v %v\n", info.Make, info.Model)
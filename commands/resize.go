@@ -28,11 +28,13 @@ func init() {
 
 	// Register command line options
 	resizeCmd.Flags().BoolP("quiet", "q", false, "Just print name of resized file on completion")
+	addFileSelectionFlags(resizeCmd)
+	addSortFlag(resizeCmd)
 }
 
 // resizeCmd displays info about the image file
 var resizeCmd = &cobra.Command{
-	Use:   "resize <files>...",
+	Use:   "resize <files or directories>...",
 	Short: "Resize files for use on the web",
 	Long:  "Resize files for use on the web",
 	Run: func(cmd *cobra.Command, args []string) {
@@ -41,6 +43,7 @@ var resizeCmd = &cobra.Command{
 			fmt.Println("Error: At least one file must be specified.")
 			os.Exit(2)
 		}
+		args = selectFiles(cmd, args)
 
 		// Read the value of --quiet (if it is missing, the value is false)
 		quiet, err := cmd.Flags().GetBool("quiet")
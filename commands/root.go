@@ -42,7 +42,9 @@ can also resize images for sharing on social media or in messages.
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	err := rootCmd.Execute()
+	closeExiftool()
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
@@ -0,0 +1,94 @@
+/*
+Copyright © 2020 Rob Allen <rob@akrabat.com>
+
+Use of this source code is governed by the MIT
+license that can be found in the LICENSE file or at
+https://akrabat.com/license/mit.
+*/
+
+/*
+Package cmd implements the commands for the app. In this case, applying the
+upload rules to an image.
+*/
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	. "github.com/akrabat/rodeo/internal"
+	"github.com/akrabat/rodeo/internal/rules"
+	"github.com/spf13/viper"
+)
+
+// Check the rules in the config and compile them into the order in which they are evaluated. Any problems with the
+// rules are displayed and, if any of them is an error, then Rodeo exits.
+func getRules(config *Config) []rules.Rule {
+	problems := lintRules(config)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if countRuleErrors(problems) > 0 {
+		fmt.Println("Config file:", viper.ConfigFileUsed())
+		exit(2)
+	}
+	if len(problems) > 0 {
+		fmt.Println()
+	}
+
+	compiled, err := rules.New(config.Rules, config.Keywords)
+	if err != nil {
+		// lintRules() has already reported this
+		fmt.Printf("Error: %v\n", err)
+		fmt.Println("Config file:", viper.ConfigFileUsed())
+		exit(2)
+	}
+	return compiled
+}
+
+// Check that exiftool is configured if any rule changes the keywords in the files. The keywords that a rule deletes
+// must be removed from the file as well, as Flickr also reads them from the file that is uploaded.
+func checkKeywordWriting(compiled []rules.Rule, config *Config) {
+	if config.Cmd.Exiftool != "" {
+		return
+	}
+	for _, rule := range compiled {
+		if rule.Action.Delete || rule.Action.WriteToFile {
+			fmt.Printf("Error: cmd.exiftool needs to be configured as rule '%s' changes the keywords in the file.\n",
+				rule.Name)
+			fmt.Println("Config file:", viper.ConfigFileUsed())
+			exit(2)
+		}
+	}
+}
+
+// Apply the rules to an image, displaying how each rule was evaluated if --verbose is set
+func evaluateRules(out io.Writer, compiled []rules.Rule, info *ImageInfo, config *Config) rules.Plan {
+	if compiled == nil {
+		debug(out, "No config found")
+	}
+
+	plan := rules.Evaluate(compiled, info, rules.Options{
+		Keywords: config.Keywords,
+		Upload:   config.Upload,
+	})
+
+	for _, trace := range plan.Trace {
+		debug(out, "Looking at rule '%s'", trace.Name)
+		for _, condition := range trace.Conditions {
+			if !condition.Passed {
+				debug(out, "Excluding due to `%s`", condition.Name)
+			}
+		}
+		if trace.Applied {
+			debug(out, "Will process rules")
+			for _, action := range trace.Actions {
+				debug(out, "Action: %s", action)
+			}
+		}
+	}
+	if plan.StoppedBy != "" {
+		debug(out, "Stopping due to `stop` in rule '%s'", plan.StoppedBy)
+	}
+	return plan
+}
@@ -0,0 +1,232 @@
+/*
+Copyright © 2020 Rob Allen <rob@akrabat.com>
+
+Use of this source code is governed by the MIT
+license that can be found in the LICENSE file or at
+https://akrabat.com/license/mit.
+*/
+
+/*
+Package cmd implements the commands for the app. In this case, checking the
+upload rules for mistakes.
+*/
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/akrabat/rodeo/internal"
+	"github.com/akrabat/rodeo/internal/rules"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rulesCmd.AddCommand(rulesLintCmd)
+
+	rulesLintCmd.Flags().Bool("check-albums", false, "Check that the albums exist on Flickr")
+}
+
+var rulesLintCmd = &cobra.Command{
+	Use:   "lint",
+	Short: "Check the upload rules for mistakes",
+	Long: `Check the upload rules for mistakes
+
+Errors, which stop rodeo upload from running:
+- unknown keys, such as include_all instead of includes_all
+- invalid keyword patterns, when expressions or actions
+
+Warnings:
+- rules with no includes_all, includes_any or when, which never apply
+- rules with no actions
+- keywords that are both included and excluded by a rule
+- rules with the same name
+
+With --check-albums, the albums of the rules are also checked against your
+albums on Flickr.
+
+Exits with status 1 if there are any problems.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Read the value of --check-albums (if it is missing, the value is false)
+		checkAlbums, err := cmd.Flags().GetBool("check-albums")
+		if err != nil {
+			checkAlbums = false
+		}
+
+		config := GetConfig()
+		problems := lintRules(config)
+
+		if checkAlbums {
+			flickrClient, err := GetFlickrClient()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				exit(1)
+			}
+			albumTitles := make(map[string]string)
+			for _, photoset := range GetPhotosets(flickrClient, "") {
+				albumTitles[photoset.Id] = photoset.Title
+			}
+			problems = append(problems, lintRuleAlbums(config.Rules, albumTitles)...)
+		}
+
+		fmt.Printf("Checked %d rule%s in %s\n", len(config.Rules), PluralS(len(config.Rules)), viper.ConfigFileUsed())
+		if len(problems) == 0 {
+			fmt.Println("No problems found")
+			return
+		}
+
+		fmt.Println()
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		errors := countRuleErrors(problems)
+		fmt.Println()
+		fmt.Printf("%d error%s, %d warning%s\n", errors, PluralS(errors), len(problems)-errors,
+			PluralS(len(problems)-errors))
+		exit(1)
+	},
+}
+
+// A ruleProblem is a mistake in the rules. Errors stop the rules from being used and warnings are for rules that are
+// valid, but probably don't do what was intended.
+type ruleProblem struct {
+	rule    string // empty if the problem is not with one rule
+	isError bool
+	message string
+}
+
+func (p ruleProblem) String() string {
+	level := "Warning"
+	if p.isError {
+		level = "Error"
+	}
+	if p.rule == "" {
+		return fmt.Sprintf("%s: %s", level, p.message)
+	}
+	return fmt.Sprintf("%s: Rule '%s' %s", level, p.rule, p.message)
+}
+
+func countRuleErrors(problems []ruleProblem) int {
+	errors := 0
+	for _, problem := range problems {
+		if problem.isError {
+			errors++
+		}
+	}
+	return errors
+}
+
+// Check the rules in the config for mistakes
+func lintRules(config *Config) []ruleProblem {
+	var problems []ruleProblem
+
+	switch config.Upload.PrivacyMerge {
+	case PrivacyMergeLast, PrivacyMergeFirst, PrivacyMergeMostRestrictive:
+	default:
+		problems = append(problems, ruleProblem{isError: true, message: fmt.Sprintf(
+			"Invalid upload.privacy_merge '%s': it must be %s, %s or %s", config.Upload.PrivacyMerge,
+			PrivacyMergeLast, PrivacyMergeFirst, PrivacyMergeMostRestrictive)})
+	}
+
+	if _, ok := SafetyLevels[config.Upload.SafetyLevel]; !ok {
+		problems = append(problems, ruleProblem{isError: true, message: fmt.Sprintf(
+			"Invalid upload.safety_level '%s': it must be safe, moderate or restricted", config.Upload.SafetyLevel)})
+	}
+	if _, ok := ContentTypes[config.Upload.ContentType]; !ok {
+		problems = append(problems, ruleProblem{isError: true, message: fmt.Sprintf(
+			"Invalid upload.content_type '%s': it must be photo, screenshot or other", config.Upload.ContentType)})
+	}
+
+	switch config.Metadata.WriteTo {
+	case MetadataTargetFile, MetadataTargetSidecar, MetadataTargetBoth:
+	default:
+		problems = append(problems, ruleProblem{isError: true, message: fmt.Sprintf(
+			"Invalid metadata.write_to '%s': it must be %s, %s or %s", config.Metadata.WriteTo, MetadataTargetFile,
+			MetadataTargetSidecar, MetadataTargetBoth)})
+	}
+
+	switch config.Keywords.HierarchicalTags {
+	case HierarchicalTagsFlat, HierarchicalTagsLeaf, HierarchicalTagsAll, HierarchicalTagsPath:
+	default:
+		problems = append(problems, ruleProblem{isError: true, message: fmt.Sprintf(
+			"Invalid keywords.hierarchical_tags '%s': it must be %s, %s, %s or %s", config.Keywords.HierarchicalTags,
+			HierarchicalTagsFlat, HierarchicalTagsLeaf, HierarchicalTagsAll, HierarchicalTagsPath)})
+	}
+
+	keyProblems := CheckRulesKeys()
+
+	seen := make(map[string]bool)
+	for n, rule := range config.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("%d", n+1)
+			problems = append(problems, ruleProblem{rule: name, message: "has no name"})
+		} else if seen[name] {
+			problems = append(problems, ruleProblem{rule: name, message: "has the same name as an earlier rule"})
+		}
+		seen[name] = true
+
+		for _, message := range keyProblems[n] {
+			problems = append(problems, ruleProblem{rule: name, isError: true, message: message})
+		}
+
+		if _, err := rules.Compile(rule, config.Keywords); err != nil {
+			problems = append(problems, ruleProblem{rule: name, isError: true, message: err.Error()})
+		}
+
+		condition := rule.Condition
+		if len(condition.IncludesAll) == 0 && len(condition.IncludesAny) == 0 && strings.TrimSpace(rule.When) == "" {
+			problems = append(problems, ruleProblem{rule: name,
+				message: "has no includes_all, includes_any or when, so it never applies"})
+		}
+
+		action := rule.Action
+		if !action.Delete && action.Privacy == nil && len(action.Albums) == 0 && len(action.Add) == 0 &&
+			len(action.Rename) == 0 && action.Flatten == "" && len(action.MachineTags) == 0 &&
+			action.SafetyLevel == "" && action.ContentType == "" && action.Hidden == nil && action.License == nil &&
+			!rule.Stop {
+			problems = append(problems, ruleProblem{rule: name, message: "has no actions"})
+		}
+
+		// Flickr reads the keywords from the image that is uploaded, so they are only deleted from the sidecar
+		if action.Delete && config.Metadata.WriteTo == MetadataTargetSidecar {
+			problems = append(problems, ruleProblem{rule: name, message: fmt.Sprintf(
+				"deletes keywords but metadata.write_to is %s, so Flickr still gets them from the image",
+				MetadataTargetSidecar)})
+		}
+
+		includes := NewKeywordSet(condition.IncludesAll, config.Keywords)
+		includes.Add(condition.IncludesAny...)
+		excludes := append(append([]string{}, condition.ExcludesAll...), condition.ExcludesAny...)
+		if both := includes.Intersection(excludes); len(both) > 0 {
+			problems = append(problems, ruleProblem{rule: name, message: fmt.Sprintf(
+				"both includes and excludes keyword%s: %s", PluralS(both), strings.Join(both, ", "))})
+		}
+	}
+
+	return problems
+}
+
+// Check the albums of the rules against the titles of the user's albums on Flickr, by album ID
+func lintRuleAlbums(rules []Rules, albumTitles map[string]string) []ruleProblem {
+	var problems []ruleProblem
+	for _, rule := range rules {
+		for _, album := range rule.Action.Albums {
+			if album.Id == "" {
+				continue
+			}
+			title, ok := albumTitles[album.Id]
+			if !ok {
+				problems = append(problems, ruleProblem{rule: rule.Name, isError: true,
+					message: fmt.Sprintf("has album %s, which does not exist on Flickr", album)})
+			} else if title != album.Name {
+				problems = append(problems, ruleProblem{rule: rule.Name,
+					message: fmt.Sprintf("has album %s, which is called '%s' on Flickr", album, title)})
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,152 @@
+/*
+Copyright © 2020 Rob Allen <rob@akrabat.com>
+
+Use of this source code is governed by the MIT
+license that can be found in the LICENSE file or at
+https://akrabat.com/license/mit.
+*/
+
+/*
+Package cmd implements the commands for the app. In this case, showing how
+the upload rules apply to images.
+*/
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	. "github.com/akrabat/rodeo/internal"
+	"github.com/akrabat/rodeo/internal/rules"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rootCmd.AddCommand(rulesCmd)
+	rulesCmd.AddCommand(rulesTestCmd)
+
+	addFileSelectionFlags(rulesTestCmd)
+}
+
+// rulesCmd represents the rules command
+var rulesCmd = &cobra.Command{
+	Use:   "rules",
+	Short: "Check the upload rules",
+	Long: `Check the upload rules
+`,
+}
+
+var rulesTestCmd = &cobra.Command{
+	Use:   "test <files or directories>...",
+	Short: "Show how the upload rules apply to these files",
+	Long: `Show how the upload rules apply to these files
+
+Evaluates every rule against each file's metadata, in the order that they are
+evaluated when uploading, and shows whether each condition passed, the image's
+keywords that it matched and the actions that the rule took. Then shows the
+tags, privacy, title and albums that the photo would be uploaded with.
+
+Flickr is not contacted and the files are not changed.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			fmt.Println("Error: At least one file must be specified.")
+			exit(2)
+		}
+		args = selectFiles(cmd, args)
+
+		config := GetConfig()
+		metadata := getMetadataReader(config)
+		exitOnInterrupt()
+
+		compiled := getRules(config)
+		if len(compiled) == 0 {
+			fmt.Println("There are no rules in the config.")
+			fmt.Println("Config file:", viper.ConfigFileUsed())
+			return
+		}
+
+		for _, filename := range args {
+			testRules(filename, metadata, compiled, config)
+			fmt.Println()
+		}
+	},
+}
+
+// Display the trace of evaluating the rules for an image
+func testRules(filename string, metadata MetadataReader, compiled []rules.Rule, config *Config) {
+	fmt.Printf("%v:\n", filename)
+
+	info, err := metadata.ReadMetadata(filename)
+	if err != nil {
+		fmt.Printf("  Error: %v\n", err)
+		return
+	}
+	fmt.Printf("  Keywords: %s\n\n", strings.Join(info.Keywords, ", "))
+
+	plan := rules.Evaluate(compiled, info, rules.Options{
+		Keywords: config.Keywords,
+		Upload:   config.Upload,
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  RULE\tCHECK\tRESULT\tDETAIL")
+	for i, rule := range compiled {
+		if i >= len(plan.Trace) {
+			fmt.Fprintf(w, "  %s\t\tskipped\tstopped by '%s'\n", rule.Name, plan.StoppedBy)
+			continue
+		}
+		trace := plan.Trace[i]
+
+		name := trace.Name
+		for _, condition := range trace.Conditions {
+			result := "pass"
+			if !condition.Passed {
+				result = "fail"
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", name, condition.Name, result, strings.Join(condition.Keywords, ", "))
+			name = ""
+		}
+		if !trace.Applied {
+			detail := ""
+			if len(trace.Conditions) == 0 {
+				detail = "no includes_all, includes_any or when"
+			}
+			fmt.Fprintf(w, "  %s\t\tnot applied\t%s\n", name, detail)
+			continue
+		}
+		fmt.Fprintf(w, "  %s\t\tapplied\t\n", name)
+		for _, action := range trace.Actions {
+			fmt.Fprintf(w, "  \taction\t\t%s\n", action)
+		}
+		if plan.StoppedBy != "" && i == len(plan.Trace)-1 {
+			fmt.Fprintf(w, "  \tstop\t\tno further rules are evaluated\n")
+		}
+	}
+	w.Flush()
+
+	albums := make([]string, len(plan.Albums))
+	for i, album := range plan.Albums {
+		albums[i] = album.String()
+	}
+
+	fmt.Println()
+	fmt.Printf("  Tags:    %s\n", strings.Join(plan.Tags, ", "))
+	fmt.Printf("  Privacy: Family: %v, Friends: %v, Public: %v\n", plan.Privacy.Family, plan.Privacy.Friends,
+		plan.Privacy.Public)
+	fmt.Printf("  Safety level: %s, content type: %s, hidden: %v\n", plan.SafetyLevel, plan.ContentType, plan.Hidden)
+	if plan.License != nil {
+		fmt.Printf("  License: %d\n", *plan.License)
+	}
+	fmt.Printf("  Title:   %s\n", plan.Title)
+	fmt.Printf("  Albums:  %s\n", strings.Join(albums, ", "))
+	if len(plan.FileKeywordsToRemove) > 0 {
+		fmt.Printf("  Keywords to remove from the file: %s\n", strings.Join(plan.FileKeywordsToRemove, ", "))
+	}
+	if len(plan.FileKeywordsToAdd) > 0 {
+		fmt.Printf("  Keywords to write to the file: %s\n", strings.Join(plan.FileKeywordsToAdd, ", "))
+	}
+}
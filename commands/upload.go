@@ -14,28 +14,93 @@ package commands
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	. "github.com/akrabat/rodeo/internal"
+	"github.com/akrabat/rodeo/internal/rules"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"gopkg.in/masci/flickr.v2"
-	"gopkg.in/masci/flickr.v2/photos"
-	"gopkg.in/masci/flickr.v2/photosets"
 )
 
-const uploadedListBaseFilename = "rodeo-uploaded-files.json"
-
 var verbose bool
 var veryVerbose bool
 
+// Guards writes to stdout when files are uploaded concurrently
+var outputMutex sync.Mutex
+
+// Guards the lookup and recording of uploads in the upload history
+var uploadedListMutex sync.Mutex
+
+// Guards the album given by --album or --create-album so that it is only created once
+var albumMutex sync.Mutex
+
+// uploadOptions holds the settings that apply to every file in an upload run
+type uploadOptions struct {
+	forceUpload bool
+	dryRun      bool
+	resume      bool
+	replace     bool // replace the image of the photo already on Flickr
+	replaceMeta bool // also set the title, description and tags of the replaced photo
+	album       *Album
+	convertCmd  string
+	jobs        int
+	session     *UploadSession
+	failures    *failureList
+	rules       []rules.Rule
+	metadata    MetadataReader
+	writer      MetadataWriter // nil if exiftool isn't configured
+}
+
+// An uploadFailure is a step of uploading a file that failed
+type uploadFailure struct {
+	filename string
+	err      error
+}
+
+// A failureList collects the failures from all the workers for the end-of-run summary
+type failureList struct {
+	mutex sync.Mutex
+	items []uploadFailure
+}
+
+func (f *failureList) add(filename string, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.items = append(f.items, uploadFailure{filename: filename, err: err})
+}
+
+// The number of failures so far
+func (f *failureList) len() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.items)
+}
+
+// Whether any of the failures after the first `n` may go away if the step is tried again later
+func (f *failureList) transientSince(n int) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, failure := range f.items[n:] {
+		if flickrErr, ok := failure.err.(*FlickrError); ok && flickrErr.Transient && !flickrErr.MayHaveSucceeded {
+			return true
+		}
+	}
+	return false
+}
+
 func init() {
 	rootCmd.AddCommand(uploadCmd)
 
@@ -46,11 +111,17 @@ func init() {
 	uploadCmd.Flags().Bool("very-verbose", false, "Display detailed image metadata during processing")
 	uploadCmd.Flags().String("album", "", "Add to specific album, e.g. --album 12345678")
 	uploadCmd.Flags().String("create-album", "", "Create a new album and add photo to it, e.g. --create-album 'SVR'")
+	uploadCmd.Flags().IntP("jobs", "j", 1, "Number of files to process concurrently")
+	uploadCmd.Flags().Bool("resume", false, "Finish the incomplete steps of interrupted uploads")
+	uploadCmd.Flags().Bool("replace", false, "Replace the image of a photo that has already been uploaded")
+	uploadCmd.Flags().Bool("replace-metadata", false, "With --replace, also update the title, description and tags")
+	addFileSelectionFlags(uploadCmd)
+	addSortFlag(uploadCmd)
 }
 
 // uploadCmd represents the upload command
 var uploadCmd = &cobra.Command{
-	Use:   "upload <files>...",
+	Use:   "upload <files or directories>...",
 	Short: "Upload images to Flickr",
 	Long: `Upload images to Flickr
 
@@ -61,10 +132,45 @@ var uploadCmd = &cobra.Command{
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 
+		// Read the value of --resume (if it is missing, the value is false)
+		resume, err := cmd.Flags().GetBool("resume")
+		if err != nil {
+			resume = false
+		}
+
+		session, err := OpenUploadSession()
+		if err != nil {
+			fmt.Printf("Error: Unable to read the upload session: %v\n", err)
+			exit(1)
+		}
+
+		// With --resume and no files, resume every incomplete upload in the session. Entries for files that no
+		// longer exist can't be finished, so they are removed.
+		if len(args) == 0 && resume {
+			for _, entry := range session.Incomplete() {
+				if _, err := os.Stat(entry.Filename); os.IsNotExist(err) {
+					fmt.Printf("Removing %s from the upload session as it no longer exists.\n", entry.Filename)
+					if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+						continue
+					}
+					if err := session.Remove(entry.Filename); err != nil {
+						fmt.Printf("Warning: Unable to update the upload session: %v\n", err)
+					}
+					continue
+				}
+				args = append(args, entry.Filename)
+			}
+			if len(args) == 0 {
+				fmt.Println("There are no incomplete uploads to resume.")
+				return
+			}
+		}
+
 		if len(args) == 0 {
 			fmt.Println("Error: At least one file must be specified.")
-			os.Exit(2)
+			exit(2)
 		}
+		args = selectFiles(cmd, args)
 
 		// Read the value of --force (if it is missing, the value is false)
 		forceUpload, err := cmd.Flags().GetBool("force")
@@ -94,6 +200,30 @@ var uploadCmd = &cobra.Command{
 			verbose = true
 		}
 
+		// Read the value of --replace and --replace-metadata (if they are missing, the values are false)
+		replace, err := cmd.Flags().GetBool("replace")
+		if err != nil {
+			replace = false
+		}
+		replaceMeta, err := cmd.Flags().GetBool("replace-metadata")
+		if err != nil {
+			replaceMeta = false
+		}
+		if replaceMeta && !replace {
+			fmt.Println("Error: --replace-metadata can only be used with --replace.")
+			exit(2)
+		}
+		if replace && (forceUpload || resume || cmd.Flags().Changed("album") || cmd.Flags().Changed("create-album")) {
+			fmt.Println("Error: --replace cannot be used with --force, --resume, --album or --create-album.")
+			exit(2)
+		}
+
+		// Read the value of --jobs (if it is missing, the value is 1)
+		jobs, err := cmd.Flags().GetInt("jobs")
+		if err != nil || jobs < 1 {
+			jobs = 1
+		}
+
 		var albums []Album
 		var album Album
 
@@ -137,38 +267,47 @@ var uploadCmd = &cobra.Command{
 		convertCmd := config.Cmd.Convert
 		if convertCmd == "" {
 			fmt.Println("Error: cmd.convert needs to be configured.")
-			fmt.Println("Config file:", viper.ConfigFileUsed(), "\n")
-			os.Exit(2)
+			fmt.Println("Config file:", viper.ConfigFileUsed())
+			fmt.Println()
+			exit(2)
 		}
 
-		var photoIds []string
-		for _, filename := range args {
-			// If the extension is tiff, then convert to jpeg
-			var jpegFilename string
-			var err error
-			if filepath.Ext(filename) == ".tiff" {
-				fmt.Printf("Converting %s to JPEG\n", filepath.Base(filename))
-				jpegFilename, err = convertFileToJpeg(filename, convertCmd)
-				if err != nil {
-					fmt.Printf("Error: Failed to convert %s to JPEG\n", filename)
-					continue
+		options := uploadOptions{
+			forceUpload: forceUpload,
+			dryRun:      dryRun,
+			resume:      resume,
+			replace:     replace,
+			replaceMeta: replaceMeta,
+			album:       &album,
+			convertCmd:  convertCmd,
+			jobs:        jobs,
+			session:     session,
+			failures:    &failureList{},
+			rules:       getRules(config),
+			metadata:    getMetadataReader(config),
+			writer:      getMetadataWriter(config),
+		}
+		checkKeywordWriting(options.rules, config)
+
+		// The uploaded lists of earlier versions of Rodeo are imported before the first real upload. A dry run
+		// doesn't change anything, so it only says that they need importing.
+		uploadedLists := uploadedListsToImport(args)
+		if dryRun {
+			for _, filename := range uploadedLists {
+				command := "rodeo history import"
+				if filename != GlobalUploadedListFilename() {
+					command += " " + filepath.Dir(filename)
 				}
-				filename = jpegFilename
+				fmt.Printf("Note: %s has not been imported into the upload history, so the images in it are not "+
+					"recognised as uploaded. Run `%s` to import it.\n", filename, command)
 			}
+		} else {
+			importUploadedLists(uploadedLists)
+		}
 
-			// Upload the file to Flickr
-			photoId := uploadFile(filename, forceUpload, dryRun, &album)
-			if photoId != "" {
-				photoIds = append(photoIds, photoId)
-			}
+		photoIds := uploadFiles(args, options)
 
-			if jpegFilename != "" {
-				err = os.Remove(jpegFilename)
-				if err != nil {
-					fmt.Printf("Error: Failed to delete %s.\n", jpegFilename)
-				}
-			}
-		}
+		printFailures(options.failures)
 
 		fmt.Println("All Done")
 		fmt.Printf("View: http://www.flickr.com/photos/%s'\n", viper.GetString("flickr.username"))
@@ -176,219 +315,326 @@ var uploadCmd = &cobra.Command{
 		if len(photoIds) > 0 {
 			fmt.Printf("Edit: http://www.flickr.com/photos/upload/edit/?ids=%s\n", strings.Join(photoIds, ","))
 		}
+
+		if options.failures.len() > 0 {
+			exit(1)
+		}
 	},
 }
 
-func debug(format string, a ...interface{}) {
+// Print the failures that happened during the upload, noting whether they were permanent or whether retrying them
+// later may help
+func printFailures(failures *failureList) {
+	if len(failures.items) == 0 {
+		return
+	}
+
+	fmt.Printf("%d step%s failed:\n", len(failures.items), PluralS(len(failures.items)))
+	for _, failure := range failures.items {
+		reason := ""
+		if flickrErr, ok := failure.err.(*FlickrError); ok {
+			if flickrErr.MayHaveSucceeded {
+				reason = " [Flickr may have received it: check your photostream before trying again]"
+			} else if flickrErr.Transient {
+				reason = " [temporary failure: try again later]"
+			} else {
+				reason = " [permanent failure]"
+			}
+		}
+		fmt.Printf("  - %s: %v%s\n", failure.filename, failure.err, reason)
+	}
+	fmt.Println("")
+}
+
+// Report a failure to upload the file and record it for the end-of-run summary
+func reportFailure(out io.Writer, options uploadOptions, filename string, err error) {
+	fmt.Fprintf(out, "Error: %v\n", err)
+	options.failures.add(filename, err)
+}
+
+func debug(out io.Writer, format string, a ...interface{}) {
 	if verbose {
 		message := fmt.Sprintf(format, a...)
-		fmt.Println("DEBUG: " + message)
+		fmt.Fprintln(out, "DEBUG: "+message)
 	}
 }
 
-func uploadFile(filename string, forceUpload bool, dryRun bool, album *Album) string {
-	fmt.Println("Processing " + filename)
+// Upload the files using a pool of `options.jobs` workers and return the IDs of the uploaded photos in the same
+// order as `filenames`
+func uploadFiles(filenames []string, options uploadOptions) []string {
+	results := make([]string, len(filenames))
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < options.jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = processFile(filenames[i], options)
+			}
+		}()
+	}
 
-	config := GetConfig()
+	// On Ctrl-C, stop handing out files so that those in progress can finish cleanly. A second Ctrl-C quits
+	// immediately and the upload session records how far each file got so that it can be resumed.
+	interrupted := make(chan os.Signal, 2)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+
+dispatch:
+	for i := range filenames {
+		select {
+		case indexes <- i:
+		case <-interrupted:
+			fmt.Println("Interrupted: waiting for the files in progress to finish. Press Ctrl-C again to quit now.")
+			go func() {
+				<-interrupted
+				fmt.Println("Run `rodeo upload --resume` to finish the incomplete uploads.")
+				exit(130)
+			}()
+			break dispatch
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	var photoIds []string
+	for _, photoId := range results {
+		if photoId != "" {
+			photoIds = append(photoIds, photoId)
+		}
+	}
+	return photoIds
+}
+
+// Convert the file if required and then upload it to Flickr.
+//
+// When more than one job is running, the output for this file is buffered and printed in one go once the file has
+// been processed so that it is not interleaved with the output of the other files.
+func processFile(filename string, options uploadOptions) string {
+	var out io.Writer = os.Stdout
+	if options.jobs > 1 {
+		var buffer bytes.Buffer
+		out = &buffer
+		defer func() {
+			outputMutex.Lock()
+			defer outputMutex.Unlock()
+			_, _ = os.Stdout.Write(buffer.Bytes())
+		}()
+	}
+
+	// Finish off a file that was uploaded in an earlier run that did not complete
+	if options.resume {
+		entry := options.session.Get(filename)
+		if entry != nil && entry.PhotoId == "" {
+			var err error
+			entry, err = findInterruptedUpload(out, *entry, options)
+			if err != nil {
+				reportFailure(out, options, filename, err)
+				return ""
+			}
+		}
+		if entry != nil {
+			return resumeUpload(out, *entry, options)
+		}
+	}
+
+	// Upload the file to Flickr
+	return uploadFile(out, filename, options)
+}
 
-	exiftool := config.Cmd.Exiftool
-	if exiftool == "" {
-		fmt.Println("Error: cmd.exiftool needs to be configured.")
-		fmt.Println("Config file:", viper.ConfigFileUsed(), "\n")
-		os.Exit(2)
+// Read the metadata of the file that is uploaded. If it was converted, then the sidecar is that of the file that it was
+// converted from.
+func readUploadMetadata(metadata MetadataReader, filename string, sourceFilename string) (*ImageInfo, error) {
+	if reader, ok := metadata.(SidecarReader); ok {
+		return reader.ReadMetadataWithSidecarOf(filename, sourceFilename)
 	}
+	return metadata.ReadMetadata(filename)
+}
+
+// Upload the file to Flickr. A TIFF is converted to a JPEG to upload, but the upload history and session record the
+// file given on the command line, `sourceFilename`, so that it is found again whatever the converter produces.
+func uploadFile(out io.Writer, sourceFilename string, options uploadOptions) string {
+	fmt.Fprintln(out, "Processing "+sourceFilename)
+
+	config := GetConfig()
 
 	// Has this image been uploaded before?
-	if uploadedPhotoId := getUploadedPhotoId(filename, config.Upload.StoreUploadListInImageDir); uploadedPhotoId != "" {
-		fmt.Print("This image has already been uploaded to Flickr.")
-		if forceUpload == true {
-			fmt.Println(" Forcing upload.")
+	uploadedPhotoId := getUploadedPhotoId(out, sourceFilename, options.replace, options.dryRun)
+	if options.replace {
+		if uploadedPhotoId == "" {
+			fmt.Fprintln(out, "This image has not been uploaded to Flickr before, so there is no photo to replace.")
+			fmt.Fprintln(out, "")
+			return ""
+		}
+		fmt.Fprintf(out, "Will replace the image of photo %s\n", uploadedPhotoId)
+	} else if uploadedPhotoId != "" {
+		fmt.Fprint(out, "This image has already been uploaded to Flickr.")
+		if options.forceUpload == true {
+			fmt.Fprintln(out, " Forcing upload.")
 		} else {
-			fmt.Printf("\nView this photo: http://www.flickr.com/photos/%s/%s\n", config.Flickr.Username, uploadedPhotoId)
-			fmt.Println("")
+			fmt.Fprintf(out, "\nView this photo: http://www.flickr.com/photos/%s/%s\n", config.Flickr.Username, uploadedPhotoId)
+			if entry := options.session.Get(sourceFilename); entry != nil {
+				fmt.Fprintln(out, "Some steps of this upload did not complete. Run `rodeo upload --resume` to finish them.")
+			}
+			fmt.Fprintln(out, "")
 			return ""
 		}
+	} else if entry := options.session.Get(sourceFilename); entry != nil && entry.PhotoId == "" && !options.resume &&
+		!options.forceUpload {
+		fmt.Fprintln(out, "An earlier upload of this image may have reached Flickr. Run `rodeo upload --resume` to look "+
+			"for it in your photostream, or use --force to upload it again.")
+		fmt.Fprintln(out, "")
+		return ""
 	}
 
-	info, err := GetImageInfo(filename, exiftool)
+	// If the file is a TIFF, then convert to jpeg
+	filename := sourceFilename
+	if ext := strings.ToLower(filepath.Ext(filename)); ext == ".tif" || ext == ".tiff" {
+		fmt.Fprintf(out, "Converting %s to JPEG\n", filepath.Base(filename))
+		jpegFilename, err := convertFileToJpeg(out, filename, options.convertCmd)
+		if err != nil {
+			reportFailure(out, options, filename, fmt.Errorf("failed to convert to JPEG: %v", err))
+			return ""
+		}
+		defer func() {
+			if err := os.Remove(jpegFilename); err != nil {
+				fmt.Fprintf(out, "Error: Failed to delete %s.\n", jpegFilename)
+			}
+		}()
+		filename = jpegFilename
+	}
+
+	info, err := readUploadMetadata(options.metadata, filename, sourceFilename)
 	if err != nil {
+		reportFailure(out, options, sourceFilename, fmt.Errorf("failed to read the metadata: %v", err))
 		return ""
 	}
 
 	if veryVerbose {
 		infoJSON, err := json.MarshalIndent(info, "", "  ")
 		if err != nil {
-			fmt.Printf("Error marshaling info to JSON: %v\n", err)
+			fmt.Fprintf(out, "Error marshaling info to JSON: %v\n", err)
 		} else {
-			fmt.Println("Image metadata:")
-			fmt.Println(string(infoJSON))
-			fmt.Println()
+			fmt.Fprintln(out, "Image metadata:")
+			fmt.Fprintln(out, string(infoJSON))
+			fmt.Fprintln(out)
 		}
 
 		if info.X != nil && len(info.X) > 0 {
 			xJSON, err := json.MarshalIndent(info.X, "", "  ")
 			if err != nil {
-				fmt.Printf("Error marshaling X to JSON: %v\n", err)
+				fmt.Fprintf(out, "Error marshaling X to JSON: %v\n", err)
 			} else {
-				fmt.Println("All metadata (X):")
-				fmt.Println(string(xJSON))
-				fmt.Println()
+				fmt.Fprintln(out, "All metadata (X):")
+				fmt.Fprintln(out, string(xJSON))
+				fmt.Fprintln(out)
 			}
 		}
 	}
 
 	// process rules
-	var keywordsToRemove []string
-	var keywordsToAdd []string
 	var albumsToAddTo []Album
-	var privacy Permissions
-	privacy.SetDefaults()
 
-	if album.Name != "" {
-		albumsToAddTo = append(albumsToAddTo, *album)
+	albumMutex.Lock()
+	if options.album.Name != "" {
+		albumsToAddTo = append(albumsToAddTo, *options.album)
 	}
+	albumMutex.Unlock()
 
-	if config.Rules != nil {
-		for _, rule := range config.Rules {
-			debug("Looking at rule '%s'", rule.Name)
-			excludesAll := rule.Condition.ExcludesAll
-			excludesAny := rule.Condition.ExcludesAny
-			includesAll := rule.Condition.IncludesAll
-			includesAny := rule.Condition.IncludesAny
-
-			var intersection []string // applicable keywords from the condition
-
-			// If the list of keywords for this image has all of `excludesAll`, then the rule is ignored
-			if len(excludesAll) > 0 {
-				intersection = Intersection(info.Keywords, excludesAll)
-				if len(intersection) == len(excludesAll) {
-					// Every `excludesAll` keyword is in info.Keywords, so this rule does not apply
-					debug("Excluding due to `excludesAll`")
-					continue
-				}
-				//fmt.Println("`excludesAll` condition does not apply")
-			}
-
-			// If the list of keywords for this image has any from `excludesAny`, then the rule is ignored
-			if len(excludesAny) > 0 {
-				intersection = Intersection(info.Keywords, excludesAny)
-				if len(intersection) > 0 {
-					// At least one `excludesAny` keyword is in info.Keywords, so this rule does not apply
-					debug("Excluding due to `excludesAny`")
-					continue
-				}
-				//fmt.Println("`excludesAny` condition does not apply")
-			}
-
-			processRules := false
-			if len(includesAll) > 0 {
-				//  info.Keywords must contain all keywords in `includesAll`
-				intersection = Intersection(info.Keywords, includesAll)
-				if len(intersection) != len(includesAll) {
-					// All `includesAll` keywords do not exist, so this rule does not apply
-					debug("Excluding due to `includesAll`")
-					continue
-				}
-				//fmt.Println("`includesAll` condition is met")
-				processRules = true
-			} else if len(includesAny) > 0 {
-				//  info.Keywords must contain all keywords in `includesAny`
-				intersection = Intersection(info.Keywords, includesAny)
-				if len(intersection) == 0 {
-					// There are no `includesAny` keywords in info.Keywords, so this rule does not apply
-					debug("Excluding due to `includesAny`")
-					continue
-				}
-				//fmt.Println("`includesAny` condition is met")
-				processRules = true
-			}
-
-			if processRules {
-				debug("Will process rules")
-				debug("Applicable keywords: %s", strings.Join(intersection, ", "))
-				if rule.Action.Delete {
-					keywordsToRemove = append(keywordsToRemove, intersection...)
-				}
-				if rule.Action.Privacy != nil {
-					privacy = *rule.Action.Privacy
-				}
-				if len(rule.Action.Albums) > 0 {
-					for _, thisAlbum := range rule.Action.Albums {
-						albumsToAddTo = append(albumsToAddTo, thisAlbum)
-					}
-				}
-			}
-		}
-	} else {
-		debug("No config found")
+	plan := evaluateRules(out, options.rules, info, config)
+	keywordsToRemove := plan.KeywordsToRemove
+	for _, album := range plan.Albums {
+		albumsToAddTo = rules.AppendAlbum(albumsToAddTo, album)
 	}
+	privacy := plan.Privacy
 
 	// Set the keywords to be added to the Flickr photo record
-	if len(keywordsToRemove) > 0 {
-		difference := Difference(info.Keywords, keywordsToRemove)
-		keywordsToAdd = difference
-	} else {
-		keywordsToAdd = info.Keywords
+	keywordsToAdd := plan.Tags
+	fileKeywordsToRemove := plan.FileKeywordsToRemove
+	fileKeywordsToAdd := plan.FileKeywordsToAdd
+
+	// A replaced photo keeps its existing privacy and album memberships
+	if options.replace {
+		albumsToAddTo = nil
 	}
 
 	// output what we are going to do
-	if len(keywordsToRemove) > 0 || len(albumsToAddTo) > 0 {
-		fmt.Printf("Actions:\n")
+	if options.dryRun || verbose {
+		for _, applied := range plan.Applied {
+			fmt.Fprintf(out, "Rule '%s' applies", applied.Name)
+			if len(applied.Keywords) > 0 {
+				fmt.Fprintf(out, ", matching keyword%s: %s", PluralS(applied.Keywords), strings.Join(applied.Keywords, ", "))
+			}
+			fmt.Fprintln(out)
+		}
+	}
+	if len(plan.Applied) > 0 || plan.License != nil || len(albumsToAddTo) > 0 {
+		fmt.Fprintf(out, "Actions:\n")
 		if len(keywordsToRemove) > 0 {
-			fmt.Printf("  - keywords to remove: %s\n", strings.Join(keywordsToRemove, ", "))
+			fmt.Fprintf(out, "  - keywords to remove: %s\n", strings.Join(keywordsToRemove, ", "))
+		}
+		if plan.TagsChanged {
+			fmt.Fprintf(out, "  - tags will be set to: %s\n", strings.Join(keywordsToAdd, ", "))
+		}
+		if len(fileKeywordsToAdd) > 0 {
+			fmt.Fprintf(out, "  - keywords to write to the file: %s\n", strings.Join(fileKeywordsToAdd, ", "))
 		}
 
-		fmt.Printf("  - privacy will be set to: Family: %v, Friends: %v, Public: %v\n", privacy.Family, privacy.Friends, privacy.Public)
+		if !options.replace {
+			fmt.Fprintf(out, "  - privacy will be set to: Family: %v, Friends: %v, Public: %v\n", privacy.Family, privacy.Friends, privacy.Public)
+			fmt.Fprintf(out, "  - safety level: %s, content type: %s, hidden: %v\n", plan.SafetyLevel, plan.ContentType, plan.Hidden)
+			if plan.License != nil {
+				fmt.Fprintf(out, "  - license will be set to: %d\n", *plan.License)
+			}
+		}
 
 		if len(albumsToAddTo) > 0 {
 			strs := make([]string, len(albumsToAddTo))
 			for i, a := range albumsToAddTo {
 				strs[i] = a.Name
 			}
-			fmt.Printf("  - albums to add to: \"%s\"\n", strings.Join(strs, "\", \""))
+			fmt.Fprintf(out, "  - albums to add to: \"%s\"\n", strings.Join(strs, "\", \""))
 		}
 	}
 
-	title := strings.Trim(info.Title, " ")
-	fmt.Printf("  - title will be set to \"%s\"\n", title)
-	fmt.Printf("\n")
+	title := plan.Title
+	fmt.Fprintf(out, "  - title will be set to \"%s\"\n", title)
+	fmt.Fprintf(out, "\n")
 
 	// All ready to process now
-	if dryRun {
-		fmt.Println("Would upload photo to Flickr")
+	if options.dryRun {
+		if options.replace {
+			fmt.Fprintln(out, "Would replace photo on Flickr")
+		} else {
+			fmt.Fprintln(out, "Would upload photo to Flickr")
+		}
 		return ""
 	}
 
-	if len(keywordsToRemove) > 0 && exiftool != "" {
-		// Format of command: exiftool -overwrite_original -keywords-=one -keywords-=two FILENAME
-		var parameters []string
-		parameters = append(parameters, "-overwrite_original")
-		for _, k := range keywordsToRemove {
-			parameters = append(parameters, fmt.Sprintf("-keywords-=%s", k))
-			parameters = append(parameters, fmt.Sprintf("-subject-=%s", k))
-		}
-		parameters = append(parameters, filename)
-		//fmt.Println("Removing keywords from photo")
-		cmd := exec.Command(exiftool, parameters...)
-		cmd.Dir = filepath.Dir(filename)
-		if err := cmd.Run(); err != nil {
-			fmt.Println("Error: ", err)
+	if (len(fileKeywordsToRemove) > 0 || len(fileKeywordsToAdd) > 0) && options.writer != nil {
+		// A sidecar belongs to the file given on the command line rather than to the converted file that is uploaded
+		update := MetadataUpdate{AddKeywords: fileKeywordsToAdd, RemoveKeywords: fileKeywordsToRemove}
+		if err := options.writer.WriteMetadata(filename, sourceFilename, update); err != nil {
+			fmt.Fprintf(out, "Error: Failed to update the keywords in the file: %v\n", err)
 		}
 	}
 
 	// Upload file to Flickr
-	fmt.Println("Uploading photo to Flickr")
+	fmt.Fprintln(out, "Uploading photo to Flickr")
 
-	client, err := GetFlickrClient()
+	flickrClient, err := GetFlickrClient()
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(out, err)
 		return ""
 	}
+	client := NewRetryingClient(flickrClient, config.Upload.Retry, out)
 
 	if title == "" {
 		// no title - use filename (without extension)
-		title = filepath.Base(filename)
-		title = strings.TrimSuffix(title, filepath.Ext(filename))
+		title = filepath.Base(sourceFilename)
+		title = strings.TrimSuffix(title, filepath.Ext(sourceFilename))
 	}
 
 	// Upload photo
@@ -405,162 +651,401 @@ func uploadFile(filename string, forceUpload bool, dryRun bool, album *Album) st
 		IsFamily:    privacy.Family,
 		IsFriend:    privacy.Friends,
 		IsPublic:    privacy.Public,
-		ContentType: 1, // photo
-		Hidden:      1, // not hidden
-		SafetyLevel: 1, // safe
+		ContentType: ContentTypes[plan.ContentType],
+		Hidden:      HiddenValue(plan.Hidden),
+		SafetyLevel: SafetyLevels[plan.SafetyLevel],
 	}
 	if info.Description != "" {
 		params.Description = info.Description
 	}
 
-	response, err := flickr.UploadFile(client, filename, &params)
+	if options.replace {
+		return replacePhoto(out, client, filename, sourceFilename, uploadedPhotoId, info, &params, options)
+	}
+
+	// Record the steps to be done for this file in the upload session before uploading so that they can be resumed
+	// if we are interrupted
+	entry := SessionEntry{Filename: sourceFilename, Title: title}
+	if config.Upload.SetDatePosted == true && info.Date != nil {
+		// set date posted to the date that the photo was taken so that it's in the right place
+		// in the Flickr photo stream
+		entry.DatePosted = fmt.Sprintf("%d", info.Date.Unix())
+	}
+	entry.License = plan.License
+	for _, thisAlbum := range albumsToAddTo {
+		entry.Albums = append(entry.Albums, SessionAlbum{Id: thisAlbum.Id, Name: thisAlbum.Name})
+	}
+	warnOnSessionError(out, options.session.Start(entry))
+
+	photoId, err := client.UploadFile(filename, &params)
 	if err != nil {
-		fmt.Println(err)
+		reportFailure(out, options, sourceFilename, err)
+		if flickrErr, ok := err.(*FlickrError); ok && flickrErr.MayHaveSucceeded {
+			// Keep the entry so that --resume can look for the photo rather than uploading it again
+			fmt.Fprintln(out, "Flickr may have received the photo. Run `rodeo upload --resume` to look for it in your "+
+				"photostream.")
+		} else {
+			warnOnSessionError(out, options.session.Remove(sourceFilename))
+		}
 		return ""
 	}
-	photoId := response.ID
-	recordUpload(filename, photoId, config.Upload.StoreUploadListInImageDir)
-	fmt.Printf("Uploaded photo '%s'\n", title)
+	recordUpload(out, sourceFilename, photoId, info, title)
+	warnOnSessionError(out, options.session.Update(sourceFilename, func(entry *SessionEntry) {
+		entry.PhotoId = photoId
+	}))
+	fmt.Fprintf(out, "Uploaded photo '%s'\n", title)
 
-	// set date posted to the date that the photo was taken so that it's in the right place
-	// in the Flickr photo stream
-	setDatePosted := config.Upload.SetDatePosted
-	if setDatePosted == true && info.Date != nil {
-		datePosted := fmt.Sprintf("%d", info.Date.Unix())
-		respSetDate, err := photos.SetDates(client, photoId, datePosted, "")
-		if err != nil {
-			// noinspection GoNilness
-			fmt.Printf("Failed update photo %v's date posted: %v\n%v\n", photoId, err, respSetDate.ErrorMsg())
+	completeUpload(out, client, sourceFilename, options)
+
+	fmt.Fprintf(out, "View this photo: http://www.flickr.com/photos/%s/%s\n", config.Flickr.Username, photoId)
+	fmt.Fprintln(out, "")
+	return photoId
+}
+
+// Replace the image of a photo that is already on Flickr with `filename`, which was converted from `sourceFilename`
+// if that is a TIFF. The photo's page, comments, faves, privacy and album memberships are kept. If
+// options.replaceMeta is set, then the title, description and tags from `params` are also set on the photo.
+func replacePhoto(out io.Writer, client *RetryingClient, filename string, sourceFilename string, photoId string,
+	info *ImageInfo, params *flickr.UploadParams, options uploadOptions) string {
+	fmt.Fprintln(out, "Replacing photo on Flickr")
+
+	if err := client.ReplaceFile(photoId, filename); err != nil {
+		reportFailure(out, options, sourceFilename, err)
+		return ""
+	}
+	recordUpload(out, sourceFilename, photoId, info, params.Title)
+	fmt.Fprintf(out, "Replaced photo %s\n", photoId)
+
+	if options.replaceMeta {
+		if err := client.SetPhotoMeta(photoId, params.Title, params.Description); err != nil {
+			reportFailure(out, options, sourceFilename, err)
+		} else {
+			fmt.Fprintf(out, "Set title to \"%s\"\n", params.Title)
+		}
+
+		if err := client.SetPhotoTags(photoId, params.Tags); err != nil {
+			reportFailure(out, options, sourceFilename, err)
+		} else {
+			fmt.Fprintf(out, "Set tag%s: %s\n", PluralS(params.Tags), strings.Join(params.Tags, " "))
 		}
 	}
 
-	if len(albumsToAddTo) > 0 {
-		// assign photo to each photoset in the list
-		for _, thisAlbum := range albumsToAddTo {
-			if thisAlbum.Id == "" {
-				// create new photoset on Flickr
-				respAdd, err := photosets.Create(client, thisAlbum.Name, "", photoId)
-				if err != nil {
-					// noinspection GoNilness
-					fmt.Println("Failed to create photoset: "+thisAlbum.Name, err, respAdd.ErrorMsg())
-				} else {
-					if album.Name == thisAlbum.Name {
-						album.Id = respAdd.Set.Id
-					}
-					fmt.Println("Added photo", photoId, "to new set", album.String())
-				}
-			} else {
-				// add to this photoset on Flickr
-				respAdd, err := photosets.AddPhoto(client, thisAlbum.Id, photoId)
-				if err != nil {
-					// noinspection GoNilness
-					fmt.Println("Failed adding photo to the set: "+thisAlbum.String(), err, respAdd.ErrorMsg())
-				} else {
-					fmt.Println("Added photo", photoId, "to set", thisAlbum.String())
-				}
+	fmt.Fprintf(out, "View this photo: http://www.flickr.com/photos/%s/%s\n", GetConfig().Flickr.Username, photoId)
+	fmt.Fprintln(out, "")
+	return photoId
+}
+
+// Finish the steps of an upload that were not completed in an earlier run
+func resumeUpload(out io.Writer, entry SessionEntry, options uploadOptions) string {
+	fmt.Fprintf(out, "Resuming upload of %s (photo %s)\n", entry.Filename, entry.PhotoId)
+
+	if options.dryRun {
+		if entry.DatePosted != "" && !entry.DatesSet {
+			fmt.Fprintln(out, "Would set the date posted")
+		}
+		if entry.License != nil && !entry.LicenseSet {
+			fmt.Fprintf(out, "Would set the license to %d\n", *entry.License)
+		}
+		for _, thisAlbum := range entry.Albums {
+			if !thisAlbum.Added {
+				fmt.Fprintf(out, "Would add photo to album \"%s\"\n", thisAlbum.Name)
 			}
 		}
+		fmt.Fprintln(out, "")
+		return ""
 	}
 
-	fmt.Printf("View this photo: http://www.flickr.com/photos/%s/%s\n", config.Flickr.Username, photoId)
-	fmt.Println("")
-	return photoId
+	flickrClient, err := GetFlickrClient()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return ""
+	}
+	client := NewRetryingClient(flickrClient, GetConfig().Upload.Retry, out)
+
+	completeUpload(out, client, entry.Filename, options)
+
+	fmt.Fprintf(out, "View this photo: http://www.flickr.com/photos/%s/%s\n", GetConfig().Flickr.Username, entry.PhotoId)
+	fmt.Fprintln(out, "")
+	return entry.PhotoId
 }
 
-// Convert file to JPEG using convert
-func convertFileToJpeg(filename string, convertCmd string) (string, error) {
-	jpegFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".jpeg"
+// Find the photo of an upload that was started in an earlier run but has no photo ID in the session because Rodeo
+// stopped before Flickr replied. The photo is looked for in the upload history and then in the photostream. If it is
+// found, then the entry is updated so that its other steps can be resumed. Otherwise it is removed from the session,
+// so that the file is uploaded again, and nil is returned.
+func findInterruptedUpload(out io.Writer, entry SessionEntry, options uploadOptions) (*SessionEntry, error) {
+	photoId := getUploadedPhotoId(out, entry.Filename, true, options.dryRun)
+	if photoId != "" {
+		fmt.Fprintf(out, "Found the interrupted upload of %s in the upload history as photo %s\n", entry.Filename, photoId)
+	} else {
+		var err error
+		photoId, err = findUploadOnFlickr(out, entry)
+		if err != nil {
+			return nil, fmt.Errorf("unable to look for the interrupted upload in your photostream: %v", err)
+		}
+		if photoId == "" {
+			fmt.Fprintf(out, "The upload of %s was interrupted before Flickr replied and the photo is not in the "+
+				"upload history or your photostream, so it will be uploaded again.\n", entry.Filename)
+			if !options.dryRun {
+				warnOnSessionError(out, options.session.Remove(entry.Filename))
+			}
+			return nil, nil
+		}
 
-	cmd := exec.Command(convertCmd, filename, jpegFilename)
-	_, err := cmd.Output()
+		fmt.Fprintf(out, "Found the interrupted upload of %s in your photostream as photo %s\n", entry.Filename, photoId)
+		if !options.dryRun {
+			info, err := options.metadata.ReadMetadata(entry.Filename)
+			if err != nil {
+				info = &ImageInfo{}
+			}
+			recordUpload(out, entry.Filename, photoId, info, entry.Title)
+		}
+	}
+
+	entry.PhotoId = photoId
+	if !options.dryRun {
+		warnOnSessionError(out, options.session.Update(entry.Filename, func(entry *SessionEntry) {
+			entry.PhotoId = photoId
+		}))
+	}
+	return &entry, nil
+}
+
+// How much earlier than the start of an upload Flickr may record it as uploaded, as the clocks of this computer and
+// Flickr's servers may differ
+const uploadClockSkew = 10 * time.Minute
+
+// Look in the photostream for the photo of an interrupted upload: one with the same title that was uploaded after
+// the upload started. Returns "" if there is no such photo.
+func findUploadOnFlickr(out io.Writer, entry SessionEntry) (string, error) {
+	flickrClient, err := GetFlickrClient()
 	if err != nil {
-		fmt.Printf("%s\n", err.(*exec.ExitError).Stderr)
 		return "", err
 	}
+	client := NewRetryingClient(flickrClient, GetConfig().Upload.Retry, out)
 
-	return jpegFilename, nil
+	// The photostream is in the order of the date posted, newest first
+	since := entry.Started.Add(-uploadClockSkew).Unix()
+	for page, pages := 1, 1; page <= pages; page++ {
+		response, err := client.GetMyPhotos(page, MaxPhotosPerPage)
+		if err != nil {
+			return "", err
+		}
+		pages = response.Photos.Pages
+
+		for _, photo := range response.Photos.Photos {
+			uploaded, err := strconv.ParseInt(photo.DateUpload, 10, 64)
+			if err != nil {
+				continue
+			}
+			if uploaded < since {
+				return "", nil
+			}
+			if photo.Title == entry.Title {
+				return photo.Id, nil
+			}
+		}
+	}
+	return "", nil
 }
 
-func getUploadedListFilename(imageFilename string, storeUploadListInImageDirectory bool) string {
-	var directory string
+// Run the steps that are still to be done for an uploaded photo, recording each one in the upload session as it
+// completes
+func completeUpload(out io.Writer, client *RetryingClient, filename string, options uploadOptions) {
+	entry := options.session.Get(filename)
+	if entry == nil {
+		return
+	}
+	photoId := entry.PhotoId
 
-	if storeUploadListInImageDirectory {
-		// File is stored in directory where image is and is hidden via a leading `.` on the imageFilename
-		directory = filepath.Dir(imageFilename)
-		return directory + "/." + uploadedListBaseFilename
+	if entry.DatePosted != "" && !entry.DatesSet {
+		err := client.SetDatePosted(photoId, entry.DatePosted)
+		if err != nil {
+			reportFailure(out, options, filename, err)
+		} else {
+			warnOnSessionError(out, options.session.Update(filename, func(entry *SessionEntry) {
+				entry.DatesSet = true
+			}))
+		}
 	}
 
-	// Storing to the config directory
-	return ConfigDir() + "/" + uploadedListBaseFilename
+	if entry.License != nil && !entry.LicenseSet {
+		err := client.SetLicense(photoId, *entry.License)
+		if err != nil {
+			reportFailure(out, options, filename, err)
+		} else {
+			fmt.Fprintf(out, "Set license to %d\n", *entry.License)
+			warnOnSessionError(out, options.session.Update(filename, func(entry *SessionEntry) {
+				entry.LicenseSet = true
+			}))
+		}
+	}
+
+	// assign photo to each photoset in the list
+	for i, thisAlbum := range entry.Albums {
+		if thisAlbum.Added {
+			continue
+		}
+
+		var albumId string
+		var err error
+		if thisAlbum.Id == "" {
+			albumId, err = addToNewAlbum(out, client, Album{Name: thisAlbum.Name}, photoId, options.album)
+		} else {
+			albumId, err = addToAlbum(out, client, Album{Id: thisAlbum.Id, Name: thisAlbum.Name}, photoId)
+		}
+		if err != nil {
+			reportFailure(out, options, filename, err)
+			continue
+		}
+
+		index := i
+		warnOnSessionError(out, options.session.Update(filename, func(entry *SessionEntry) {
+			entry.Albums[index].Id = albumId
+			entry.Albums[index].Added = true
+		}))
+		recordAlbum(out, photoId, Album{Id: albumId, Name: thisAlbum.Name})
+	}
 }
 
-// Has this file been uploaded to Flickr?
-// Check the `.rodeo-uploaded-files` file that resides in the same directory as `filename`
-func getUploadedPhotoId(filename string, storeUploadedListInImageDirectory bool) string {
-	uploadedListFilename := getUploadedListFilename(filename, storeUploadedListInImageDirectory)
-	filenames := readUploadedListFile(uploadedListFilename)
+func warnOnSessionError(out io.Writer, err error) {
+	if err != nil {
+		fmt.Fprintf(out, "Warning: Unable to update the upload session: %v\n", err)
+	}
+}
 
-	// Is imageFilename a key in the map?
-	imageFilename := filepath.Base(filename)
-	if photoId, ok := filenames[imageFilename]; ok {
-		// imageFilename exists, return its associated photoId
-		return photoId
+// Add the photo to an existing photoset on Flickr and return the album's ID
+func addToAlbum(out io.Writer, client *RetryingClient, album Album, photoId string) (string, error) {
+	err := client.AddPhotoToPhotoset(album.Id, photoId)
+	if err != nil {
+		return "", err
 	}
 
-	return ""
+	fmt.Fprintln(out, "Added photo", photoId, "to set", album.String())
+	return album.Id, nil
 }
 
-// Record the filename of the image uploaded into the uploaded list
-func recordUpload(filename string, photoId string, storeUploadedListInImageDirectory bool) {
-	imageFilename := filepath.Base(filename)
-	uploadedListFilename := getUploadedListFilename(filename, storeUploadedListInImageDirectory)
-	filenames := readUploadedListFile(uploadedListFilename)
+// Create a new photoset on Flickr with this photo as its primary photo and return the new album's ID.
+//
+// If the new album is the one given by --album or --create-album, then its ID is recorded in `album` so that
+// subsequent photos are added to it rather than creating it again. As other workers may be doing the same thing at
+// the same time, this is done with albumMutex held and if another worker got there first, the photo is added to the
+// album that it created.
+func addToNewAlbum(out io.Writer, client *RetryingClient, newAlbum Album, photoId string, album *Album) (string, error) {
+	albumMutex.Lock()
+	defer albumMutex.Unlock()
+
+	if album.Name == newAlbum.Name && album.Id != "" {
+		return addToAlbum(out, client, *album, photoId)
+	}
 
-	// If the imageFilename is already recorded, then there's nothing to do
-	if _, ok := filenames[imageFilename]; ok {
-		return
+	// create new photoset on Flickr
+	albumId, err := client.CreatePhotoset(newAlbum.Name, photoId)
+	if err != nil {
+		return "", err
 	}
 
-	// Filename not in list, so append to list and save
-	filenames[imageFilename] = photoId
-	writeUploadedListFile(filenames, uploadedListFilename)
+	newAlbum.Id = albumId
+	if album.Name == newAlbum.Name {
+		album.Id = newAlbum.Id
+	}
+	fmt.Fprintln(out, "Added photo", photoId, "to new set", newAlbum.String())
+	return newAlbum.Id, nil
 }
 
-// Read the uploaded list from the `uploadedListFilename` and convert to a map from the JSON
-func readUploadedListFile(uploadedListFilename string) map[string]string {
-	filenames := make(map[string]string)
+// Convert file to JPEG using convert
+func convertFileToJpeg(out io.Writer, filename string, convertCmd string) (string, error) {
+	jpegFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".jpeg"
 
-	// Does the file exist?
-	if _, err := os.Stat(uploadedListFilename); err == nil || os.IsExist(err) {
-		// File exists - therefore read it
-		data, err := ioutil.ReadFile(uploadedListFilename)
+	cmd := exec.Command(convertCmd, filename, jpegFilename)
+	_, err := cmd.Output()
+	if err != nil {
+		fmt.Fprintf(out, "%s\n", err.(*exec.ExitError).Stderr)
+		return "", err
+	}
+
+	return jpegFilename, nil
+}
+
+// Has this file been uploaded to Flickr?
+// Check the upload history for an image with the same content as `filename` and return its photo ID. If `byPath` is
+// set and there isn't one, then the photo uploaded from the same path is found instead, as the image may have been
+// edited since it was uploaded.
+//
+// A record imported from the original uploaded list format only has a filename, so unless this is a dry run, the
+// first image that it matches has its hash and path recorded so that other images with that filename don't match it.
+func getUploadedPhotoId(out io.Writer, filename string, byPath bool, dryRun bool) string {
+	uploadedListMutex.Lock()
+	defer uploadedListMutex.Unlock()
+
+	history, err := GetHistory()
+	if err != nil {
+		fmt.Fprintf(out, "Error: %v\n", err)
+		return ""
+	}
+
+	hash, err := ImageHash(filename)
+	if err != nil {
+		fmt.Fprintf(out, "Error: Unable to read %s: %v\n", filename, err)
+	}
+
+	record, err := history.FindUpload(filename, hash)
+	if err != nil {
+		fmt.Fprintf(out, "Error: %v\n", err)
+	}
+	if record == nil && byPath {
+		record, err = history.FindUploadByPath(filename)
 		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			return filenames
+			fmt.Fprintf(out, "Error: %v\n", err)
 		}
+		if record != nil {
+			debug(out, "Found the upload of %s by its path as its content has changed", filename)
+		}
+	}
+	if record == nil {
+		return ""
+	}
 
-		err = json.Unmarshal(data, &filenames)
+	if record.Hash == "" && hash != "" && !dryRun {
+		err := history.UpdateUpload(record.PhotoId, func(record *UploadRecord) error {
+			return record.SetFile(filename)
+		})
 		if err != nil {
-			fmt.Println("error:", err)
+			fmt.Fprintf(out, "Warning: Unable to record the hash of %s in the upload history: %v\n", filename, err)
 		}
 	}
-
-	return filenames
+	return record.PhotoId
 }
 
-// Write the uploaded list to the `uploadedListFilename` in JSON format
-func writeUploadedListFile(filenames map[string]string, uploadedListFilename string) {
-	// Convert to JSON
-	data, err := json.MarshalIndent(filenames, "", "  ")
+// Record the image uploaded as photoId in the upload history
+func recordUpload(out io.Writer, filename string, photoId string, info *ImageInfo, title string) {
+	uploadedListMutex.Lock()
+	defer uploadedListMutex.Unlock()
+
+	history, err := GetHistory()
 	if err != nil {
-		fmt.Println("error:", err)
+		fmt.Fprintf(out, "Error: %v\n", err)
+		return
 	}
 
-	// Write to disk
-	err = ioutil.WriteFile(uploadedListFilename, data, 0664)
+	record, err := NewUploadRecord(filename, photoId, title, info.Date)
 	if err != nil {
-		fmt.Printf("Error: Unable to write %s: %v", filepath.Base(uploadedListFilename), err)
-		return
+		fmt.Fprintf(out, "Error: Unable to read %s: %v\n", filename, err)
+	}
+
+	if err := history.RecordUpload(record); err != nil {
+		fmt.Fprintf(out, "Error: Unable to record the upload of %s: %v\n", filepath.Base(filename), err)
+	}
+}
+
+// Record in the upload history that the photo was added to this album
+func recordAlbum(out io.Writer, photoId string, album Album) {
+	history, err := GetHistory()
+	if err == nil {
+		err = history.AddAlbum(photoId, album)
+	}
+	if err != nil && err != ErrNoSuchUpload {
+		fmt.Fprintf(out, "Warning: Unable to record album %s in the upload history: %v\n", album.Name, err)
 	}
 }
 
@@ -0,0 +1,275 @@
+/*
+Copyright © 2020 Rob Allen <rob@akrabat.com>
+
+Use of this source code is governed by the MIT
+license that can be found in the LICENSE file or at
+https://akrabat.com/license/mit.
+*/
+
+/*
+Package cmd implements the commands for the app. In this case, checking the
+upload history against the photos on Flickr.
+*/
+package commands
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/akrabat/rodeo/internal"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	// Register command line options
+	verifyCmd.Flags().Bool("fix", false, "Update the history to match Flickr")
+	verifyCmd.Flags().BoolP("verbose", "v", false, "List the Flickr photos that have no record in the history")
+	verifyCmd.Flags().Float64("rate", 1, "Maximum number of Flickr API calls per second")
+}
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check the history of uploaded images against Flickr",
+	Long: `Check the history of uploaded images against Flickr
+
+Reports:
+- missing photos: recorded as uploaded, but no longer on Flickr, usually
+  because they were deleted using the Flickr website. These images will not be
+  uploaded again until their records are removed.
+- orphaned records: the image file that was uploaded no longer exists.
+- unrecorded photos: on Flickr, but not in the history. If one has the same
+  title and date taken as a missing photo, then it is most likely a new upload
+  of the same image.
+
+With --fix, the records of missing photos that match an unrecorded photo are
+changed to that photo and the other records of missing photos are removed.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Read the value of --fix (if it is missing, the value is false)
+		fix, err := cmd.Flags().GetBool("fix")
+		if err != nil {
+			fix = false
+		}
+
+		// Read the value of --verbose (if it is missing, the value is false)
+		verbose, err = cmd.Flags().GetBool("verbose")
+		if err != nil {
+			verbose = false
+		}
+
+		// Read the value of --rate (if it is missing, the value is 1)
+		rate, err := cmd.Flags().GetFloat64("rate")
+		if err != nil {
+			rate = 1
+		}
+
+		history := getHistory()
+		records, err := history.Uploads()
+		if err != nil {
+			fmt.Printf("Error: Unable to read the history: %v\n", err)
+			exit(1)
+		}
+
+		flickrClient, err := GetFlickrClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exit(1)
+		}
+		client := NewRetryingClient(flickrClient, GetConfig().Upload.Retry, os.Stdout)
+		client.SetRateLimiter(NewRateLimiter(rate))
+
+		photos, err := getAllPhotos(client)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exit(1)
+		}
+
+		result, err := verifyHistory(client, records, photos)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exit(1)
+		}
+
+		printVerifyResult(result)
+
+		if fix {
+			fixHistory(history, result)
+		} else if len(result.missing) > 0 {
+			fmt.Println()
+			fmt.Println("Run `rodeo verify --fix` to update the history.")
+		}
+	},
+}
+
+// A missingPhoto is a record of a photo that is no longer on Flickr
+type missingPhoto struct {
+	record UploadRecord
+	match  *FlickrPhoto // unrecorded photo with the same title and date taken
+}
+
+type verifyResult struct {
+	checked    int
+	missing    []missingPhoto
+	orphaned   []UploadRecord
+	unrecorded []FlickrPhoto
+}
+
+// Get every photo in the user's photostream
+func getAllPhotos(client *RetryingClient) (map[string]FlickrPhoto, error) {
+	photos := make(map[string]FlickrPhoto)
+	for page, pages := 1, 1; page <= pages; page++ {
+		response, err := client.GetMyPhotos(page, MaxPhotosPerPage)
+		if err != nil {
+			return nil, err
+		}
+		pages = response.Photos.Pages
+		fmt.Printf("Fetched page %d of %d of your photos from Flickr\n", page, pages)
+
+		for _, photo := range response.Photos.Photos {
+			photos[photo.Id] = photo
+		}
+	}
+	return photos, nil
+}
+
+// Compare the records with the photos on Flickr
+func verifyHistory(client *RetryingClient, records []UploadRecord, photos map[string]FlickrPhoto) (verifyResult, error) {
+	result := verifyResult{checked: len(records)}
+	recorded := make(map[string]bool)
+
+	for _, record := range records {
+		recorded[record.PhotoId] = true
+
+		if record.Path != "" {
+			if _, err := os.Stat(record.Path); os.IsNotExist(err) {
+				result.orphaned = append(result.orphaned, record)
+			}
+		}
+
+		if _, ok := photos[record.PhotoId]; ok {
+			continue
+		}
+
+		// The list of photos may be out of date if a photo was uploaded while it was being fetched
+		exists, err := client.PhotoExists(record.PhotoId)
+		if err != nil {
+			return result, err
+		}
+		if !exists {
+			result.missing = append(result.missing, missingPhoto{record: record})
+		}
+	}
+
+	for id, photo := range photos {
+		if !recorded[id] {
+			result.unrecorded = append(result.unrecorded, photo)
+		}
+	}
+
+	// Each unrecorded photo can only be the new upload of one missing photo
+	matched := make(map[string]bool)
+	for i := range result.missing {
+		missing := &result.missing[i]
+		for j := range result.unrecorded {
+			photo := &result.unrecorded[j]
+			if !matched[photo.Id] && isSamePhoto(missing.record, *photo) {
+				missing.match = photo
+				matched[photo.Id] = true
+				break
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// Does the Flickr photo have the same title and date taken as the record?
+func isSamePhoto(record UploadRecord, photo FlickrPhoto) bool {
+	if record.Title == "" || record.DateTaken == nil {
+		return false
+	}
+	return record.Title == photo.Title && record.DateTaken.Format("2006-01-02 15:04:05") == photo.DateTaken
+}
+
+func printVerifyResult(result verifyResult) {
+	fmt.Println()
+	fmt.Printf("Checked %d record%s\n", result.checked, PluralS(result.checked))
+
+	if len(result.missing) > 0 {
+		fmt.Println()
+		fmt.Printf("%d photo%s no longer on Flickr:\n", len(result.missing), PluralS(len(result.missing)))
+		for _, missing := range result.missing {
+			fmt.Printf("  - %s: %s", missing.record.PhotoId, describeRecord(missing.record))
+			if missing.match != nil {
+				fmt.Printf(" [probably uploaded again as %s]", missing.match.Id)
+			}
+			fmt.Println()
+		}
+	}
+
+	if len(result.orphaned) > 0 {
+		fmt.Println()
+		fmt.Printf("%d record%s whose image file no longer exists:\n", len(result.orphaned), PluralS(len(result.orphaned)))
+		for _, record := range result.orphaned {
+			fmt.Printf("  - %s: %s\n", record.PhotoId, record.Path)
+		}
+	}
+
+	if len(result.unrecorded) > 0 {
+		fmt.Println()
+		fmt.Printf("%d photo%s on Flickr with no record in the history\n", len(result.unrecorded),
+			PluralS(len(result.unrecorded)))
+		if verbose {
+			for _, photo := range result.unrecorded {
+				fmt.Printf("  - %s: %s (taken %s)\n", photo.Id, photo.Title, photo.DateTaken)
+			}
+		}
+	}
+
+	if len(result.missing) == 0 && len(result.orphaned) == 0 {
+		fmt.Println("The history matches Flickr")
+	}
+}
+
+// Apply the fixes for the missing photos to the history
+func fixHistory(history *History, result verifyResult) {
+	fmt.Println()
+	for _, missing := range result.missing {
+		photoId := missing.record.PhotoId
+		if missing.match != nil {
+			newPhotoId := missing.match.Id
+			err := history.UpdateUpload(photoId, func(record *UploadRecord) error {
+				record.PhotoId = newPhotoId
+				return nil
+			})
+			if err != nil {
+				fmt.Printf("Error: Photo %s: %v\n", photoId, err)
+				continue
+			}
+			fmt.Printf("Changed %s to photo %s\n", describeRecord(missing.record), newPhotoId)
+			continue
+		}
+
+		if err := history.RemoveUpload(photoId); err != nil {
+			fmt.Printf("Error: Photo %s: %v\n", photoId, err)
+			continue
+		}
+		fmt.Printf("Removed photo %s (%s) from the history\n", photoId, describeRecord(missing.record))
+	}
+}
+
+// A short description of the image that a record is for
+func describeRecord(record UploadRecord) string {
+	file := record.Path
+	if file == "" {
+		file = record.Filename
+	}
+	if record.Title == "" {
+		return file
+	}
+	return fmt.Sprintf("'%s' %s", record.Title, file)
+}
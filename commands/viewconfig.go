@@ -55,6 +55,16 @@ func viewConfig() {
 	fmt.Printf("  Exiftool: %v\n", commands.Exiftool)
 	fmt.Printf("  Convert: %v\n", commands.Convert)
 
+	fmt.Println("\nMetadata settings")
+	fmt.Printf("  Reader: %v\n", config.MetadataReaderName())
+	fmt.Printf("  Sidecar: %v\n", config.Metadata.Sidecar)
+	fmt.Printf("  Write to: %v\n", config.Metadata.WriteTo)
+	fmt.Printf("  Backup: %v\n", config.Metadata.Backup)
+
+	fmt.Println("\nKeyword settings")
+	fmt.Printf("  Case insensitive: %v\n", config.Keywords.CaseInsensitive)
+	fmt.Printf("  Hierarchical tags: %v\n", config.Keywords.HierarchicalTags)
+
 	resize := config.Resize
 	fmt.Println("\nResize settings")
 	fmt.Printf("  Method: %v\n", resize.Method)
@@ -65,6 +75,9 @@ func viewConfig() {
 	for n, rule := range config.Rules {
 
 		fmt.Printf("  Rule %v:\n", n+1)
+		if rule.Priority != 0 {
+			fmt.Printf("    Priority: %v\n", rule.Priority)
+		}
 		fmt.Printf("    Conditions:\n")
 		includesAll := rule.Condition.IncludesAll
 		includesAny := rule.Condition.IncludesAny
@@ -82,11 +95,44 @@ func viewConfig() {
 		if len(excludesAny) > 0 {
 			fmt.Printf("      - must not include keyword%v: %v\n", PluralS(excludesAny), strings.Join(excludesAny, ", "))
 		}
+		if rule.When != "" {
+			fmt.Printf("      - when: %v\n", rule.When)
+		}
 
 		fmt.Printf("    Action:\n")
 		if rule.Action.Delete {
 			fmt.Printf("      Delete keyword\n")
 		}
+		if len(rule.Action.Add) > 0 {
+			fmt.Printf("      Add tag%v: %v\n", PluralS(rule.Action.Add), strings.Join(rule.Action.Add, ", "))
+		}
+		for _, rename := range rule.Action.Rename {
+			fmt.Printf("      Rename tag: %v to %v\n", rename.From, rename.To)
+		}
+		if rule.Action.Flatten != "" {
+			fmt.Printf("      Flatten hierarchical keywords: %v\n", rule.Action.Flatten)
+		}
+		if len(rule.Action.MachineTags) > 0 {
+			fmt.Printf("      Add machine tag%v: %v\n", PluralS(rule.Action.MachineTags), strings.Join(rule.Action.MachineTags, ", "))
+		}
+		if rule.Action.WriteToFile {
+			fmt.Printf("      Write tag changes to the file\n")
+		}
+		if rule.Action.SafetyLevel != "" {
+			fmt.Printf("      Set safety level: %v\n", rule.Action.SafetyLevel)
+		}
+		if rule.Action.ContentType != "" {
+			fmt.Printf("      Set content type: %v\n", rule.Action.ContentType)
+		}
+		if rule.Action.Hidden != nil {
+			fmt.Printf("      Hide from public searches: %v\n", *rule.Action.Hidden)
+		}
+		if rule.Action.License != nil {
+			fmt.Printf("      Set license: %v\n", *rule.Action.License)
+		}
+		if rule.Stop {
+			fmt.Printf("      Stop evaluating rules\n")
+		}
 
 		albums := rule.Action.Albums
 		if len(albums) > 0 {
@@ -0,0 +1,347 @@
+/*
+Copyright © 2020 Rob Allen <rob@akrabat.com>
+
+Use of this source code is governed by the MIT
+license that can be found in the LICENSE file or at
+https://akrabat.com/license/mit.
+*/
+
+/*
+Package cmd implements the commands for the app. In this case, watching
+directories and uploading new images to Flickr.
+*/
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "github.com/akrabat/rodeo/internal"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+
+	// Register command line options
+	watchCmd.Flags().BoolP("dry-run", "n", false, "Show what would have been uploaded")
+	watchCmd.Flags().BoolP("verbose", "v", false, "Display additional messages during processing")
+	watchCmd.Flags().Duration("settle", 2*time.Second, "How long a file must be unchanged before it is uploaded")
+	watchCmd.Flags().Duration("retry-after", time.Minute, "How long to wait before trying a failed upload again")
+	addFileSelectionFlags(watchCmd)
+}
+
+// watchCmd represents the watch command
+var watchCmd = &cobra.Command{
+	Use:   "watch <directories>...",
+	Short: "Upload images to Flickr as they are added to directories",
+	Long: `Upload images to Flickr as they are added to directories
+
+Each new or changed image is uploaded once it has finished being written,
+applying the upload rules as for "rodeo upload". Images that have already been
+uploaded are skipped. Press Ctrl-C to stop watching.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if len(args) == 0 {
+			fmt.Println("Error: At least one directory must be specified.")
+			exit(2)
+		}
+
+		// Read the value of --dry-run (if it is missing, the value is false)
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			dryRun = false
+		}
+
+		// Read the value of --verbose (if it is missing, the value is false)
+		verbose, err = cmd.Flags().GetBool("verbose")
+		if err != nil {
+			verbose = false
+		}
+
+		// Read the value of --settle (if it is missing, the value is 2 seconds)
+		settle, err := cmd.Flags().GetDuration("settle")
+		if err != nil || settle <= 0 {
+			settle = 2 * time.Second
+		}
+
+		// Read the value of --retry-after (if it is missing, the value is 1 minute)
+		retryAfter, err := cmd.Flags().GetDuration("retry-after")
+		if err != nil || retryAfter <= 0 {
+			retryAfter = time.Minute
+		}
+
+		config := GetConfig()
+		if config.Cmd.Convert == "" {
+			fmt.Println("Error: cmd.convert needs to be configured.")
+			fmt.Println("Config file:", viper.ConfigFileUsed())
+			fmt.Println()
+			exit(2)
+		}
+
+		session, err := OpenUploadSession()
+		if err != nil {
+			fmt.Printf("Error: Unable to read the upload session: %v\n", err)
+			exit(1)
+		}
+
+		options := uploadOptions{
+			dryRun:     dryRun,
+			album:      &Album{},
+			convertCmd: config.Cmd.Convert,
+			jobs:       1,
+			session:    session,
+			failures:   &failureList{},
+			rules:      getRules(config),
+			metadata:   getMetadataReader(config),
+			writer:     getMetadataWriter(config),
+		}
+		checkKeywordWriting(options.rules, config)
+		if !dryRun {
+			importUploadedLists(uploadedListsToImport(args))
+		}
+
+		w := folderWatcher{
+			selection:  getFileSelection(cmd),
+			settle:     settle,
+			retryAfter: retryAfter,
+			options:    options,
+			pending:    make(map[string]*pendingFile),
+			uploaded:   make(map[string]fileState),
+		}
+		if err := w.run(args); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exit(1)
+		}
+
+		printFailures(options.failures)
+		if options.failures.len() > 0 {
+			exit(1)
+		}
+	},
+}
+
+// A pendingFile is a file that has been created or changed and is waiting for its size to stop changing
+type pendingFile struct {
+	size      int64
+	modTime   time.Time
+	since     time.Time // when the size was last seen to change
+	notBefore time.Time // when a failed upload of the file can be tried again
+}
+
+// The size and modification time of a file, which tell us whether it has changed
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// A folderWatcher uploads files as they appear in the watched directories
+type folderWatcher struct {
+	watcher    *fsnotify.Watcher
+	selection  FileSelection
+	settle     time.Duration
+	retryAfter time.Duration
+	options    uploadOptions
+	pending    map[string]*pendingFile
+	uploaded   map[string]fileState // files uploaded by this watcher, as they were once the upload finished
+}
+
+// Watch the directories until interrupted
+func (w *folderWatcher) run(directories []string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	w.watcher = watcher
+
+	for _, directory := range directories {
+		stat, err := os.Stat(directory)
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() {
+			return fmt.Errorf("%s is not a directory", directory)
+		}
+		if err := w.addDirectory(directory); err != nil {
+			return err
+		}
+	}
+
+	// On Ctrl-C, stop once the file being uploaded has finished. A second Ctrl-C quits immediately.
+	stop := make(chan struct{})
+	interrupted := make(chan os.Signal, 2)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+	go func() {
+		<-interrupted
+		log.Println("Stopping. Press Ctrl-C again to quit now.")
+		close(stop)
+		<-interrupted
+		exit(130)
+	}()
+
+	ticker := time.NewTicker(w.settle / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			w.handleEvent(event)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("Error: %v\n", err)
+
+		case <-ticker.C:
+			w.uploadSettledFiles(stop)
+		}
+	}
+}
+
+// Watch this directory and, if recursive, its subdirectories
+func (w *folderWatcher) addDirectory(directory string) error {
+	if err := w.watcher.Add(directory); err != nil {
+		return err
+	}
+	log.Printf("Watching %s\n", directory)
+
+	if !w.selection.Recursive {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name()[0] != '.' {
+			if err := w.addDirectory(filepath.Join(directory, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *folderWatcher) handleEvent(event fsnotify.Event) {
+	filename := event.Name
+
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		delete(w.pending, filename)
+		return
+	}
+
+	if event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+		return
+	}
+
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return
+	}
+
+	if stat.IsDir() {
+		if event.Op&fsnotify.Create != 0 && w.selection.Recursive && filepath.Base(filename)[0] != '.' {
+			if err := w.addDirectory(filename); err != nil {
+				log.Printf("Error: Unable to watch %s: %v\n", filename, err)
+			}
+			// Files may have been written to the new directory before we started watching it
+			if files, err := w.selection.Expand([]string{filename}); err == nil {
+				for _, file := range files {
+					w.markPending(file)
+				}
+			}
+		}
+		return
+	}
+
+	if !w.selection.Matches(filename) {
+		return
+	}
+	uploaded, ok := w.uploaded[filename]
+	if ok && uploaded.size == stat.Size() && uploaded.modTime.Equal(stat.ModTime()) {
+		// The file hasn't changed since it was uploaded, so this is our own change to it, such as deleting keywords
+		debug(os.Stdout, "Ignoring change to %s as it has already been uploaded", filename)
+		return
+	}
+	w.markPending(filename)
+}
+
+// Note that this file has changed so that it is uploaded once it has settled
+func (w *folderWatcher) markPending(filename string) {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return
+	}
+
+	if _, ok := w.pending[filename]; !ok {
+		debug(os.Stdout, "Waiting for %s to finish being written", filename)
+	}
+	w.pending[filename] = &pendingFile{size: stat.Size(), modTime: stat.ModTime(), since: time.Now()}
+}
+
+// Upload the pending files whose size and modification time have not changed for the settle time
+func (w *folderWatcher) uploadSettledFiles(stop chan struct{}) {
+	for filename, pending := range w.pending {
+		stat, err := os.Stat(filename)
+		if err != nil {
+			delete(w.pending, filename)
+			continue
+		}
+
+		if stat.Size() != pending.size || !stat.ModTime().Equal(pending.modTime) {
+			pending.size = stat.Size()
+			pending.modTime = stat.ModTime()
+			pending.since = time.Now()
+			continue
+		}
+
+		if stat.Size() == 0 || time.Since(pending.since) < w.settle || time.Now().Before(pending.notBefore) {
+			continue
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		delete(w.pending, filename)
+
+		log.Printf("Uploading %s\n", filename)
+		failures := w.options.failures.len()
+		photoId := processFile(filename, w.options)
+		if photoId != "" {
+			log.Printf("Uploaded %s as photo %s\n", filename, photoId)
+			// Remember the file as it is after any changes that we made to it, so that the events for those changes
+			// are ignored but a later change to it is uploaded
+			if stat, err := os.Stat(filename); err == nil {
+				w.uploaded[filename] = fileState{size: stat.Size(), modTime: stat.ModTime()}
+			}
+		} else if w.options.failures.transientSince(failures) {
+			log.Printf("Will try to upload %s again in %v\n", filename, w.retryAfter)
+			w.markPending(filename)
+			if retry, ok := w.pending[filename]; ok {
+				retry.notBefore = time.Now().Add(w.retryAfter)
+			}
+		}
+	}
+}
@@ -4,9 +4,13 @@ go 1.14
 
 require (
 	github.com/davecgh/go-spew v1.1.1
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/mitchellh/go-homedir v1.1.0
+	github.com/mitchellh/mapstructure v1.1.2
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/viper v1.7.0
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/text v0.3.6
 	golang.org/x/tools/gopls v0.7.3 // indirect
 	gopkg.in/masci/flickr.v2 v2.0.0-20161216033441-3cc496dc15cd
 )
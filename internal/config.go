@@ -2,7 +2,10 @@ package internal
 
 import (
 	"fmt"
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
+	"strings"
+	"time"
 )
 
 var config *Config
@@ -23,8 +26,27 @@ type Flickr struct {
 }
 
 type Upload struct {
-	SetDatePosted             bool `mapstructure:"set_date_posted"`
-	StoreUploadListInImageDir bool `mapstructure:"store_uploaded_list_in_image_dir"`
+	SetDatePosted             bool   `mapstructure:"set_date_posted"`
+	StoreUploadListInImageDir bool   `mapstructure:"store_uploaded_list_in_image_dir"` // deprecated: uploads are recorded in the history database
+	PrivacyMerge              string `mapstructure:"privacy_merge"`                    // how the privacy of rules that apply is combined: last, first or most_restrictive
+	SafetyLevel               string `mapstructure:"safety_level"`                     // safe, moderate or restricted
+	ContentType               string `mapstructure:"content_type"`                     // photo, screenshot or other
+	Hidden                    bool   `mapstructure:"hidden"`                           // if true, then photos are hidden from public searches
+	License                   *int   `mapstructure:"license"`                          // Flickr license ID, if set
+	Retry                     Retry  `mapstructure:"retry"`
+}
+
+// Strategies for combining the privacy of the rules that apply to an image
+const (
+	PrivacyMergeLast            = "last"             // the last rule to apply wins
+	PrivacyMergeFirst           = "first"            // the first rule to apply wins
+	PrivacyMergeMostRestrictive = "most_restrictive" // each permission is only given if every rule gives it
+)
+
+type Retry struct {
+	MaxAttempts  int           `mapstructure:"max_attempts"`  // number of times to try a Flickr API call
+	InitialDelay time.Duration `mapstructure:"initial_delay"` // delay before the first retry
+	MaxDelay     time.Duration `mapstructure:"max_delay"`     // longest delay between retries
 }
 
 type Resize struct {
@@ -33,6 +55,18 @@ type Resize struct {
 	Scale   string
 }
 
+type Metadata struct {
+	Reader  string `mapstructure:"reader"`   // how metadata is read from images: native, exiftool or empty for the default
+	Sidecar string `mapstructure:"sidecar"`  // how the metadata in XMP sidecars is used: prefer, fallback or ignore
+	WriteTo string `mapstructure:"write_to"` // where keywords are written: file, sidecar or both
+	Backup  bool   `mapstructure:"backup"`   // keep a copy of a file before its metadata is first changed
+}
+
+type Keywords struct {
+	CaseInsensitive  bool   `mapstructure:"case_insensitive"`  // if true, then keywords that only differ in case match
+	HierarchicalTags string `mapstructure:"hierarchical_tags"` // how hierarchical keywords become tags: flat, leaf, all or path
+}
+
 type Condition struct {
 	ExcludesAll []string `mapstructure:"excludes_all"` // list of keywords that must all not exist on image
 	ExcludesAny []string `mapstructure:"excludes_any"` // list of keywords where any one must not exist on image
@@ -41,8 +75,8 @@ type Condition struct {
 }
 
 type Album struct {
-	Id   string
-	Name string
+	Id   string `json:"id"`
+	Name string `json:"name"`
 }
 
 func (a Album) String() string {
@@ -61,23 +95,54 @@ func (p *Permissions) SetDefaults() {
 	p.Public = true
 }
 
+type Rename struct {
+	From string // keyword pattern, see ParseKeywordPattern()
+	To   string
+}
+
 type Action struct {
-	Delete  bool
-	Privacy *Permissions
-	Albums  []Album
+	Delete      bool
+	Privacy     *Permissions
+	Albums      []Album
+	Add         []string // keywords to add to the Flickr tags
+	Rename      []Rename // keywords to rename in the Flickr tags
+	Flatten     string   // convert hierarchical keywords, e.g. "Places|USA|Boston", to just the "leaf" or "all" levels
+	MachineTags []string `mapstructure:"machine_tags"`  // Flickr machine tags to add, e.g. "geo:country=uk"
+	WriteToFile bool     `mapstructure:"write_to_file"` // also make the add, rename and flatten changes to the image file
+	SafetyLevel string   `mapstructure:"safety_level"`  // safe, moderate or restricted
+	ContentType string   `mapstructure:"content_type"`  // photo, screenshot or other
+	Hidden      *bool    // hide the photo from public searches
+	License     *int     // Flickr license ID, e.g. 4 for CC BY 2.0
 }
 type Rules struct {
 	Name      string
+	Priority  int  // rules with a higher priority are evaluated first
+	Stop      bool // if true and the rule applies, then no further rules are evaluated
 	Condition Condition
+	When      string // expression that must also be true for the rule to apply, see ParseExpression()
 	Action    Action
 }
 
 type Config struct {
-	Cmd    Command
-	Flickr Flickr
-	Upload Upload
-	Resize Resize
-	Rules  []Rules
+	Cmd      Command
+	Flickr   Flickr
+	Upload   Upload
+	Resize   Resize
+	Metadata Metadata
+	Keywords Keywords
+	Rules    []Rules
+}
+
+// The metadata reader to use. If metadata.reader isn't set, then exiftool is used if cmd.exiftool is set, as it reads
+// more file types and tags, and otherwise the native reader.
+func (c *Config) MetadataReaderName() string {
+	if c.Metadata.Reader != "" {
+		return c.Metadata.Reader
+	}
+	if c.Cmd.Exiftool != "" {
+		return ExiftoolMetadataReader
+	}
+	return NativeMetadataReader
 }
 
 func GetConfig() *Config {
@@ -97,14 +162,82 @@ func GetConfig() *Config {
 	return config
 }
 
+// Check that each rule in the config file only has known keys and that their values are of the right type. GetConfig()
+// ignores unknown keys, so a typo such as `include_all` would otherwise mean that a condition is silently left out of
+// its rule. Returns the problems with each rule, by its position in the list of rules.
+func CheckRulesKeys() map[int][]string {
+	problems := make(map[int][]string)
+	rules, _ := viper.Get("rules").([]interface{})
+	for i, rule := range rules {
+		var decoded Rules
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			ErrorUnused:      true,
+			WeaklyTypedInput: true,
+			Result:           &decoded,
+		})
+		if err != nil {
+			problems[i] = append(problems[i], err.Error())
+			continue
+		}
+		err = decoder.Decode(rule)
+		if err == nil {
+			continue
+		}
+		decodeErr, ok := err.(*mapstructure.Error)
+		if !ok {
+			problems[i] = append(problems[i], err.Error())
+			continue
+		}
+		for _, message := range decodeErr.Errors {
+			problems[i] = append(problems[i], describeDecodeError(message))
+		}
+	}
+	return problems
+}
+
+// Convert mapstructure's "'Condition' has invalid keys: include_all" to "has unknown keys in condition: include_all"
+func describeDecodeError(message string) string {
+	const invalidKeys = " has invalid keys: "
+	i := strings.Index(message, invalidKeys)
+	if i < 0 {
+		return message
+	}
+	field := strings.ToLower(strings.Trim(message[:i], "'"))
+	keys := message[i+len(invalidKeys):]
+	if field == "" {
+		return "has unknown keys: " + keys
+	}
+	return fmt.Sprintf("has unknown keys in %s: %s", field, keys)
+}
+
 func setDefaults() {
 
 	if viper.IsSet("upload.set_date_posted") == false {
 		viper.Set("upload.set_date_posted", false)
 	}
 
-	if viper.IsSet("upload.store_uploaded_list_in_image_dir") == false {
-		viper.Set("upload.store_uploaded_list_in_image_dir", false)
+	if viper.IsSet("upload.privacy_merge") == false {
+		viper.Set("upload.privacy_merge", PrivacyMergeLast)
+	}
+
+	if viper.IsSet("upload.safety_level") == false {
+		viper.Set("upload.safety_level", "safe")
+	}
+	if viper.IsSet("upload.content_type") == false {
+		viper.Set("upload.content_type", "photo")
+	}
+	if viper.IsSet("upload.hidden") == false {
+		viper.Set("upload.hidden", false)
+	}
+
+	if viper.IsSet("upload.retry.max_attempts") == false {
+		viper.Set("upload.retry.max_attempts", 4)
+	}
+	if viper.IsSet("upload.retry.initial_delay") == false {
+		viper.Set("upload.retry.initial_delay", "1s")
+	}
+	if viper.IsSet("upload.retry.max_delay") == false {
+		viper.Set("upload.retry.max_delay", "30s")
 	}
 
 	if viper.IsSet("cmd.convert") == false {
@@ -121,6 +254,28 @@ func setDefaults() {
 		viper.Set("resize.quality", "75")
 	}
 
+	// metadata.reader is not given a default here as it depends on cmd.exiftool: see Config.MetadataReaderName()
+
+	if viper.IsSet("metadata.sidecar") == false {
+		viper.Set("metadata.sidecar", SidecarPrefer)
+	}
+
+	if viper.IsSet("metadata.write_to") == false {
+		viper.Set("metadata.write_to", MetadataTargetFile)
+	}
+
+	if viper.IsSet("metadata.backup") == false {
+		viper.Set("metadata.backup", false)
+	}
+
+	if viper.IsSet("keywords.hierarchical_tags") == false {
+		viper.Set("keywords.hierarchical_tags", HierarchicalTagsFlat)
+	}
+
+	if viper.IsSet("keywords.case_insensitive") == false {
+		viper.Set("keywords.case_insensitive", false)
+	}
+
 	if err := viper.WriteConfig(); err != nil {
 		fmt.Println("Error writing config: ", err)
 	}
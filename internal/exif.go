@@ -0,0 +1,432 @@
+package internal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Exif metadata is stored in TIFF format: a header giving the byte order, followed by image file directories (IFDs)
+// of tagged values. A TIFF image file is the same format, with the image data referred to by tags in the first IFD.
+
+var errInvalidTIFF = errors.New("invalid TIFF data")
+
+// Types of TIFF values and their sizes in bytes
+const (
+	tiffByte      = 1
+	tiffASCII     = 2
+	tiffShort     = 3
+	tiffLong      = 4
+	tiffRational  = 5
+	tiffUndefined = 7
+	tiffSLong     = 9
+	tiffSRational = 10
+)
+
+var tiffTypeSizes = map[uint16]uint64{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+// Tags that point to other IFDs or hold other kinds of metadata
+const (
+	tiffExifIFD       = 0x8769
+	tiffGPSIFD        = 0x8825
+	tiffImageWidth    = 0x0100
+	tiffImageHeight   = 0x0101
+	tiffXMP           = 0x02bc
+	tiffIPTC          = 0x83bb
+	tiffPhotoshop     = 0x8649
+	maxTIFFDirEntries = 1000
+)
+
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// Parse TIFF data into `sources`. If `isImage` is set, then the data is a TIFF image file, so the size of the image
+// and any XMP and IPTC metadata that it contains are also read.
+func parseTIFF(data []byte, sources *metadataSources, isImage bool) error {
+	if len(data) < 8 {
+		return errInvalidTIFF
+	}
+	r := &tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		r.order = binary.LittleEndian
+	case "MM":
+		r.order = binary.BigEndian
+	default:
+		return errInvalidTIFF
+	}
+	if r.order.Uint16(data[2:4]) != 42 {
+		return errInvalidTIFF
+	}
+
+	ifd0, err := r.readIFD(r.order.Uint32(data[4:8]))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range ifd0 {
+		switch entry.tag {
+		case tiffExifIFD:
+			exifIFD, err := r.readIFD(r.uint(entry))
+			if err != nil {
+				return err
+			}
+			r.addTags(exifIFD, exifTags, sources.exif)
+		case tiffGPSIFD:
+			gpsIFD, err := r.readIFD(r.uint(entry))
+			if err != nil {
+				return err
+			}
+			r.addGPSTags(gpsIFD, sources.exif)
+		case tiffXMP:
+			if err := parseXMP(entry.value, sources.xmp); err != nil {
+				return err
+			}
+		case tiffIPTC:
+			if err := parseIPTC(entry.value, sources.iptc); err != nil {
+				return err
+			}
+		case tiffPhotoshop:
+			if err := parsePhotoshop(entry.value, sources); err != nil {
+				return err
+			}
+		case tiffImageWidth:
+			if isImage {
+				sources.file.set("ImageWidth", r.uint(entry))
+			}
+		case tiffImageHeight:
+			if isImage {
+				sources.file.set("ImageHeight", r.uint(entry))
+			}
+		}
+	}
+	r.addTags(ifd0, exifTags, sources.exif)
+	return nil
+}
+
+// Read the entries of the IFD at `offset`
+func (r *tiffReader) readIFD(offset uint32) ([]tiffEntry, error) {
+	if uint64(offset)+2 > uint64(len(r.data)) {
+		return nil, errInvalidTIFF
+	}
+	count := int(r.order.Uint16(r.data[offset:]))
+	if count > maxTIFFDirEntries || uint64(offset)+2+uint64(count)*12 > uint64(len(r.data)) {
+		return nil, errInvalidTIFF
+	}
+
+	var entries []tiffEntry
+	for i := 0; i < count; i++ {
+		p := r.data[int(offset)+2+i*12:]
+		entry := tiffEntry{
+			tag:   r.order.Uint16(p[0:2]),
+			typ:   r.order.Uint16(p[2:4]),
+			count: r.order.Uint32(p[4:8]),
+		}
+		typeSize, ok := tiffTypeSizes[entry.typ]
+		if !ok {
+			continue
+		}
+		size := typeSize * uint64(entry.count)
+		if size <= 4 {
+			entry.value = p[8 : 8+size]
+		} else {
+			valueOffset := uint64(r.order.Uint32(p[8:12]))
+			if valueOffset+size > uint64(len(r.data)) {
+				// Skip values that are outside of the data, as other tools do
+				continue
+			}
+			entry.value = r.data[valueOffset : valueOffset+size]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// The integer values of an entry
+func (r *tiffReader) uints(entry tiffEntry) []uint32 {
+	var values []uint32
+	for i := uint32(0); i < entry.count; i++ {
+		switch entry.typ {
+		case tiffByte, tiffUndefined:
+			values = append(values, uint32(entry.value[i]))
+		case tiffShort:
+			values = append(values, uint32(r.order.Uint16(entry.value[i*2:])))
+		case tiffLong, tiffSLong:
+			values = append(values, r.order.Uint32(entry.value[i*4:]))
+		}
+	}
+	return values
+}
+
+// The first integer value of an entry
+func (r *tiffReader) uint(entry tiffEntry) uint32 {
+	values := r.uints(entry)
+	if len(values) == 0 {
+		return 0
+	}
+	return values[0]
+}
+
+// The rational values of an entry
+func (r *tiffReader) rationals(entry tiffEntry) []float64 {
+	var values []float64
+	if entry.typ != tiffRational && entry.typ != tiffSRational {
+		for _, value := range r.uints(entry) {
+			values = append(values, float64(value))
+		}
+		return values
+	}
+	for i := uint32(0); i < entry.count; i++ {
+		var numerator, denominator float64
+		if entry.typ == tiffSRational {
+			numerator = float64(int32(r.order.Uint32(entry.value[i*8:])))
+			denominator = float64(int32(r.order.Uint32(entry.value[i*8+4:])))
+		} else {
+			numerator = float64(r.order.Uint32(entry.value[i*8:]))
+			denominator = float64(r.order.Uint32(entry.value[i*8+4:]))
+		}
+		if denominator == 0 {
+			values = append(values, 0)
+		} else {
+			values = append(values, numerator/denominator)
+		}
+	}
+	return values
+}
+
+// The string value of an entry
+func (r *tiffReader) string(entry tiffEntry) string {
+	value := entry.value
+	if i := strings.IndexByte(string(value), 0); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(string(value))
+}
+
+// An exifTag converts the value of a tag to the same value that `exiftool -j` shows
+type exifTag struct {
+	name   string
+	format func(r *tiffReader, entry tiffEntry) interface{}
+}
+
+// Tags in IFD0 and the Exif IFD, by the names that exiftool uses
+var exifTags = map[uint16]exifTag{
+	0x010e: {"ImageDescription", exifString},
+	0x010f: {"Make", exifString},
+	0x0110: {"Model", exifString},
+	0x0112: {"Orientation", exifNames(map[uint32]string{
+		1: "Horizontal (normal)",
+		2: "Mirror horizontal",
+		3: "Rotate 180",
+		4: "Mirror vertical",
+		5: "Mirror horizontal and rotate 270 CW",
+		6: "Rotate 90 CW",
+		7: "Mirror horizontal and rotate 90 CW",
+		8: "Rotate 270 CW",
+	})},
+	0x0131: {"Software", exifString},
+	0x0132: {"ModifyDate", exifString},
+	0x013b: {"Artist", exifString},
+	0x8298: {"Copyright", exifString},
+	0x829a: {"ExposureTime", func(r *tiffReader, entry tiffEntry) interface{} {
+		return exposureTime(firstRational(r, entry))
+	}},
+	0x829d: {"FNumber", func(r *tiffReader, entry tiffEntry) interface{} { return fNumber(firstRational(r, entry)) }},
+	0x8822: {"ExposureProgram", exifNames(map[uint32]string{
+		0: "Not Defined",
+		1: "Manual",
+		2: "Program AE",
+		3: "Aperture-priority AE",
+		4: "Shutter speed priority AE",
+		5: "Creative (Slow speed)",
+		6: "Action (High speed)",
+		7: "Portrait",
+		8: "Landscape",
+	})},
+	0x8827: {"ISO", exifInt},
+	0x9003: {"DateTimeOriginal", exifString},
+	0x9004: {"CreateDate", exifString},
+	0x9010: {"OffsetTime", exifString},
+	0x9011: {"OffsetTimeOriginal", exifString},
+	0x9012: {"OffsetTimeDigitized", exifString},
+	0x9201: {"ShutterSpeedValue", func(r *tiffReader, entry tiffEntry) interface{} {
+		// APEX value
+		return exposureTime(math.Pow(2, -firstRational(r, entry)))
+	}},
+	0x9202: {"ApertureValue", func(r *tiffReader, entry tiffEntry) interface{} {
+		// APEX value
+		return fNumber(math.Pow(2, firstRational(r, entry)/2))
+	}},
+	0x9204: {"ExposureCompensation", func(r *tiffReader, entry tiffEntry) interface{} {
+		return fraction(firstRational(r, entry))
+	}},
+	0x9207: {"MeteringMode", exifNames(map[uint32]string{
+		0:   "Unknown",
+		1:   "Average",
+		2:   "Center-weighted average",
+		3:   "Spot",
+		4:   "Multi-spot",
+		5:   "Multi-segment",
+		6:   "Partial",
+		255: "Other",
+	})},
+	0x920a: {"FocalLength", func(r *tiffReader, entry tiffEntry) interface{} {
+		return fmt.Sprintf("%.1f mm", firstRational(r, entry))
+	}},
+	0xa002: {"ExifImageWidth", exifInt},
+	0xa003: {"ExifImageHeight", exifInt},
+	0xa403: {"WhiteBalance", exifNames(map[uint32]string{0: "Auto", 1: "Manual"})},
+	0xa405: {"FocalLengthIn35mmFormat", func(r *tiffReader, entry tiffEntry) interface{} {
+		return fmt.Sprintf("%d mm", r.uint(entry))
+	}},
+	0xa420: {"ImageUniqueID", exifString},
+	0xa431: {"SerialNumber", exifString},
+	0xa432: {"LensInfo", lensInfo},
+	0xa433: {"LensMake", exifString},
+	0xa434: {"LensModel", exifString},
+	0xa435: {"LensSerialNumber", exifString},
+}
+
+// Add the tags of an IFD that are in `table`
+func (r *tiffReader) addTags(entries []tiffEntry, table map[uint16]exifTag, tags tagSet) {
+	for _, entry := range entries {
+		definition, ok := table[entry.tag]
+		if !ok || entry.count == 0 {
+			continue
+		}
+		if value := definition.format(r, entry); value != nil && value != "" {
+			tags.set(definition.name, value)
+		}
+	}
+}
+
+// Add the GPS tags, formatted as exiftool does, e.g. `51 deg 30' 26.00" N`
+func (r *tiffReader) addGPSTags(entries []tiffEntry, tags tagSet) {
+	var latitudeRef, longitudeRef string
+	var latitude, longitude []float64
+	for _, entry := range entries {
+		switch entry.tag {
+		case 0x0001:
+			latitudeRef = r.string(entry)
+		case 0x0002:
+			latitude = r.rationals(entry)
+		case 0x0003:
+			longitudeRef = r.string(entry)
+		case 0x0004:
+			longitude = r.rationals(entry)
+		case 0x0006:
+			tags.set("GPSAltitude", fmt.Sprintf("%.1f m", firstRational(r, entry)))
+		}
+	}
+
+	if len(latitude) != 3 || len(longitude) != 3 {
+		return
+	}
+	lat := formatGPSCoordinate(latitude, latitudeRef)
+	lon := formatGPSCoordinate(longitude, longitudeRef)
+	tags.set("GPSLatitude", lat)
+	tags.set("GPSLongitude", lon)
+	tags.set("GPSPosition", lat+", "+lon)
+}
+
+func formatGPSCoordinate(dms []float64, ref string) string {
+	degrees := dms[0] + dms[1]/60 + dms[2]/3600
+	d := math.Floor(degrees)
+	m := math.Floor((degrees - d) * 60)
+	s := ((degrees-d)*60 - m) * 60
+	return strings.TrimSpace(fmt.Sprintf("%d deg %d' %.2f\" %s", int(d), int(m), s, ref))
+}
+
+func exifString(r *tiffReader, entry tiffEntry) interface{} {
+	if entry.typ != tiffASCII && entry.typ != tiffUndefined && entry.typ != tiffByte {
+		return nil
+	}
+	return r.string(entry)
+}
+
+func exifInt(r *tiffReader, entry tiffEntry) interface{} {
+	return r.uint(entry)
+}
+
+// Convert a numbered value to its name
+func exifNames(names map[uint32]string) func(r *tiffReader, entry tiffEntry) interface{} {
+	return func(r *tiffReader, entry tiffEntry) interface{} {
+		value := r.uint(entry)
+		if name, ok := names[value]; ok {
+			return name
+		}
+		return fmt.Sprintf("Unknown (%d)", value)
+	}
+}
+
+func firstRational(r *tiffReader, entry tiffEntry) float64 {
+	values := r.rationals(entry)
+	if len(values) == 0 {
+		return 0
+	}
+	return values[0]
+}
+
+// Format an exposure time in seconds as exiftool does, e.g. "1/250" or "2"
+func exposureTime(seconds float64) interface{} {
+	if seconds > 0 && seconds < 0.25001 {
+		return fmt.Sprintf("1/%d", int(0.5+1/seconds))
+	}
+	return number(strings.TrimSuffix(fmt.Sprintf("%.1f", seconds), ".0"))
+}
+
+// Format an f-number as exiftool does, e.g. 2.8
+func fNumber(value float64) interface{} {
+	if value > 1 {
+		return number(fmt.Sprintf("%.1f", value))
+	}
+	return number(fmt.Sprintf("%.2f", value))
+}
+
+// Format a value as a fraction as exiftool does, e.g. "+1/3"
+func fraction(value float64) interface{} {
+	if value == math.Trunc(value) {
+		return number(strconv.Itoa(int(value)))
+	}
+	for _, denominator := range []float64{2, 3} {
+		numerator := value * denominator
+		if math.Abs(numerator-math.Round(numerator)) < 0.001 {
+			return fmt.Sprintf("%+d/%d", int(math.Round(numerator)), int(denominator))
+		}
+	}
+	return number(fmt.Sprintf("%.2f", value))
+}
+
+// Format the lens specification as exiftool does, e.g. "18-55mm f/2.8-4"
+func lensInfo(r *tiffReader, entry tiffEntry) interface{} {
+	values := r.rationals(entry)
+	if len(values) != 4 {
+		return nil
+	}
+	formatRange := func(min float64, max float64) string {
+		s := strconv.FormatFloat(min, 'f', -1, 64)
+		if max != min && max != 0 {
+			s += "-" + strconv.FormatFloat(max, 'f', -1, 64)
+		}
+		return s
+	}
+	return fmt.Sprintf("%smm f/%s", formatRange(values[0], values[1]), formatRange(values[2], values[3]))
+}
+
+// A number that is output in JSON as a number, as exiftool does
+func number(s string) interface{} {
+	return json.Number(s)
+}
@@ -0,0 +1,267 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// A tiffFixture builds TIFF data, in the byte order that it's given, for tests
+type tiffFixture struct {
+	order binary.ByteOrder
+	ifd0  []tiffEntry
+	// IFDs that IFD0 points to, e.g. the Exif IFD, by the tag of the pointer
+	subIFDs []tiffSubIFD
+}
+
+type tiffSubIFD struct {
+	tag     uint16
+	entries []tiffEntry
+}
+
+func (f *tiffFixture) ascii(tag uint16, s string) tiffEntry {
+	return tiffEntry{tag: tag, typ: tiffASCII, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+func (f *tiffFixture) short(tag uint16, values ...uint16) tiffEntry {
+	value := make([]byte, 2*len(values))
+	for i, v := range values {
+		f.order.PutUint16(value[i*2:], v)
+	}
+	return tiffEntry{tag: tag, typ: tiffShort, count: uint32(len(values)), value: value}
+}
+
+func (f *tiffFixture) long(tag uint16, values ...uint32) tiffEntry {
+	value := make([]byte, 4*len(values))
+	for i, v := range values {
+		f.order.PutUint32(value[i*4:], v)
+	}
+	return tiffEntry{tag: tag, typ: tiffLong, count: uint32(len(values)), value: value}
+}
+
+// A rational entry from numerator and denominator pairs
+func (f *tiffFixture) rational(tag uint16, typ uint16, pairs ...int32) tiffEntry {
+	value := make([]byte, 4*len(pairs))
+	for i, v := range pairs {
+		f.order.PutUint32(value[i*4:], uint32(v))
+	}
+	return tiffEntry{tag: tag, typ: typ, count: uint32(len(pairs) / 2), value: value}
+}
+
+func (f *tiffFixture) undefined(tag uint16, data []byte) tiffEntry {
+	return tiffEntry{tag: tag, typ: tiffUndefined, count: uint32(len(data)), value: data}
+}
+
+// The TIFF data: the header, then the IFDs, then the values that don't fit in their entries
+func (f *tiffFixture) bytes() []byte {
+	ifds := [][]tiffEntry{append([]tiffEntry{}, f.ifd0...)}
+	for _, sub := range f.subIFDs {
+		ifds[0] = append(ifds[0], f.long(sub.tag, 0))
+		ifds = append(ifds, sub.entries)
+	}
+
+	offsets := make([]uint32, len(ifds))
+	offset := uint32(8)
+	for i, entries := range ifds {
+		offsets[i] = offset
+		offset += 2 + 12*uint32(len(entries)) + 4
+	}
+	for i := range f.subIFDs {
+		f.order.PutUint32(ifds[0][len(f.ifd0)+i].value, offsets[i+1])
+	}
+
+	var out, values bytes.Buffer
+	if f.order == binary.LittleEndian {
+		out.WriteString("II")
+	} else {
+		out.WriteString("MM")
+	}
+	_ = binary.Write(&out, f.order, uint16(42))
+	_ = binary.Write(&out, f.order, uint32(8))
+	for _, entries := range ifds {
+		_ = binary.Write(&out, f.order, uint16(len(entries)))
+		for _, entry := range entries {
+			_ = binary.Write(&out, f.order, entry.tag)
+			_ = binary.Write(&out, f.order, entry.typ)
+			_ = binary.Write(&out, f.order, entry.count)
+			if len(entry.value) <= 4 {
+				out.Write(append(entry.value, make([]byte, 4-len(entry.value))...))
+				continue
+			}
+			_ = binary.Write(&out, f.order, offset+uint32(values.Len()))
+			values.Write(entry.value)
+			if values.Len()%2 != 0 {
+				values.WriteByte(0)
+			}
+		}
+		_ = binary.Write(&out, f.order, uint32(0))
+	}
+	out.Write(values.Bytes())
+	return out.Bytes()
+}
+
+// A TIFF with the common tags in IFD0, the Exif IFD and the GPS IFD
+func newTestTIFF(order binary.ByteOrder) *tiffFixture {
+	f := &tiffFixture{order: order}
+	f.ifd0 = []tiffEntry{
+		f.long(tiffImageWidth, 4000),
+		f.short(tiffImageHeight, 3000),
+		f.ascii(0x010f, "Canon"),
+		f.ascii(0x0110, "Canon EOS 5D"),
+		f.short(0x0112, 6),
+	}
+	f.subIFDs = []tiffSubIFD{
+		{tiffExifIFD, []tiffEntry{
+			f.rational(0x829a, tiffRational, 1, 250),
+			f.rational(0x829d, tiffRational, 28, 10),
+			f.short(0x8827, 200),
+			f.ascii(0x9003, "2020:05:06 07:08:09"),
+			f.ascii(0x9011, "+01:00"),
+			f.rational(0x9204, tiffSRational, -1, 3),
+			f.rational(0x920a, tiffRational, 50, 1),
+			f.rational(0xa432, tiffRational, 18, 1, 55, 1, 28, 10, 4, 1),
+		}},
+		{tiffGPSIFD, []tiffEntry{
+			f.ascii(0x0001, "N"),
+			f.rational(0x0002, tiffRational, 51, 1, 30, 1, 2600, 100),
+			f.ascii(0x0003, "W"),
+			f.rational(0x0004, tiffRational, 0, 1, 7, 1, 3960, 100),
+			f.rational(0x0006, tiffRational, 355, 10),
+		}},
+	}
+	return f
+}
+
+var testTIFFExifTags = tagSet{
+	"Make":                 "Canon",
+	"Model":                "Canon EOS 5D",
+	"Orientation":          "Rotate 90 CW",
+	"ExposureTime":         "1/250",
+	"FNumber":              json.Number("2.8"),
+	"ISO":                  uint32(200),
+	"DateTimeOriginal":     "2020:05:06 07:08:09",
+	"OffsetTimeOriginal":   "+01:00",
+	"ExposureCompensation": "-1/3",
+	"FocalLength":          "50.0 mm",
+	"LensInfo":             "18-55mm f/2.8-4",
+	"GPSLatitude":          `51 deg 30' 26.00" N`,
+	"GPSLongitude":         `0 deg 7' 39.60" W`,
+	"GPSPosition":          `51 deg 30' 26.00" N, 0 deg 7' 39.60" W`,
+	"GPSAltitude":          "35.5 m",
+}
+
+func assertTags(t *testing.T, name string, got tagSet, want tagSet) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s tags = %#v, want %#v", name, got, want)
+	}
+}
+
+func TestParseTIFF(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			data := newTestTIFF(order).bytes()
+
+			sources := newMetadataSources()
+			if err := parseTIFF(data, sources, false); err != nil {
+				t.Fatalf("parseTIFF() error: %v", err)
+			}
+			assertTags(t, "Exif", sources.exif, testTIFFExifTags)
+			assertTags(t, "file", sources.file, tagSet{})
+
+			sources = newMetadataSources()
+			if err := parseTIFF(data, sources, true); err != nil {
+				t.Fatalf("parseTIFF() error: %v", err)
+			}
+			assertTags(t, "file", sources.file, tagSet{"ImageWidth": uint32(4000), "ImageHeight": uint32(3000)})
+		})
+	}
+}
+
+func TestParseTIFFEmbeddedMetadata(t *testing.T) {
+	f := &tiffFixture{order: binary.BigEndian}
+	f.ifd0 = []tiffEntry{
+		f.undefined(tiffXMP, []byte(testXMP)),
+		f.undefined(tiffIPTC, iptcDataset(2, 25, "heron")),
+	}
+	sources := newMetadataSources()
+	if err := parseTIFF(f.bytes(), sources, true); err != nil {
+		t.Fatalf("parseTIFF() error: %v", err)
+	}
+	if sources.xmp["Title"] != "Heron" {
+		t.Errorf("XMP Title = %#v, want %q", sources.xmp["Title"], "Heron")
+	}
+	assertTags(t, "IPTC", sources.iptc, tagSet{"Keywords": "heron"})
+}
+
+func TestParseTIFFInvalid(t *testing.T) {
+	valid := newTestTIFF(binary.LittleEndian).bytes()
+	badExifPointer := newTestTIFF(binary.LittleEndian)
+	badExifPointer.ifd0 = append(badExifPointer.ifd0, badExifPointer.long(tiffGPSIFD, 1<<20))
+	badExifPointer.subIFDs = nil
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated header", valid[:6]},
+		{"unknown byte order", append([]byte("XX"), valid[2:]...)},
+		{"wrong magic number", append([]byte("II\x2b\x00"), valid[4:]...)},
+		{"IFD0 outside the data", []byte("II*\x00\xff\x00\x00\x00")},
+		{"truncated IFD0", valid[:8+2+12*2]},
+		{"IFD pointer outside the data", badExifPointer.bytes()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := parseTIFF(test.data, newMetadataSources(), true); err != errInvalidTIFF {
+				t.Errorf("parseTIFF() error = %v, want %v", err, errInvalidTIFF)
+			}
+		})
+	}
+}
+
+func TestParseTIFFValueOutsideTheData(t *testing.T) {
+	// A value that doesn't fit in its entry but whose offset is past the end of the data is skipped
+	f := &tiffFixture{order: binary.LittleEndian}
+	f.ifd0 = []tiffEntry{f.short(0x0112, 1), f.ascii(0x010f, "Canon")}
+	data := f.bytes()
+	data = data[:len(data)-6]
+
+	sources := newMetadataSources()
+	if err := parseTIFF(data, sources, false); err != nil {
+		t.Fatalf("parseTIFF() error: %v", err)
+	}
+	assertTags(t, "Exif", sources.exif, tagSet{"Orientation": "Horizontal (normal)"})
+}
+
+func TestExifFormats(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{"exposure time fraction", exposureTime(1.0 / 60), "1/60"},
+		{"exposure time seconds", exposureTime(2), json.Number("2")},
+		{"exposure time fractional seconds", exposureTime(0.5), json.Number("0.5")},
+		{"f-number", fNumber(5.6), json.Number("5.6")},
+		{"f-number below 1", fNumber(0.95), json.Number("0.95")},
+		{"fraction whole", fraction(-2), json.Number("-2")},
+		{"fraction half", fraction(0.5), "+1/2"},
+		{"fraction third", fraction(-2.0 / 3), "-2/3"},
+		{"fraction other", fraction(0.3), json.Number("0.30")},
+		{"GPS coordinate", formatGPSCoordinate([]float64{40, 26, 46.3}, "N"), `40 deg 26' 46.30" N`},
+		{"GPS coordinate without a reference", formatGPSCoordinate([]float64{1.5, 0, 0}, ""), `1 deg 30' 0.00"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if !reflect.DeepEqual(test.value, test.want) {
+				t.Errorf("got %#v, want %#v", test.value, test.want)
+			}
+		})
+	}
+}
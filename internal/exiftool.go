@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long Close waits for exiftool to exit before killing it
+const exiftoolCloseTimeout = 5 * time.Second
+
+// An Exiftool runs commands in one long-lived exiftool process, using `exiftool -stay_open True -@ -`, rather than
+// starting a new process for each one. The process is started by the first command and is restarted if it dies. It is
+// safe for concurrent use: the commands are run one at a time.
+type Exiftool struct {
+	path   string
+	mutex  sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	stderr *bufio.Reader
+	count  int   // the number of commands that have been run, which identifies the response to each one
+	closed int32 // set by Close before it waits for the command that is running, so that no more are started
+}
+
+// Create an Exiftool that runs the exiftool at `path`
+func NewExiftool(path string) *Exiftool {
+	return &Exiftool{path: path}
+}
+
+// Run exiftool with these arguments and return its output. If exiftool reports an error, then it is returned.
+// Warnings are ignored.
+func (e *Exiftool) Execute(args ...string) ([]byte, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if atomic.LoadInt32(&e.closed) == 1 {
+		return nil, errors.New("exiftool has been closed")
+	}
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "\r\n") {
+			return nil, fmt.Errorf("exiftool argument contains a line break: %q", arg)
+		}
+	}
+	if e.cmd == nil {
+		if err := e.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Each argument is on its own line. exiftool writes "{ready<n>}" to stdout when it has run the command and -echo4
+	// writes the same to stderr once it has finished, so that we know where the response to this command ends.
+	e.count++
+	ready := fmt.Sprintf("{ready%d}", e.count)
+	var request bytes.Buffer
+	for _, arg := range args {
+		request.WriteString(arg + "\n")
+	}
+	request.WriteString("-echo4\n" + ready + "\n")
+	request.WriteString(fmt.Sprintf("-execute%d\n", e.count))
+	if _, err := e.stdin.Write(request.Bytes()); err != nil {
+		e.stop()
+		return nil, fmt.Errorf("unable to send command to exiftool: %v", err)
+	}
+
+	// Read stderr at the same time as stdout so that exiftool can't block on writing to either of them
+	var stderr []byte
+	var stderrErr error
+	done := make(chan struct{})
+	go func() {
+		stderr, stderrErr = readUntil(e.stderr, ready)
+		close(done)
+	}()
+	stdout, err := readUntil(e.stdout, ready)
+	<-done
+	if err == nil {
+		err = stderrErr
+	}
+	if err != nil {
+		// exiftool has most likely died, so it is restarted by the next command
+		e.stop()
+		return nil, fmt.Errorf("unable to read the response from exiftool: %v", err)
+	}
+
+	var errorMessages []string
+	for _, line := range strings.Split(string(stderr), "\n") {
+		if strings.HasPrefix(line, "Error") {
+			errorMessages = append(errorMessages, strings.TrimSpace(line))
+		}
+	}
+	if len(errorMessages) > 0 {
+		return stdout, errors.New(strings.Join(errorMessages, "; "))
+	}
+	return stdout, nil
+}
+
+// Stop the exiftool process, if it is running. Any later command returns an error.
+func (e *Exiftool) Close() error {
+	atomic.StoreInt32(&e.closed, 1)
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.cmd == nil {
+		return nil
+	}
+
+	// Ask exiftool to exit and give it a little time to do so before killing it
+	_, err := io.WriteString(e.stdin, "-stay_open\nFalse\n")
+	e.stdin.Close()
+	exited := make(chan error, 1)
+	cmd := e.cmd
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case waitErr := <-exited:
+		if err == nil {
+			err = waitErr
+		}
+	case <-time.After(exiftoolCloseTimeout):
+		cmd.Process.Kill()
+		<-exited
+		err = errors.New("exiftool did not exit, so it was killed")
+	}
+	e.cmd = nil
+	return err
+}
+
+func (e *Exiftool) start() error {
+	cmd := exec.Command(e.path, "-stay_open", "True", "-@", "-")
+	setExiftoolProcessAttributes(cmd)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to start exiftool: %v", err)
+	}
+
+	e.cmd = cmd
+	e.stdin = stdin
+	e.stdout = bufio.NewReader(stdout)
+	e.stderr = bufio.NewReader(stderr)
+	return nil
+}
+
+// Kill the exiftool process after it has stopped responding
+func (e *Exiftool) stop() {
+	e.stdin.Close()
+	e.cmd.Process.Kill()
+	e.cmd.Wait()
+	e.cmd = nil
+}
+
+// Read lines up to the line that is `marker` and return them
+func readUntil(r *bufio.Reader, marker string) ([]byte, error) {
+	var output []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		if string(bytes.TrimRight(line, "\r\n")) == marker {
+			return output, nil
+		}
+		output = append(output, line...)
+		if err != nil {
+			return output, err
+		}
+	}
+}
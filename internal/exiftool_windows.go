@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package internal
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Run exiftool in its own process group so that Ctrl-C in the console doesn't stop it part way through writing a
+// file. Rodeo stops it when it exits.
+func setExiftoolProcessAttributes(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
@@ -0,0 +1,674 @@
+// The expression language for the `when` condition of a rule
+package internal
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// An Expression is a parsed and type-checked `when` condition, such as:
+//
+//	(holiday or travel) and not private and camera = 'X100V'
+//
+// A word or quoted string on its own is true if the image has a keyword that matches it as a KeywordPattern. A
+// comparison of a metadata field with a value is true if the image's field has that value. Expressions are combined
+// with `and`, `or`, `not` and parentheses.
+type Expression struct {
+	source   string
+	root     exprNode
+	keywords []KeywordPattern // keywords that the expression requires the image to have, i.e. not within a `not`
+}
+
+// Parse and type-check an expression. Keywords are matched according to the Keywords config.
+func ParseExpression(source string, options Keywords) (*Expression, error) {
+	tokens, err := tokenise(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens, options: options}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf(p.peek(), "unexpected %s", p.peek())
+	}
+
+	e := &Expression{source: source, root: root}
+	collectKeywords(root, true, &e.keywords)
+	return e, nil
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Evaluate the expression for an image. If it is true, then the keywords that it required the image to have are also
+// returned.
+func (e *Expression) Evaluate(info *ImageInfo) (bool, []string) {
+	if !e.root.eval(info) {
+		return false, nil
+	}
+
+	matched, _ := MatchKeywordPatterns(e.keywords, info.MatchKeywords())
+	return true, matched
+}
+
+// Collect the keywords that are required to be present, i.e. those that are within an even number of `not`s
+func collectKeywords(node exprNode, positive bool, keywords *[]KeywordPattern) {
+	switch n := node.(type) {
+	case *andNode:
+		collectKeywords(n.left, positive, keywords)
+		collectKeywords(n.right, positive, keywords)
+	case *orNode:
+		collectKeywords(n.left, positive, keywords)
+		collectKeywords(n.right, positive, keywords)
+	case *notNode:
+		collectKeywords(n.operand, !positive, keywords)
+	case *keywordNode:
+		if positive {
+			*keywords = append(*keywords, n.pattern)
+		}
+	}
+}
+
+// Types of metadata field
+type fieldType int
+
+const (
+	stringField fieldType = iota
+	numberField
+	dateField
+	timeField
+	boolField
+	tagField // a tag from ImageInfo.X, whose type is only known when the expression is evaluated
+)
+
+func (t fieldType) String() string {
+	switch t {
+	case numberField:
+		return "number"
+	case dateField:
+		return "date"
+	case timeField:
+		return "time"
+	case boolField:
+		return "boolean"
+	case tagField:
+		return "tag"
+	}
+	return "string"
+}
+
+// The operators that can be used with each type of field
+var fieldOperators = map[fieldType]string{
+	stringField: "= != ~ !~",
+	numberField: "= != < <= > >=",
+	dateField:   "= != < <= > >=",
+	timeField:   "= != < <= > >=",
+	boolField:   "= !=",
+	tagField:    "= != < <= > >= ~ !~",
+}
+
+// An exprField is a metadata field that can be compared in an expression. `get` returns false if the image does not
+// have a value for the field.
+type exprField struct {
+	typ fieldType
+	get func(info *ImageInfo) (interface{}, bool)
+}
+
+// The prefix of a field name that refers to any tag that exiftool returns, e.g. `tag.LensModel`
+const tagFieldPrefix = "tag."
+
+// The metadata fields that can be used in expressions
+var exprFields = map[string]exprField{
+	"title":       {stringField, func(info *ImageInfo) (interface{}, bool) { return info.Title, info.Title != "" }},
+	"description": {stringField, func(info *ImageInfo) (interface{}, bool) { return info.Description, info.Description != "" }},
+	"make":        {stringField, func(info *ImageInfo) (interface{}, bool) { return info.Make, info.Make != "" }},
+	"model":       {stringField, func(info *ImageInfo) (interface{}, bool) { return info.Model, info.Model != "" }},
+	"camera":      {stringField, func(info *ImageInfo) (interface{}, bool) { return info.Model, info.Model != "" }},
+	"lens":        {stringField, func(info *ImageInfo) (interface{}, bool) { return tagString(info, lensTags...) }},
+	"filename":    {stringField, func(info *ImageInfo) (interface{}, bool) { return tagString(info, "FileName") }},
+	"directory":   {stringField, func(info *ImageInfo) (interface{}, bool) { return tagString(info, "Directory") }},
+	"orientation": {stringField, func(info *ImageInfo) (interface{}, bool) { return orientation(info) }},
+	"shutter_speed": {stringField, func(info *ImageInfo) (interface{}, bool) {
+		return info.ShutterSpeed, info.ShutterSpeed != ""
+	}},
+	"aperture": {numberField, func(info *ImageInfo) (interface{}, bool) { return numberValue(string(info.Aperture)) }},
+	"iso":      {numberField, func(info *ImageInfo) (interface{}, bool) { return numberValue(string(info.ISO)) }},
+	"focal_length": {numberField, func(info *ImageInfo) (interface{}, bool) {
+		// e.g. "23.0 mm"
+		value, _ := tagString(info, "FocalLength")
+		return numberValue(strings.TrimSuffix(value, " mm"))
+	}},
+	"width":  {numberField, func(info *ImageInfo) (interface{}, bool) { return float64(info.Width), info.Width != 0 }},
+	"height": {numberField, func(info *ImageInfo) (interface{}, bool) { return float64(info.Height), info.Height != 0 }},
+	"date": {dateField, func(info *ImageInfo) (interface{}, bool) {
+		if info.Date == nil {
+			return nil, false
+		}
+		return *info.Date, true
+	}},
+	"time": {timeField, func(info *ImageInfo) (interface{}, bool) {
+		if info.Date == nil {
+			return nil, false
+		}
+		return *info.Date, true
+	}},
+	"gps": {boolField, func(info *ImageInfo) (interface{}, bool) {
+		_, ok := tagString(info, "GPSLatitude", "GPSPosition")
+		return ok, true
+	}},
+}
+
+// Tags that hold the name of the lens, in order of preference
+var lensTags = []string{"LensModel", "LensID", "Lens", "LensType"}
+
+// Get the first of these tags that the image has as a string
+func tagString(info *ImageInfo, names ...string) (string, bool) {
+	for _, name := range names {
+		if value, ok := info.X[name]; ok && value != nil {
+			if s := strings.TrimSpace(fmt.Sprintf("%v", value)); s != "" {
+				return s, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Get a tag from ImageInfo.X by name, ignoring case
+func tagValue(info *ImageInfo, name string) (interface{}, bool) {
+	if value, ok := info.X[name]; ok {
+		return value, value != nil
+	}
+	for key, value := range info.X {
+		if strings.EqualFold(key, name) {
+			return value, value != nil
+		}
+	}
+	return nil, false
+}
+
+// Whether the image is landscape, portrait or square once it has been rotated as its Exif orientation says
+func orientation(info *ImageInfo) (interface{}, bool) {
+	if info.Width == 0 || info.Height == 0 {
+		return "", false
+	}
+
+	width, height := info.Width, info.Height
+	// Orientation is either a description, such as "Rotate 90 CW", or a number, where 5 to 8 are rotated by 90°
+	if value, ok := tagString(info, "Orientation"); ok {
+		n, err := strconv.Atoi(value)
+		if strings.Contains(value, "90") || strings.Contains(value, "270") || (err == nil && n >= 5 && n <= 8) {
+			width, height = height, width
+		}
+	}
+
+	switch {
+	case width > height:
+		return "landscape", true
+	case width < height:
+		return "portrait", true
+	}
+	return "square", true
+}
+
+func numberValue(s string) (interface{}, bool) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return f, err == nil
+}
+
+// Names of the fields for error messages
+func exprFieldNames() string {
+	var names []string
+	for name := range exprFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ") + " or " + tagFieldPrefix + "<exiftool tag name>"
+}
+
+// Nodes of the parsed expression
+
+type exprNode interface {
+	eval(info *ImageInfo) bool
+}
+
+type andNode struct{ left, right exprNode }
+
+func (n *andNode) eval(info *ImageInfo) bool { return n.left.eval(info) && n.right.eval(info) }
+
+type orNode struct{ left, right exprNode }
+
+func (n *orNode) eval(info *ImageInfo) bool { return n.left.eval(info) || n.right.eval(info) }
+
+type notNode struct{ operand exprNode }
+
+func (n *notNode) eval(info *ImageInfo) bool { return !n.operand.eval(info) }
+
+type keywordNode struct{ pattern KeywordPattern }
+
+func (n *keywordNode) eval(info *ImageInfo) bool {
+	return len(n.pattern.Match(info.MatchKeywords())) > 0
+}
+
+type compareNode struct {
+	name  string
+	field exprField
+	op    string
+	value interface{} // string, float64, bool, dateValue or timeValue, depending on the field's type
+}
+
+func (n *compareNode) eval(info *ImageInfo) bool {
+	actual, ok := n.field.get(info)
+	if !ok {
+		// A missing value is not equal to anything
+		return n.op == "!=" || n.op == "!~"
+	}
+
+	if n.op == "~" || n.op == "!~" {
+		return globMatches(n.value.(string), fmt.Sprintf("%v", actual)) == (n.op == "~")
+	}
+
+	var cmp int
+	switch value := n.value.(type) {
+	case string:
+		// The value of a tag field is compared as a number if both it and the tag are numbers
+		if number, err := strconv.ParseFloat(value, 64); err == nil && n.field.typ == tagField {
+			if a, ok := numberValue(fmt.Sprintf("%v", actual)); ok {
+				cmp = compareNumbers(a.(float64), number)
+				break
+			}
+		}
+		if n.op != "=" && n.op != "!=" {
+			// Strings can't be ordered
+			return false
+		}
+		// String comparisons are case-insensitive
+		if !strings.EqualFold(strings.TrimSpace(fmt.Sprintf("%v", actual)), value) {
+			cmp = 1
+		}
+	case float64:
+		cmp = compareNumbers(actual.(float64), value)
+	case bool:
+		if actual.(bool) != value {
+			cmp = 1
+		}
+	case dateValue:
+		cmp = value.compare(actual.(time.Time))
+	case timeValue:
+		cmp = value.compare(actual.(time.Time))
+	}
+
+	switch n.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func compareNumbers(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Does the value match a glob pattern, such as `DJI_*.JPG`? Case is ignored.
+func globMatches(pattern string, value string) bool {
+	matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(value))
+	return err == nil && matched
+}
+
+// A dateValue is a date or date and time in an expression. Dates are compared with the local time at which the photo
+// was taken, to the precision of the value; e.g. `date = 2020-05-01` is true for any time on that day.
+type dateValue struct {
+	layout string
+	text   string // the value formatted with layout
+}
+
+var dateLayouts = []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02", "2006-01", "2006"}
+
+func parseDateValue(s string) (dateValue, bool) {
+	for _, layout := range dateLayouts {
+		if date, err := time.Parse(layout, s); err == nil {
+			// Normalise so that the values can be compared as strings
+			layout = strings.Replace(layout, " ", "T", 1)
+			return dateValue{layout: layout, text: date.Format(layout)}, true
+		}
+	}
+	return dateValue{}, false
+}
+
+// Compare the date with this value, returning -1, 0 or 1 if it is before, within or after it
+func (d dateValue) compare(date time.Time) int {
+	return strings.Compare(date.Format(d.layout), d.text)
+}
+
+// A timeValue is a time of day in an expression, compared with the local time at which the photo was taken to the
+// precision of the value
+type timeValue dateValue
+
+var timeLayouts = []string{"15:04:05", "15:04", "15"}
+
+func parseTimeValue(s string) (timeValue, bool) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return timeValue{layout: layout, text: t.Format(layout)}, true
+		}
+	}
+	return timeValue{}, false
+}
+
+func (t timeValue) compare(date time.Time) int {
+	return dateValue(t).compare(date)
+}
+
+// Tokens
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokLParen
+	tokRParen
+	tokAnd
+	tokOr
+	tokNot
+	tokOp
+	tokWord
+	tokString
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	pos   int // position in the source, starting at 1
+	value string
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return fmt.Sprintf("'%s'", t.value)
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+// Characters that end a word
+const wordTerminators = "()'\"=!<>&|~"
+
+func tokenise(source string) ([]token, error) {
+	var tokens []token
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+
+		case r == '(':
+			tokens = append(tokens, token{kind: tokLParen, text: "(", pos: start + 1})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokRParen, text: ")", pos: start + 1})
+			i++
+
+		case r == '&' || r == '|':
+			if i+1 >= len(runes) || runes[i+1] != r {
+				return nil, fmt.Errorf("unexpected '%c' at position %d", r, start+1)
+			}
+			kind := tokAnd
+			if r == '|' {
+				kind = tokOr
+			}
+			tokens = append(tokens, token{kind: kind, text: string(runes[i : i+2]), pos: start + 1})
+			i += 2
+
+		case r == '=' || r == '!' || r == '<' || r == '>' || r == '~':
+			op := string(r)
+			i++
+			if i < len(runes) && (runes[i] == '=' || (r == '!' && runes[i] == '~')) {
+				op += string(runes[i])
+				i++
+			}
+			switch op {
+			case "!":
+				tokens = append(tokens, token{kind: tokNot, text: op, pos: start + 1})
+			case "==":
+				tokens = append(tokens, token{kind: tokOp, text: "=", pos: start + 1})
+			default:
+				tokens = append(tokens, token{kind: tokOp, text: op, pos: start + 1})
+			}
+
+		case r == '\'' || r == '"':
+			var value []rune
+			i++
+			for ; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value = append(value, runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string starting at position %d", start+1)
+			}
+			i++
+			tokens = append(tokens, token{kind: tokString, text: string(runes[start:i]), value: string(value), pos: start + 1})
+
+		default:
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(wordTerminators, runes[i]) {
+				i++
+			}
+			word := string(runes[start:i])
+			kind := tokWord
+			switch strings.ToLower(word) {
+			case "and":
+				kind = tokAnd
+			case "or":
+				kind = tokOr
+			case "not":
+				kind = tokNot
+			}
+			tokens = append(tokens, token{kind: kind, text: word, value: word, pos: start + 1})
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(runes) + 1}), nil
+}
+
+// Parser
+
+type exprParser struct {
+	tokens  []token
+	pos     int
+	options Keywords
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("%s at position %d", fmt.Sprintf(format, args...), t.pos)
+}
+
+// or := and ("or" and)*
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+	return left, nil
+}
+
+// and := not ("and" not)*
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokAnd {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+	return left, nil
+}
+
+// not := "not" not | primary
+func (p *exprParser) parseNot() (exprNode, error) {
+	if p.peek().kind == tokNot {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+// primary := "(" or ")" | field op value | keyword
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokRParen {
+			return nil, p.errorf(closing, "expected ')' but found %s", closing)
+		}
+		return node, nil
+
+	case tokWord, tokString:
+		if p.peek().kind == tokOp {
+			if t.kind == tokString {
+				return nil, p.errorf(t, "expected a field name but found %s", t)
+			}
+			return p.parseComparison(t)
+		}
+		pattern, err := ParseKeywordPattern(t.value, p.options)
+		if err != nil {
+			return nil, p.errorf(t, "%v", err)
+		}
+		return &keywordNode{pattern: pattern}, nil
+	}
+
+	return nil, p.errorf(t, "expected a keyword, comparison or '(' but found %s", t)
+}
+
+func (p *exprParser) parseComparison(name token) (exprNode, error) {
+	fieldName := strings.ToLower(name.value)
+	field, ok := exprFields[fieldName]
+	if strings.HasPrefix(fieldName, tagFieldPrefix) && len(fieldName) > len(tagFieldPrefix) {
+		tagName := name.value[len(tagFieldPrefix):]
+		fieldName = tagFieldPrefix + tagName
+		field = exprField{tagField, func(info *ImageInfo) (interface{}, bool) { return tagValue(info, tagName) }}
+	} else if !ok {
+		return nil, p.errorf(name, "unknown field '%s' (fields are: %s)", name.value, exprFieldNames())
+	}
+
+	op := p.next()
+	if !containsWord(fieldOperators[field.typ], op.text) {
+		return nil, p.errorf(op, "operator %s cannot be used with %s field '%s'", op.text, field.typ, fieldName)
+	}
+
+	valueToken := p.next()
+	if valueToken.kind != tokWord && valueToken.kind != tokString {
+		return nil, p.errorf(valueToken, "expected a value but found %s", valueToken)
+	}
+
+	node := &compareNode{name: fieldName, field: field, op: op.text}
+	switch {
+	case field.typ == stringField || field.typ == tagField || op.text == "~" || op.text == "!~":
+		if op.text == "~" || op.text == "!~" {
+			if _, err := path.Match(valueToken.value, ""); err != nil {
+				return nil, p.errorf(valueToken, "%s is not a valid pattern", valueToken)
+			}
+		}
+		node.value = valueToken.value
+	case field.typ == numberField:
+		number, err := strconv.ParseFloat(valueToken.value, 64)
+		if err != nil {
+			return nil, p.errorf(valueToken, "%s is not a number, as required by field '%s'", valueToken, fieldName)
+		}
+		node.value = number
+	case field.typ == dateField:
+		date, ok := parseDateValue(valueToken.value)
+		if !ok {
+			return nil, p.errorf(valueToken, "%s is not a date (YYYY-MM-DD or YYYY-MM-DD HH:MM:SS), as required by field '%s'",
+				valueToken, fieldName)
+		}
+		node.value = date
+	case field.typ == timeField:
+		t, ok := parseTimeValue(valueToken.value)
+		if !ok {
+			return nil, p.errorf(valueToken, "%s is not a time (HH:MM or HH:MM:SS), as required by field '%s'",
+				valueToken, fieldName)
+		}
+		node.value = t
+	case field.typ == boolField:
+		switch strings.ToLower(valueToken.value) {
+		case "true", "yes":
+			node.value = true
+		case "false", "no":
+			node.value = false
+		default:
+			return nil, p.errorf(valueToken, "%s is not true or false, as required by field '%s'", valueToken, fieldName)
+		}
+	}
+	return node, nil
+}
+
+func containsWord(words string, word string) bool {
+	for _, w := range strings.Fields(words) {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,361 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func parseExpression(t *testing.T, source string, options Keywords) *Expression {
+	t.Helper()
+	e, err := ParseExpression(source, options)
+	if err != nil {
+		t.Fatalf("ParseExpression(%q) error: %v", source, err)
+	}
+	return e
+}
+
+// The image that the comparisons are tested against unless a test says otherwise
+func testExpressionImage() *ImageInfo {
+	date := time.Date(2020, 5, 6, 7, 8, 9, 0, time.Local)
+	return &ImageInfo{
+		Width:    6000,
+		Height:   4000,
+		Keywords: []string{"holiday", "beach"},
+		Date:     &date,
+		Make:     "FUJIFILM",
+		Model:    "X100V",
+		Aperture: "2.8",
+		ISO:      "400",
+		X: map[string]interface{}{
+			"FileName":             "DJI_0001.JPG",
+			"Directory":            "/photos/2020",
+			"LensModel":            "XF23mmF2 R WR",
+			"FocalLength":          "23.0 mm",
+			"GPSLatitude":          "51 deg 30' 0.00\" N",
+			"ExposureCompensation": 0.33,
+			"Rating":               nil,
+		},
+	}
+}
+
+// `not` binds more tightly than `and`, which binds more tightly than `or`
+func TestExpressionPrecedence(t *testing.T) {
+	tests := []struct {
+		source   string
+		keywords []string
+		want     bool
+	}{
+		{"a or b and c", []string{"a"}, true},    // a or (b and c), rather than (a or b) and c
+		{"c and b or a", []string{"a"}, true},    // (c and b) or a, rather than c and (b or a)
+		{"a or b and c", []string{"b"}, false},   // a or (b and c)
+		{"not a and b", nil, false},              // (not a) and b, rather than not (a and b)
+		{"not a or b", []string{"a", "b"}, true}, // (not a) or b, rather than not (a or b)
+		{"not a or b", []string{"a"}, false},
+		{"not not a", []string{"a"}, true},
+		{"not not not a", []string{"a"}, false},
+		{"a and b and c", []string{"a", "b"}, false},
+		{"a or b or c", []string{"c"}, true},
+		{"a and not b or c and not d", []string{"c"}, true},
+		{"a and not b or c and not d", []string{"a", "b", "c", "d"}, false},
+		{"a && b || c", []string{"c"}, true},
+		{"!a && b", []string{"b"}, true},
+		{"a AND b OR c", []string{"a", "b"}, true},
+		{"Not a", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.source, func(t *testing.T) {
+			e := parseExpression(t, test.source, caseSensitive)
+			got, _ := e.Evaluate(&ImageInfo{Keywords: test.keywords})
+			if got != test.want {
+				t.Errorf("Evaluate() with %q = %v, want %v", test.keywords, got, test.want)
+			}
+		})
+	}
+}
+
+func TestExpressionParentheses(t *testing.T) {
+	tests := []struct {
+		source   string
+		keywords []string
+		want     bool
+	}{
+		{"(a or b) and c", []string{"a"}, false},
+		{"(a or b) and c", []string{"b", "c"}, true},
+		{"not (a or b)", []string{"b"}, false},
+		{"not (a and b)", []string{"a"}, true},
+		{"((a))", []string{"a"}, true},
+		{"a and (b or (c and not d))", []string{"a", "c"}, true},
+		{"a and (b or (c and not d))", []string{"a", "c", "d"}, false},
+		{"(a)and(b)", []string{"a", "b"}, true},
+		{"(holiday or travel) and not private and camera = 'X100V'", []string{"travel"}, true},
+		{"(holiday or travel) and not private and camera = 'X100V'", []string{"travel", "private"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.source, func(t *testing.T) {
+			e := parseExpression(t, test.source, caseSensitive)
+			got, _ := e.Evaluate(&ImageInfo{Keywords: test.keywords, Model: "X100V"})
+			if got != test.want {
+				t.Errorf("Evaluate() with %q = %v, want %v", test.keywords, got, test.want)
+			}
+		})
+	}
+}
+
+// Malformed expressions are reported as errors, with the position of the problem, rather than panicking
+func TestParseExpressionErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"", "expected a keyword, comparison or '(' but found end of expression at position 1"},
+		{"   ", "found end of expression at position 4"},
+		{"(", "found end of expression at position 2"},
+		{"()", "found ')' at position 2"},
+		{"(a", "expected ')' but found end of expression at position 3"},
+		{"(a or b", "expected ')' but found end of expression"},
+		{"a)", "unexpected ')' at position 2"},
+		{"a b", "unexpected 'b' at position 3"},
+		{"a and", "found end of expression at position 6"},
+		{"a or or b", "found 'or' at position 6"},
+		{"and a", "found 'and' at position 1"},
+		{"not", "found end of expression"},
+		{"a & b", "unexpected '&' at position 3"},
+		{"a | b", "unexpected '|' at position 3"},
+		{"a &", "unexpected '&' at position 3"},
+		{"'unterminated", "unterminated string starting at position 1"},
+		{"a and \"unterminated", "unterminated string starting at position 7"},
+		{"= a", "found '=' at position 1"},
+		{"camera =", "expected a value but found end of expression at position 9"},
+		{"camera = (", "expected a value but found '('"},
+		{"camera = = 'X100V'", "expected a value but found '='"},
+		{"'camera' = 'X100V'", "expected a field name but found 'camera' at position 1"},
+		{"lense = 'XF23mm'", "unknown field 'lense'"},
+		{"tag. = 1", "unknown field 'tag.'"},
+		{"camera < 'X100V'", "operator < cannot be used with string field 'camera'"},
+		{"iso ~ '4*'", "operator ~ cannot be used with number field 'iso'"},
+		{"gps > true", "operator > cannot be used with boolean field 'gps'"},
+		{"iso = high", "'high' is not a number, as required by field 'iso'"},
+		{"date = 2020-13-01", "is not a date"},
+		{"date = yesterday", "is not a date"},
+		{"time = 25:00", "is not a time"},
+		{"time = 7pm", "is not a time"},
+		{"gps = maybe", "'maybe' is not true or false"},
+		{"filename ~ '[a'", "'[a' is not a valid pattern"},
+		{"'re:['", "invalid regular expression in 're:['"},
+		{"'[abc'", "invalid pattern '[abc'"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.source, func(t *testing.T) {
+			e, err := ParseExpression(test.source, caseSensitive)
+			if err == nil {
+				t.Fatalf("ParseExpression() = %v, want an error", e)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("ParseExpression() error = %q, want it to contain %q", err, test.want)
+			}
+		})
+	}
+}
+
+// Comparisons of metadata fields with values, including those of the date and time the photo was taken and any tag
+// that exiftool returns
+func TestExpressionComparisons(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{"camera = 'X100V'", true},
+		{"camera = X100V", true},
+		{"camera == X100V", true},
+		{"camera = 'x100v'", true},
+		{"camera != 'X100V'", false},
+		{"model = 'X-T4'", false},
+		{"CAMERA = X100V", true},
+		{"make ~ 'FUJI*'", true},
+		{"make !~ 'FUJI*'", false},
+		{"make ~ 'fuji*'", true},
+		{"lens ~ '*23mm*'", true},
+		{"filename ~ 'DJI_*'", true},
+		{"filename ~ 'dji_????.jpg'", true},
+		{"directory = '/photos/2020'", true},
+
+		// A field that the image doesn't have only matches != and !~
+		{"title = 'Sunset'", false},
+		{"title != 'Sunset'", true},
+		{"title ~ '*'", false},
+		{"title !~ '*'", true},
+
+		{"iso = 400", true},
+		{"iso >= 400", true},
+		{"iso > 400", false},
+		{"iso < 800", true},
+		{"iso <= 200", false},
+		{"aperture = 2.80", true},
+		{"aperture < 4", true},
+		{"focal_length = 23", true},
+		{"width > 5000 and height < 5000", true},
+
+		{"date = 2020-05-06", true},
+		{"date = 2020-05", true},
+		{"date = 2020", true},
+		{"date = 2021", false},
+		{"date != 2020-05-07", true},
+		{"date > 2020-05-05", true},
+		{"date < 2020-05-06", false},
+		{"date <= 2020-05-06", true},
+		{"date >= 2020-05-06 and date < 2020-05-07", true},
+		{"date = '2020-05-06 07:08'", true},
+		{"date = 2020-05-06T07:08:09", true},
+		{"date < '2020-05-06 07:08:10'", true},
+		{"date > '2020-05-06 07:08:09'", false},
+
+		{"time = 07", true},
+		{"time = 07:08", true},
+		{"time = 07:08:09", true},
+		{"time >= 07:00", true},
+		{"time < 07:08", false},
+		{"time > 12:00", false},
+		{"time >= 06:00 and time < 09:00", true},
+
+		{"gps = true", true},
+		{"gps = yes", true},
+		{"gps = false", false},
+		{"gps != true", false},
+
+		{"tag.LensModel = 'XF23mmF2 R WR'", true},
+		{"tag.lensmodel = 'xf23mmf2 r wr'", true},
+		{"tag.LensModel ~ 'XF*'", true},
+		{"tag.LensModel < 'Z'", false},
+		{"tag.ExposureCompensation > 0", true},
+		{"tag.ExposureCompensation = 0.33", true},
+		{"tag.ExposureCompensation <= -1", false},
+		{"tag.Rating = 5", false},
+		{"tag.Rating != 5", true},
+		{"tag.Missing = 'x'", false},
+		{"tag.Missing != 'x'", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.source, func(t *testing.T) {
+			e := parseExpression(t, test.source, caseSensitive)
+			if got, _ := e.Evaluate(testExpressionImage()); got != test.want {
+				t.Errorf("Evaluate() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// An image without a date taken or GPS position
+func TestExpressionComparisonsWithoutValues(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{"date = 2020", false},
+		{"date < 2020", false},
+		{"date != 2020", true},
+		{"time < 12:00", false},
+		{"gps = false", true},
+		{"iso > 0", false},
+		{"orientation = landscape", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.source, func(t *testing.T) {
+			e := parseExpression(t, test.source, caseSensitive)
+			if got, _ := e.Evaluate(&ImageInfo{}); got != test.want {
+				t.Errorf("Evaluate() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExpressionOrientation(t *testing.T) {
+	tests := []struct {
+		name        string
+		width       uint
+		height      uint
+		orientation interface{}
+		want        string
+	}{
+		{"landscape", 6000, 4000, nil, "landscape"},
+		{"portrait", 4000, 6000, nil, "portrait"},
+		{"square", 1000, 1000, nil, "square"},
+		{"normal", 6000, 4000, "Horizontal (normal)", "landscape"},
+		{"rotated", 6000, 4000, "Rotate 90 CW", "portrait"},
+		{"rotated 270", 6000, 4000, "Rotate 270 CW", "portrait"},
+		{"rotated 180", 6000, 4000, "Rotate 180", "landscape"},
+		{"numeric rotated", 6000, 4000, "6", "portrait"},
+		{"numeric normal", 6000, 4000, "1", "landscape"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info := &ImageInfo{Width: test.width, Height: test.height, X: map[string]interface{}{}}
+			if test.orientation != nil {
+				info.X["Orientation"] = test.orientation
+			}
+			for _, orientation := range []string{"landscape", "portrait", "square"} {
+				e := parseExpression(t, "orientation = "+orientation, caseSensitive)
+				if got, _ := e.Evaluate(info); got != (orientation == test.want) {
+					t.Errorf("orientation = %s is %v, want %v", orientation, got, orientation == test.want)
+				}
+			}
+		})
+	}
+}
+
+// Keywords in an expression are matched as KeywordPatterns, and those that the image is required to have are returned
+// when the expression is true
+func TestExpressionKeywords(t *testing.T) {
+	tests := []struct {
+		name         string
+		source       string
+		options      Keywords
+		keywords     []string
+		hierarchical []string
+		want         bool
+		wantMatched  []string
+	}{
+		{"required", "(holiday or travel) and not private", caseSensitive, []string{"holiday", "beach"}, nil,
+			true, []string{"holiday"}},
+		{"excluded", "(holiday or travel) and not private", caseSensitive, []string{"holiday", "private"}, nil,
+			false, nil},
+		{"within two nots", "not not holiday", caseSensitive, []string{"holiday"}, nil, true, []string{"holiday"}},
+		{"not substrings", "art", caseSensitive, []string{"party"}, nil, false, nil},
+		{"quoted multi-word keyword", "'New York'", caseSensitive, []string{"New York"}, nil,
+			true, []string{"New York"}},
+		{"quoted keyword that is an operator", "\"and\"", caseSensitive, []string{"and"}, nil, true, []string{"and"}},
+		{"escaped quote", `'Rob\'s'`, caseSensitive, []string{"Rob's"}, nil, true, []string{"Rob's"}},
+		{"case sensitive", "Holiday", caseSensitive, []string{"holiday"}, nil, false, nil},
+		{"case insensitive", "Holiday", caseInsensitive, []string{"holiday"}, nil, true, []string{"holiday"}},
+		{"normal forms", cafeNFD, caseSensitive, []string{cafeNFC}, nil, true, []string{cafeNFC}},
+		{"glob", "client:*", caseSensitive, []string{"client:acme", "holiday"}, nil, true, []string{"client:acme"}},
+		{"regular expression", "'re:^job-[0-9]+$'", caseSensitive, []string{"job-12", "job-x"}, nil,
+			true, []string{"job-12"}},
+		{"hierarchical keyword", "'Animals|Birds'", caseSensitive, []string{"Heron"}, []string{"Animals|Birds|Heron"},
+			true, []string{"Animals|Birds"}},
+		{"keyword and comparison", "holiday and iso > 100", caseSensitive, []string{"holiday"}, nil,
+			true, []string{"holiday"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := parseExpression(t, test.source, test.options)
+			if e.String() != test.source {
+				t.Errorf("String() = %q, want %q", e.String(), test.source)
+			}
+
+			info := &ImageInfo{Keywords: test.keywords, HierarchicalSubject: test.hierarchical, ISO: "400"}
+			got, matched := e.Evaluate(info)
+			if got != test.want {
+				t.Errorf("Evaluate() = %v, want %v", got, test.want)
+			}
+			assertKeywords(t, "matched keywords", matched, test.wantMatched)
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The extensions of the image files that are found in directories unless told otherwise
+var DefaultImageExtensions = []string{"jpg", "jpeg", "tif", "tiff", "png", "heic", "gif"}
+
+// A FileSelection describes how to turn the paths given on the command line into a list of image files
+type FileSelection struct {
+	Recursive  bool     // Find files in subdirectories of directories too
+	Include    []string // Glob patterns; if set, files found in a directory must match at least one
+	Exclude    []string // Glob patterns of files to skip
+	Extensions []string // Extensions (without the leading `.`) of the files to find in directories
+	SortBy     string   // "name", "date" or empty to keep the order of the paths
+	DateOf     func(filename string) *time.Time
+}
+
+// Expand the paths into a list of files.
+//
+// A path may be a file, a directory or a glob pattern. Files are always included unless they match an exclude
+// pattern. For a directory, the files within it that have an allowed extension and match the include and exclude
+// patterns are included in filename order. Hidden files and directories are skipped.
+func (s FileSelection) Expand(paths []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	add := func(filename string) {
+		filename = filepath.Clean(filename)
+		if !seen[filename] {
+			seen[filename] = true
+			files = append(files, filename)
+		}
+	}
+
+	for _, path := range paths {
+		matches := []string{path}
+		if _, err := os.Stat(path); os.IsNotExist(err) && strings.ContainsAny(path, "*?[") {
+			matches, err = filepath.Glob(path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %s: %v", path, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %s", path)
+			}
+		}
+
+		for _, match := range matches {
+			stat, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+
+			if !stat.IsDir() {
+				if !s.isExcluded(match) {
+					add(match)
+				}
+				continue
+			}
+
+			dirFiles, err := s.findInDirectory(match)
+			if err != nil {
+				return nil, err
+			}
+			for _, filename := range dirFiles {
+				add(filename)
+			}
+		}
+	}
+
+	s.sort(files)
+	return files, nil
+}
+
+// Find the image files within a directory, descending into subdirectories if s.Recursive is set
+func (s FileSelection) findInDirectory(directory string) ([]string, error) {
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if isHidden(entry.Name()) {
+			continue
+		}
+
+		filename := filepath.Join(directory, entry.Name())
+		if entry.IsDir() {
+			if s.Recursive {
+				subFiles, err := s.findInDirectory(filename)
+				if err != nil {
+					return nil, err
+				}
+				files = append(files, subFiles...)
+			}
+			continue
+		}
+
+		if s.hasAllowedExtension(filename) && s.isIncluded(filename) && !s.isExcluded(filename) {
+			files = append(files, filename)
+		}
+	}
+
+	return files, nil
+}
+
+// Is this file one that would be found in a directory, i.e. it is not hidden, has an allowed extension and matches the
+// include and exclude patterns?
+func (s FileSelection) Matches(filename string) bool {
+	return !isHidden(filepath.Base(filename)) && s.hasAllowedExtension(filename) && s.isIncluded(filename) &&
+		!s.isExcluded(filename)
+}
+
+func (s FileSelection) hasAllowedExtension(filename string) bool {
+	extensions := s.Extensions
+	if len(extensions) == 0 {
+		extensions = DefaultImageExtensions
+	}
+
+	ext := strings.TrimPrefix(filepath.Ext(filename), ".")
+	for _, allowed := range extensions {
+		if strings.EqualFold(ext, strings.TrimPrefix(allowed, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s FileSelection) isIncluded(filename string) bool {
+	if len(s.Include) == 0 {
+		return true
+	}
+	return matchesAnyPattern(filename, s.Include)
+}
+
+func (s FileSelection) isExcluded(filename string) bool {
+	return matchesAnyPattern(filename, s.Exclude)
+}
+
+// Does the file's name, or its path if the pattern contains a separator, match any of the glob patterns?
+func matchesAnyPattern(filename string, patterns []string) bool {
+	for _, pattern := range patterns {
+		name := filepath.Base(filename)
+		if strings.ContainsRune(pattern, filepath.Separator) {
+			name = filename
+		}
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// Sort the files by name or by capture date. Files with the same name or date, or without a date, are ordered by
+// their path so that the order is always the same.
+func (s FileSelection) sort(files []string) {
+	switch s.SortBy {
+	case "name":
+		sort.SliceStable(files, func(i, j int) bool {
+			iName, jName := filepath.Base(files[i]), filepath.Base(files[j])
+			if iName != jName {
+				return iName < jName
+			}
+			return files[i] < files[j]
+		})
+	case "date":
+		dates := make(map[string]*time.Time)
+		for _, filename := range files {
+			if s.DateOf != nil {
+				dates[filename] = s.DateOf(filename)
+			}
+		}
+		sort.SliceStable(files, func(i, j int) bool {
+			iDate, jDate := dates[files[i]], dates[files[j]]
+			switch {
+			case iDate != nil && jDate != nil && !iDate.Equal(*jDate):
+				return iDate.Before(*jDate)
+			case iDate != nil && jDate == nil:
+				return true
+			case iDate == nil && jDate != nil:
+				return false
+			}
+			return files[i] < files[j]
+		})
+	}
+}
@@ -2,10 +2,16 @@
 package internal
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"gopkg.in/masci/flickr.v2"
 	"gopkg.in/masci/flickr.v2/photosets"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -62,3 +68,152 @@ func GetPhotosets(client *flickr.FlickrClient, filter string) []photosets.Photos
 
 	return albums
 }
+
+const replaceEndpoint = "https://up.flickr.com/services/replace/"
+
+// Replace the image of an existing Flickr photo with the image in `filename`. The photo keeps its page, title, tags,
+// comments, faves and album memberships.
+func ReplaceFile(client *flickr.FlickrClient, photoId string, filename string) (*flickr.UploadResponse, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	client.Init()
+	client.EndpointUrl = replaceEndpoint
+	client.HTTPVerb = "POST"
+	client.Args.Set("photo_id", photoId)
+	client.OAuthSign()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("photo", filepath.Base(filename))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return nil, err
+	}
+	for key, val := range client.Args {
+		_ = writer.WriteField(key, val[0])
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	response := &flickr.UploadResponse{}
+	err = flickr.DoPostBody(client, body, writer.FormDataContentType(), response)
+	return response, err
+}
+
+// Set the title and description of a photo
+func SetPhotoMeta(client *flickr.FlickrClient, photoId string, title string, description string) (*flickr.BasicResponse, error) {
+	return callMethod(client, "flickr.photos.setMeta", map[string]string{
+		"photo_id":    photoId,
+		"title":       title,
+		"description": description,
+	})
+}
+
+// Replace the tags of a photo. Each tag containing a space must already be quoted.
+func SetPhotoTags(client *flickr.FlickrClient, photoId string, tags []string) (*flickr.BasicResponse, error) {
+	return callMethod(client, "flickr.photos.setTags", map[string]string{
+		"photo_id": photoId,
+		"tags":     strings.Join(tags, " "),
+	})
+}
+
+// Flickr's safety levels and content types by the names used in the config
+var (
+	SafetyLevels = map[string]int{"safe": 1, "moderate": 2, "restricted": 3}
+	ContentTypes = map[string]int{"photo": 1, "screenshot": 2, "other": 3}
+)
+
+// The value of Flickr's `hidden` upload parameter
+func HiddenValue(hidden bool) int {
+	if hidden {
+		return 2 // hidden from public searches
+	}
+	return 1 // shown in public searches
+}
+
+// Set the license of a photo
+func SetLicense(client *flickr.FlickrClient, photoId string, licenseId int) (*flickr.BasicResponse, error) {
+	return callMethod(client, "flickr.photos.licenses.setLicense", map[string]string{
+		"photo_id":   photoId,
+		"license_id": strconv.Itoa(licenseId),
+	})
+}
+
+// A FlickrPhoto is a photo in the user's photostream
+type FlickrPhoto struct {
+	Id         string `xml:"id,attr"`
+	Title      string `xml:"title,attr"`
+	DateTaken  string `xml:"datetaken,attr"`  // in the format "2006-01-02 15:04:05" with no time zone
+	DateUpload string `xml:"dateupload,attr"` // Unix timestamp
+}
+
+// A PhotoListResponse is one page of a list of photos
+type PhotoListResponse struct {
+	flickr.BasicResponse
+	Photos struct {
+		Page   int           `xml:"page,attr"`
+		Pages  int           `xml:"pages,attr"`
+		Total  int           `xml:"total,attr"`
+		Photos []FlickrPhoto `xml:"photo"`
+	} `xml:"photos"`
+}
+
+// The largest page size that flickr.people.getPhotos allows
+const MaxPhotosPerPage = 500
+
+// Get a page of the photos in the authenticated user's photostream, including private photos
+func GetMyPhotos(client *flickr.FlickrClient, page int, perPage int) (*PhotoListResponse, error) {
+	response := &PhotoListResponse{}
+	err := getMethod(client, "flickr.people.getPhotos", map[string]string{
+		"user_id":  "me",
+		"extras":   "date_taken,date_upload",
+		"page":     strconv.Itoa(page),
+		"per_page": strconv.Itoa(perPage),
+	}, response)
+	return response, err
+}
+
+// Get information about a photo. The information itself is not parsed: this is used to check that the photo exists.
+func GetPhotoInfo(client *flickr.FlickrClient, photoId string) (*flickr.BasicResponse, error) {
+	response := &flickr.BasicResponse{}
+	err := getMethod(client, "flickr.photos.getInfo", map[string]string{
+		"photo_id": photoId,
+	}, response)
+	return response, err
+}
+
+// Call a Flickr API method that only reads data
+func getMethod(client *flickr.FlickrClient, method string, args map[string]string, response flickr.FlickrResponse) error {
+	client.Init()
+	client.HTTPVerb = "GET"
+	client.Args.Set("method", method)
+	for key, value := range args {
+		client.Args.Set(key, value)
+	}
+	client.OAuthSign()
+
+	return flickr.DoGet(client, response)
+}
+
+// Call a Flickr API method that does not return any data
+func callMethod(client *flickr.FlickrClient, method string, args map[string]string) (*flickr.BasicResponse, error) {
+	client.Init()
+	client.EndpointUrl = flickr.API_ENDPOINT
+	client.HTTPVerb = "POST"
+	client.Args.Set("method", method)
+	for key, value := range args {
+		client.Args.Set(key, value)
+	}
+	client.OAuthSign()
+
+	response := &flickr.BasicResponse{}
+	err := flickr.DoPost(client, response)
+	return response, err
+}
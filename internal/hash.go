@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// PNG chunks that hold metadata rather than image data
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"tIME": true,
+}
+
+var pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+// Calculate the SHA-256 hash of the image data in a file.
+//
+// For JPEG and PNG files, the metadata (Exif, IPTC, XMP, comments and text chunks) is not included so that the hash
+// does not change when keywords are edited. For other file types, the whole file is hashed.
+func ImageHash(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	h := sha256.New()
+
+	header, _ := reader.Peek(len(pngSignature))
+	switch {
+	case len(header) >= 2 && header[0] == 0xFF && header[1] == 0xD8:
+		err = hashJpeg(reader, h)
+	case bytes.Equal(header, pngSignature):
+		err = hashPng(reader, h)
+	default:
+		_, err = io.Copy(h, reader)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Hash the segments of a JPEG file, skipping the APPn and COM segments that contain metadata
+func hashJpeg(reader *bufio.Reader, h hash.Hash) error {
+	// SOI marker
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(reader, soi); err != nil {
+		return err
+	}
+	h.Write(soi)
+
+	for {
+		marker := make([]byte, 2)
+		if _, err := io.ReadFull(reader, marker); err != nil {
+			return err
+		}
+		if marker[0] != 0xFF {
+			return errors.New("invalid JPEG segment marker")
+		}
+
+		// Markers without a length
+		if marker[1] == 0xD9 || (marker[1] >= 0xD0 && marker[1] <= 0xD7) || marker[1] == 0x01 {
+			h.Write(marker)
+			if marker[1] == 0xD9 {
+				return nil
+			}
+			continue
+		}
+
+		lengthBytes := make([]byte, 2)
+		if _, err := io.ReadFull(reader, lengthBytes); err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint16(lengthBytes)) - 2
+		if length < 0 {
+			return errors.New("invalid JPEG segment length")
+		}
+
+		isMetadata := (marker[1] >= 0xE0 && marker[1] <= 0xEF) || marker[1] == 0xFE
+		if isMetadata {
+			if _, err := io.CopyN(ioutil.Discard, reader, length); err != nil {
+				return err
+			}
+			continue
+		}
+
+		h.Write(marker)
+		h.Write(lengthBytes)
+		if _, err := io.CopyN(h, reader, length); err != nil {
+			return err
+		}
+
+		// Start of scan: the rest of the file is the compressed image data
+		if marker[1] == 0xDA {
+			_, err := io.Copy(h, reader)
+			return err
+		}
+	}
+}
+
+// Hash the chunks of a PNG file, skipping the chunks that contain metadata
+func hashPng(reader *bufio.Reader, h hash.Hash) error {
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(reader, signature); err != nil {
+		return err
+	}
+	h.Write(signature)
+
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:])
+
+		// chunk data is followed by a 4 byte CRC
+		if pngMetadataChunks[chunkType] {
+			if _, err := io.CopyN(ioutil.Discard, reader, length+4); err != nil {
+				return err
+			}
+			continue
+		}
+
+		h.Write(header)
+		if _, err := io.CopyN(h, reader, length+4); err != nil {
+			return err
+		}
+		if chunkType == "IEND" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"strings"
+)
+
+// The separator of the levels of a hierarchical keyword, e.g. "Animals|Birds|Heron", as used by Lightroom's XMP
+// HierarchicalSubject
+const HierarchySeparator = "|"
+
+// How hierarchical keywords become Flickr tags, which can be set in the config
+const (
+	HierarchicalTagsFlat = "flat" // not at all: only the image's flat keywords are tags
+	HierarchicalTagsLeaf = "leaf" // the last level, e.g. "Heron"
+	HierarchicalTagsAll  = "all"  // every level, e.g. "Animals", "Birds" and "Heron"
+	HierarchicalTagsPath = "path" // the whole keyword, e.g. "Animals|Birds|Heron"
+)
+
+// A KeywordTree holds hierarchical keywords as a tree, e.g. "Animals|Birds|Heron" and "Animals|Cat" are both under
+// "Animals"
+type KeywordTree struct {
+	Roots []*KeywordNode
+}
+
+// A KeywordNode is one level of a hierarchical keyword
+type KeywordNode struct {
+	Name     string // e.g. "Birds"
+	Path     string // the levels down to and including this one, e.g. "Animals|Birds"
+	Children []*KeywordNode
+}
+
+// Create the tree of these hierarchical keywords. Levels are compared as keywords are, according to `options`.
+func NewKeywordTree(keywords []string, options Keywords) *KeywordTree {
+	tree := &KeywordTree{}
+	for _, keyword := range keywords {
+		levels := SplitHierarchicalKeyword(keyword)
+		nodes := &tree.Roots
+		path := ""
+		for _, level := range levels {
+			if path != "" {
+				path += HierarchySeparator
+			}
+			path += level
+
+			var node *KeywordNode
+			for _, existing := range *nodes {
+				if options.keywordKey(existing.Name) == options.keywordKey(level) {
+					node = existing
+				}
+			}
+			if node == nil {
+				node = &KeywordNode{Name: level, Path: path}
+				*nodes = append(*nodes, node)
+			}
+			nodes = &node.Children
+		}
+	}
+	return tree
+}
+
+// The paths of every node in the tree, parents before their children, e.g. "Animals", "Animals|Birds" and
+// "Animals|Birds|Heron"
+func (t *KeywordTree) Paths() []string {
+	var paths []string
+	t.walk(func(node *KeywordNode, depth int) {
+		paths = append(paths, node.Path)
+	})
+	return paths
+}
+
+// Call f for each node in the tree, parents before their children
+func (t *KeywordTree) walk(f func(node *KeywordNode, depth int)) {
+	var walk func(nodes []*KeywordNode, depth int)
+	walk = func(nodes []*KeywordNode, depth int) {
+		for _, node := range nodes {
+			f(node, depth)
+			walk(node.Children, depth+1)
+		}
+	}
+	walk(t.Roots, 0)
+}
+
+// The tree as indented lines of text, one for each node
+func (t *KeywordTree) Lines(indent string) []string {
+	var lines []string
+	t.walk(func(node *KeywordNode, depth int) {
+		lines = append(lines, strings.Repeat(indent, depth)+node.Name)
+	})
+	return lines
+}
+
+// Split a hierarchical keyword into its levels, ignoring empty levels
+func SplitHierarchicalKeyword(keyword string) []string {
+	var levels []string
+	for _, level := range strings.Split(keyword, HierarchySeparator) {
+		if level = strings.TrimSpace(level); level != "" {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
+
+// Whether a hierarchical keyword is below `ancestor` in the hierarchy, e.g. "Animals|Birds|Heron" is below "Animals"
+// and "Animals|Birds". Levels are compared as keywords are, according to `options`.
+func IsHierarchicalDescendant(keyword string, ancestor string, options Keywords) bool {
+	levels := SplitHierarchicalKeyword(keyword)
+	ancestorLevels := SplitHierarchicalKeyword(ancestor)
+	if len(ancestorLevels) == 0 || len(levels) <= len(ancestorLevels) {
+		return false
+	}
+	for i, level := range ancestorLevels {
+		if options.keywordKey(level) != options.keywordKey(levels[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Convert a hierarchical keyword to tags: its last level (HierarchicalTagsLeaf), all its levels (HierarchicalTagsAll),
+// the whole keyword (HierarchicalTagsPath) or none (HierarchicalTagsFlat)
+func HierarchicalTags(keyword string, mode string) []string {
+	levels := SplitHierarchicalKeyword(keyword)
+	if len(levels) == 0 {
+		return nil
+	}
+	switch mode {
+	case HierarchicalTagsLeaf:
+		return levels[len(levels)-1:]
+	case HierarchicalTagsAll:
+		return levels
+	case HierarchicalTagsPath:
+		return []string{strings.Join(levels, HierarchySeparator)}
+	}
+	return nil
+}
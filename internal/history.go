@@ -0,0 +1,487 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const historyBaseFilename = "rodeo-history.db"
+
+// How long to wait for another Rodeo process to finish with the history database
+const historyLockTimeout = 30 * time.Second
+
+// Bucket names. Each index bucket has a key for each record of the form `{value}\x00{record id}`.
+var (
+	uploadsBucket  = []byte("uploads")
+	filenameIndex  = []byte("by_filename")
+	hashIndex      = []byte("by_hash")
+	pathIndex      = []byte("by_path")
+	photoIdIndex   = []byte("by_photo_id")
+	importsBucket  = []byte("imports")
+	sessionBucket  = []byte("session")
+	historyBuckets = [][]byte{uploadsBucket, filenameIndex, hashIndex, pathIndex, photoIdIndex, importsBucket,
+		sessionBucket}
+	indexSeparator  = []byte{0}
+	importedSuffix  = ".imported"
+	historyInstance *History
+	historyMutex    sync.Mutex
+)
+
+// ErrNoSuchUpload is returned when there is no record of an upload of the photo
+var ErrNoSuchUpload = errors.New("no upload of this photo in the history")
+
+// The History is the record of every image that has been uploaded to Flickr. It is stored in a bbolt database in the
+// config directory.
+//
+// The database is only opened for the duration of each operation so that other Rodeo processes can use it at the same
+// time; bbolt's file lock ensures that only one process writes to it at once.
+type History struct {
+	mutex    sync.Mutex
+	filename string
+}
+
+// Get the upload history, creating it if required
+func GetHistory() (*History, error) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	if historyInstance != nil {
+		return historyInstance, nil
+	}
+
+	history := &History{filename: ConfigDir() + "/" + historyBaseFilename}
+	err := history.update(func(tx *bolt.Tx) error {
+		// The path index was added after the others, so the records in an older history need to be added to it
+		indexPaths := tx.Bucket(uploadsBucket) != nil && tx.Bucket(pathIndex) == nil
+		for _, name := range historyBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if !indexPaths {
+			return nil
+		}
+		return tx.Bucket(uploadsBucket).ForEach(func(key, data []byte) error {
+			var record UploadRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if record.Path == "" {
+				return nil
+			}
+			return tx.Bucket(pathIndex).Put(indexKey(record.Path, binary.BigEndian.Uint64(key)), []byte{})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	historyInstance = history
+	return history, nil
+}
+
+// Find the record for an image that has already been uploaded. Returns nil if it has not been uploaded.
+//
+// An image matches a record with the same hash, even if it has been renamed. Records without a hash, which were
+// imported from the original uploaded list format, match an image with the same filename. If the record came from a
+// list in an image directory, then the image must also be in that directory.
+func (h *History) FindUpload(imageFilename string, hash string) (*UploadRecord, error) {
+	path, err := filepath.Abs(imageFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *UploadRecord
+	err = h.view(func(tx *bolt.Tx) error {
+		if hash != "" {
+			for _, id := range indexLookup(tx, hashIndex, hash) {
+				record, err := getRecord(tx, id)
+				if err != nil || record != nil {
+					found = record
+					return err
+				}
+			}
+		}
+
+		for _, id := range indexLookup(tx, filenameIndex, filepath.Base(imageFilename)) {
+			record, err := getRecord(tx, id)
+			if err != nil {
+				return err
+			}
+			if record != nil && record.Hash == "" && (record.Path == "" || record.Path == path) {
+				found = record
+				return nil
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Find the most recent record of an upload of the file at this path, whatever its content was. This finds an image
+// that has been edited since it was uploaded. Returns nil if there is no such record.
+func (h *History) FindUploadByPath(imageFilename string) (*UploadRecord, error) {
+	path, err := filepath.Abs(imageFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *UploadRecord
+	err = h.view(func(tx *bolt.Tx) error {
+		// Record IDs increase, so the last one is the most recent
+		ids := indexLookup(tx, pathIndex, path)
+		for i := len(ids) - 1; i >= 0; i-- {
+			record, err := getRecord(tx, ids[i])
+			if err != nil || record != nil {
+				found = record
+				return err
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Add the record to the history. If there is already a record for the same Flickr photo, for instance because its
+// image has been replaced, then that record is updated instead.
+func (h *History) RecordUpload(record UploadRecord) error {
+	return h.update(func(tx *bolt.Tx) error {
+		return recordUpload(tx, record)
+	})
+}
+
+// Get all the records in the order in which they were added
+func (h *History) Uploads() ([]UploadRecord, error) {
+	var records []UploadRecord
+	err := h.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadsBucket).ForEach(func(key, data []byte) error {
+			var record UploadRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			record.Id = binary.BigEndian.Uint64(key)
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// Get the record of the upload of a Flickr photo. Returns ErrNoSuchUpload if there is no record of it.
+func (h *History) FindPhoto(photoId string) (*UploadRecord, error) {
+	var found *UploadRecord
+	err := h.view(func(tx *bolt.Tx) error {
+		var err error
+		found, err = findPhoto(tx, photoId)
+		return err
+	})
+	return found, err
+}
+
+// Change the record of the upload of a Flickr photo. Returns ErrNoSuchUpload if there is no record of it.
+//
+// `fn` may change any field of the record, including its photo ID, as long as no other record has the new photo ID.
+func (h *History) UpdateUpload(photoId string, fn func(record *UploadRecord) error) error {
+	return h.update(func(tx *bolt.Tx) error {
+		record, err := findPhoto(tx, photoId)
+		if err != nil {
+			return err
+		}
+
+		if err := removeFromIndexes(tx, record); err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+		if record.PhotoId != photoId && len(indexLookup(tx, photoIdIndex, record.PhotoId)) > 0 {
+			return fmt.Errorf("photo %s is already in the history", record.PhotoId)
+		}
+
+		return putRecord(tx, record)
+	})
+}
+
+// Record that Rodeo added the photo to an album
+func (h *History) AddAlbum(photoId string, album Album) error {
+	return h.UpdateUpload(photoId, func(record *UploadRecord) error {
+		for _, existing := range record.Albums {
+			if existing.Id == album.Id {
+				return nil
+			}
+		}
+		record.Albums = append(record.Albums, album)
+		return nil
+	})
+}
+
+// Remove the record of the upload of a Flickr photo. Returns ErrNoSuchUpload if there is no record of it.
+func (h *History) RemoveUpload(photoId string) error {
+	return h.update(func(tx *bolt.Tx) error {
+		record, err := findPhoto(tx, photoId)
+		if err != nil {
+			return err
+		}
+		if err := removeFromIndexes(tx, record); err != nil {
+			return err
+		}
+		return tx.Bucket(uploadsBucket).Delete(idKey(record.Id))
+	})
+}
+
+// Import the records from an uploaded list JSON file, as written by earlier versions of Rodeo, and then rename the
+// file so that it is not imported again. Returns the number of records imported.
+func (h *History) ImportUploadedList(filename string) (int, error) {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	list, err := ReadUploadedList(filename)
+	if err != nil {
+		return 0, fmt.Errorf("unable to import %s: %v", filename, err)
+	}
+
+	count := 0
+	err = h.update(func(tx *bolt.Tx) error {
+		for _, record := range list.Uploads {
+			// The same image may have been recorded in more than one list
+			if record.Hash != "" && len(indexLookup(tx, hashIndex, record.Hash)) > 0 {
+				continue
+			}
+			if len(indexLookup(tx, photoIdIndex, record.PhotoId)) > 0 {
+				continue
+			}
+			if err := recordUpload(tx, record); err != nil {
+				return err
+			}
+			count++
+		}
+
+		absFilename, _ := filepath.Abs(filename)
+		return tx.Bucket(importsBucket).Put([]byte(absFilename), []byte(time.Now().Format(time.RFC3339)))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, os.Rename(filename, filename+importedSuffix)
+}
+
+// Add or update a record within a transaction
+func recordUpload(tx *bolt.Tx, record UploadRecord) error {
+	uploads := tx.Bucket(uploadsBucket)
+
+	if ids := indexLookup(tx, photoIdIndex, record.PhotoId); len(ids) > 0 {
+		existing, err := getRecord(tx, ids[0])
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			if err := removeFromIndexes(tx, existing); err != nil {
+				return err
+			}
+			record.Id = existing.Id
+			if record.Albums == nil {
+				// The photo is still in the albums that it was added to when it was first uploaded
+				record.Albums = existing.Albums
+			}
+		}
+	}
+
+	if record.Id == 0 {
+		id, err := uploads.NextSequence()
+		if err != nil {
+			return err
+		}
+		record.Id = id
+	}
+
+	return putRecord(tx, &record)
+}
+
+// Write a record and add it to the indexes
+func putRecord(tx *bolt.Tx, record *UploadRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(uploadsBucket).Put(idKey(record.Id), data); err != nil {
+		return err
+	}
+	return addToIndexes(tx, record)
+}
+
+// Get the record of a Flickr photo. Returns ErrNoSuchUpload if there is no record of it.
+func findPhoto(tx *bolt.Tx, photoId string) (*UploadRecord, error) {
+	for _, id := range indexLookup(tx, photoIdIndex, photoId) {
+		record, err := getRecord(tx, id)
+		if err != nil || record != nil {
+			return record, err
+		}
+	}
+	return nil, ErrNoSuchUpload
+}
+
+// Get a record by its ID. Returns nil if there is no such record.
+func getRecord(tx *bolt.Tx, id uint64) (*UploadRecord, error) {
+	data := tx.Bucket(uploadsBucket).Get(idKey(id))
+	if data == nil {
+		return nil, nil
+	}
+
+	var record UploadRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	record.Id = id
+	return &record, nil
+}
+
+func addToIndexes(tx *bolt.Tx, record *UploadRecord) error {
+	for bucket, value := range indexValues(record) {
+		if value == "" {
+			continue
+		}
+		if err := tx.Bucket([]byte(bucket)).Put(indexKey(value, record.Id), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeFromIndexes(tx *bolt.Tx, record *UploadRecord) error {
+	for bucket, value := range indexValues(record) {
+		if err := tx.Bucket([]byte(bucket)).Delete(indexKey(value, record.Id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func indexValues(record *UploadRecord) map[string]string {
+	return map[string]string{
+		string(filenameIndex): record.Filename,
+		string(hashIndex):     record.Hash,
+		string(pathIndex):     record.Path,
+		string(photoIdIndex):  record.PhotoId,
+	}
+}
+
+// Find the IDs of the records with this value in an index
+func indexLookup(tx *bolt.Tx, index []byte, value string) []uint64 {
+	var ids []uint64
+	prefix := append([]byte(value), indexSeparator...)
+	cursor := tx.Bucket(index).Cursor()
+	for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+		id := key[len(prefix):]
+		if len(id) == 8 {
+			ids = append(ids, binary.BigEndian.Uint64(id))
+		}
+	}
+	return ids
+}
+
+func idKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func indexKey(value string, id uint64) []byte {
+	key := append([]byte(value), indexSeparator...)
+	return append(key, idKey(id)...)
+}
+
+func (h *History) view(fn func(tx *bolt.Tx) error) error {
+	return h.withDB(func(db *bolt.DB) error {
+		return db.View(fn)
+	})
+}
+
+func (h *History) update(fn func(tx *bolt.Tx) error) error {
+	return h.withDB(func(db *bolt.DB) error {
+		return db.Update(fn)
+	})
+}
+
+// Open the database, call fn and then close the database again
+func (h *History) withDB(fn func(db *bolt.DB) error) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	db, err := bolt.Open(h.filename, 0664, &bolt.Options{Timeout: historyLockTimeout})
+	if err != nil {
+		return fmt.Errorf("unable to open upload history %s: %v", h.filename, err)
+	}
+	defer db.Close()
+
+	return fn(db)
+}
+
+// An UploadFilter selects records from the upload history. Empty fields match every record.
+type UploadFilter struct {
+	From        *time.Time // earliest upload date (or date taken if ByDateTaken)
+	To          *time.Time // latest upload date (or date taken if ByDateTaken)
+	ByDateTaken bool
+	Directory   string // only images within this directory or its subdirectories
+	Album       string // name or ID of an album that Rodeo added the photo to
+	PhotoId     string
+}
+
+// Does the record match the filter?
+func (f UploadFilter) Matches(record UploadRecord) bool {
+	if f.PhotoId != "" && record.PhotoId != f.PhotoId {
+		return false
+	}
+
+	if f.From != nil || f.To != nil {
+		date := record.UploadedAt
+		if f.ByDateTaken {
+			date = record.DateTaken
+		}
+		if date == nil {
+			return false
+		}
+		if f.From != nil && date.Before(*f.From) {
+			return false
+		}
+		if f.To != nil && date.After(*f.To) {
+			return false
+		}
+	}
+
+	if f.Directory != "" {
+		directory, err := filepath.Abs(f.Directory)
+		if err != nil || record.Path == "" {
+			return false
+		}
+		if !strings.HasPrefix(record.Path, strings.TrimSuffix(directory, string(filepath.Separator))+string(filepath.Separator)) {
+			return false
+		}
+	}
+
+	if f.Album != "" {
+		found := false
+		for _, album := range record.Albums {
+			if album.Id == f.Album || strings.EqualFold(album.Name, f.Album) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// IPTC metadata is a list of datasets, each of which is a record number, a dataset number and a value. Rodeo only
+// reads the application record (2), which holds the descriptive metadata.
+
+var errInvalidIPTC = errors.New("invalid IPTC data")
+
+const (
+	iptcTagMarker         = 0x1c
+	iptcEnvelopeRecord    = 1
+	iptcApplicationRecord = 2
+	iptcCodedCharacterSet = 90 // in the envelope record
+)
+
+// Datasets of the application record, by the names that exiftool uses
+var iptcDatasets = map[byte]string{
+	5:   "ObjectName",
+	15:  "Category",
+	20:  "SupplementalCategories",
+	25:  "Keywords",
+	55:  "DateCreated",
+	60:  "TimeCreated",
+	80:  "By-line",
+	85:  "By-lineTitle",
+	90:  "City",
+	92:  "Sub-location",
+	95:  "Province-State",
+	101: "Country-PrimaryLocationName",
+	105: "Headline",
+	110: "Credit",
+	115: "Source",
+	116: "CopyrightNotice",
+	120: "Caption-Abstract",
+	122: "Writer-Editor",
+}
+
+// Datasets that can be repeated
+var iptcLists = map[byte]bool{20: true, 25: true, 80: true, 85: true}
+
+// Parse IPTC data into `tags`
+func parseIPTC(data []byte, tags tagSet) error {
+	isUTF8 := false
+	lists := make(map[string][]string)
+	var names []string // in the order in which they are first found
+
+	for len(data) > 0 {
+		// Some writers pad the data with zeros
+		if data[0] == 0 {
+			data = data[1:]
+			continue
+		}
+		if data[0] != iptcTagMarker || len(data) < 5 {
+			return errInvalidIPTC
+		}
+		record, dataset := data[1], data[2]
+		size := int(binary.BigEndian.Uint16(data[3:5]))
+		data = data[5:]
+		if size&0x8000 != 0 {
+			// Extended dataset: the size is in the next (size & 0x7fff) bytes
+			n := size & 0x7fff
+			if n > 4 || len(data) < n {
+				return errInvalidIPTC
+			}
+			size = 0
+			for _, b := range data[:n] {
+				size = size<<8 | int(b)
+			}
+			data = data[n:]
+		}
+		if size > len(data) {
+			return errInvalidIPTC
+		}
+		value := data[:size]
+		data = data[size:]
+
+		if record == iptcEnvelopeRecord && dataset == iptcCodedCharacterSet {
+			// ESC % G selects UTF-8
+			isUTF8 = bytes.Equal(value, []byte("\x1b%G"))
+			continue
+		}
+		if record != iptcApplicationRecord {
+			continue
+		}
+		name, ok := iptcDatasets[dataset]
+		if !ok {
+			continue
+		}
+
+		s := iptcString(value, isUTF8)
+		switch name {
+		case "DateCreated":
+			// CCYYMMDD
+			if len(s) == 8 {
+				s = s[0:4] + ":" + s[4:6] + ":" + s[6:8]
+			}
+		case "TimeCreated":
+			// HHMMSS±HHMM
+			if len(s) == 11 {
+				s = s[0:2] + ":" + s[2:4] + ":" + s[4:6] + s[6:9] + ":" + s[9:11]
+			}
+		}
+		if s == "" {
+			continue
+		}
+
+		if _, ok := lists[name]; !ok {
+			names = append(names, name)
+		}
+		if iptcLists[dataset] || len(lists[name]) == 0 {
+			lists[name] = append(lists[name], s)
+		}
+	}
+
+	// As exiftool does, a list with one item is a string
+	for _, name := range names {
+		if values := lists[name]; len(values) == 1 {
+			tags.set(name, values[0])
+		} else {
+			tags.set(name, values)
+		}
+	}
+	return nil
+}
+
+// Decode an IPTC value. If the character set isn't given as UTF-8, then it is assumed to be UTF-8 if it is valid and
+// Latin-1 otherwise.
+func iptcString(value []byte, isUTF8 bool) string {
+	if isUTF8 || utf8.Valid(value) {
+		return strings.TrimSpace(string(value))
+	}
+	runes := make([]rune, len(value))
+	for i, b := range value {
+		runes[i] = rune(b)
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+// Photoshop image resources, which is where IPTC metadata is stored in JPEG and TIFF files
+
+const (
+	photoshopResourceSignature = "8BIM"
+	photoshopIPTCResource      = 0x0404
+)
+
+// Parse the IPTC metadata in Photoshop image resource blocks into `sources`
+func parsePhotoshop(data []byte, sources *metadataSources) error {
+	for len(data) >= 12 {
+		if string(data[:4]) != photoshopResourceSignature {
+			return errors.New("invalid Photoshop image resources")
+		}
+		id := binary.BigEndian.Uint16(data[4:6])
+
+		// The name is a Pascal string, padded to an even length
+		nameLength := int(data[6]) + 1
+		if nameLength%2 != 0 {
+			nameLength++
+		}
+		p := 6 + nameLength
+		if p+4 > len(data) {
+			return errors.New("invalid Photoshop image resources")
+		}
+		size := int(binary.BigEndian.Uint32(data[p : p+4]))
+		p += 4
+		if size < 0 || p+size > len(data) {
+			return errors.New("invalid Photoshop image resources")
+		}
+
+		if id == photoshopIPTCResource {
+			if err := parseIPTC(data[p:p+size], sources.iptc); err != nil {
+				return err
+			}
+		}
+
+		// The data is also padded to an even length
+		if size%2 != 0 {
+			size++
+		}
+		if p+size >= len(data) {
+			break
+		}
+		data = data[p+size:]
+	}
+	return nil
+}
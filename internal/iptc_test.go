@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// An IPTC dataset with a standard (not extended) size
+func iptcDataset(record byte, dataset byte, value string) []byte {
+	data := []byte{iptcTagMarker, record, dataset, 0, 0}
+	binary.BigEndian.PutUint16(data[3:], uint16(len(value)))
+	return append(data, value...)
+}
+
+// A Photoshop image resource block with its name and data padded to even lengths
+func photoshopBlock(id uint16, name string, data []byte) []byte {
+	var block bytes.Buffer
+	block.WriteString(photoshopResourceSignature)
+	_ = binary.Write(&block, binary.BigEndian, id)
+	block.WriteByte(byte(len(name)))
+	block.WriteString(name)
+	if (len(name)+1)%2 != 0 {
+		block.WriteByte(0)
+	}
+	_ = binary.Write(&block, binary.BigEndian, uint32(len(data)))
+	block.Write(data)
+	if len(data)%2 != 0 {
+		block.WriteByte(0)
+	}
+	return block.Bytes()
+}
+
+func joinBytes(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestParseIPTC(t *testing.T) {
+	// The size of the extended dataset is in the two bytes after its header
+	extended := append([]byte{iptcTagMarker, 2, 120, 0x80, 0x02, 0x00, 0x05}, "Heron"...)
+
+	tests := []struct {
+		name string
+		data []byte
+		want tagSet
+	}{
+		{"empty", nil, tagSet{}},
+		{"keywords", joinBytes(
+			iptcDataset(2, 25, "heron"),
+			iptcDataset(2, 25, " bird "),
+			iptcDataset(2, 5, "Heron"),
+		), tagSet{"Keywords": []string{"heron", "bird"}, "ObjectName": "Heron"}},
+		{"one keyword is a string", iptcDataset(2, 25, "heron"), tagSet{"Keywords": "heron"}},
+		{"first of a dataset that isn't repeatable", joinBytes(
+			iptcDataset(2, 5, "First"),
+			iptcDataset(2, 5, "Second"),
+		), tagSet{"ObjectName": "First"}},
+		{"date and time", joinBytes(
+			iptcDataset(2, 55, "20200506"),
+			iptcDataset(2, 60, "070809+0100"),
+		), tagSet{"DateCreated": "2020:05:06", "TimeCreated": "07:08:09+01:00"}},
+		{"date and time in other forms are kept", joinBytes(
+			iptcDataset(2, 55, "2020"),
+			iptcDataset(2, 60, "0708"),
+		), tagSet{"DateCreated": "2020", "TimeCreated": "0708"}},
+		{"other records and unknown datasets are ignored", joinBytes(
+			iptcDataset(1, 20, "envelope"),
+			iptcDataset(2, 0, "\x00\x04"),
+			iptcDataset(3, 25, "other record"),
+			iptcDataset(2, 25, "heron"),
+		), tagSet{"Keywords": "heron"}},
+		{"empty values are ignored", joinBytes(
+			iptcDataset(2, 25, " "),
+			iptcDataset(2, 120, ""),
+		), tagSet{}},
+		{"zero padding", joinBytes(
+			[]byte{0, 0},
+			iptcDataset(2, 25, "heron"),
+			[]byte{0, 0, 0},
+		), tagSet{"Keywords": "heron"}},
+		{"extended dataset", extended, tagSet{"Caption-Abstract": "Heron"}},
+		{"UTF-8", iptcDataset(2, 25, cafeNFC), tagSet{"Keywords": cafeNFC}},
+		{"Latin-1", iptcDataset(2, 25, "caf\xe9"), tagSet{"Keywords": cafeNFC}},
+		{"UTF-8 character set", joinBytes(
+			iptcDataset(1, 90, "\x1b%G"),
+			iptcDataset(2, 25, cafeNFC),
+		), tagSet{"Keywords": cafeNFC}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tags := tagSet{}
+			if err := parseIPTC(test.data, tags); err != nil {
+				t.Fatalf("parseIPTC() error: %v", err)
+			}
+			assertTags(t, "IPTC", tags, test.want)
+		})
+	}
+}
+
+func TestParseIPTCInvalid(t *testing.T) {
+	keyword := iptcDataset(2, 25, "heron")
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no tag marker", []byte("heron")},
+		{"truncated header", keyword[:4]},
+		{"truncated value", keyword[:len(keyword)-1]},
+		{"truncated second dataset", joinBytes(keyword, keyword[:3])},
+		{"extended size that is too long", []byte{iptcTagMarker, 2, 25, 0x80, 0x05, 0, 0, 0, 0, 1, 'a'}},
+		{"truncated extended size", []byte{iptcTagMarker, 2, 25, 0x80, 0x02, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := parseIPTC(test.data, tagSet{}); err != errInvalidIPTC {
+				t.Errorf("parseIPTC() error = %v, want %v", err, errInvalidIPTC)
+			}
+		})
+	}
+}
+
+func TestParsePhotoshop(t *testing.T) {
+	iptc := joinBytes(iptcDataset(2, 25, "heron"), iptcDataset(2, 25, "bird"))
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"IPTC only", photoshopBlock(photoshopIPTCResource, "", iptc)},
+		{"after other resources", joinBytes(
+			photoshopBlock(0x03ed, "", []byte{1, 2, 3}),
+			photoshopBlock(0x040c, "thumbnail", []byte{1, 2, 3, 4}),
+			photoshopBlock(photoshopIPTCResource, "IPTC", iptc),
+		)},
+		{"trailing padding", joinBytes(photoshopBlock(photoshopIPTCResource, "", iptc), []byte{0, 0, 0})},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sources := newMetadataSources()
+			if err := parsePhotoshop(test.data, sources); err != nil {
+				t.Fatalf("parsePhotoshop() error: %v", err)
+			}
+			assertTags(t, "IPTC", sources.iptc, tagSet{"Keywords": []string{"heron", "bird"}})
+		})
+	}
+}
+
+func TestParsePhotoshopInvalid(t *testing.T) {
+	block := photoshopBlock(photoshopIPTCResource, "", iptcDataset(2, 25, "heron"))
+	longName := photoshopBlock(photoshopIPTCResource, "", nil)
+	longName[6] = 200
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"wrong signature", append([]byte("8BIX"), block[4:]...)},
+		{"truncated data", block[:len(block)-2]},
+		{"name past the end", longName},
+		{"wrong signature of a later block", joinBytes(block, []byte("XXXX\x04\x04\x00\x00\x00\x00\x00\x00"))},
+		{"invalid IPTC", photoshopBlock(photoshopIPTCResource, "", []byte("heron"))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := parsePhotoshop(test.data, newMetadataSources()); err == nil {
+				t.Errorf("parsePhotoshop() succeeded, want an error")
+			}
+		})
+	}
+}
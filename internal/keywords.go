@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// A KeywordSet is a set of keywords that keeps the order in which they were added.
+//
+// Keywords are compared exactly, after Unicode normalisation (NFC) so that, for instance, "café" with a combining
+// accent is the same as "café" with a precomposed "é". If the Keywords config has CaseInsensitive set, then case is
+// also ignored. The set keeps each keyword as it was first added.
+type KeywordSet struct {
+	options  Keywords
+	keywords []string
+	index    map[string]int // position of each keyword in `keywords` by its key
+}
+
+// Create a set of these keywords. Duplicates are removed.
+func NewKeywordSet(keywords []string, options Keywords) *KeywordSet {
+	set := &KeywordSet{options: options, index: make(map[string]int)}
+	set.Add(keywords...)
+	return set
+}
+
+// The key that the keyword is compared by
+func (o Keywords) keywordKey(keyword string) string {
+	key := norm.NFC.String(strings.TrimSpace(keyword))
+	if o.CaseInsensitive {
+		key = cases.Fold().String(key)
+	}
+	return key
+}
+
+// Add keywords that are not already in the set to the end of it
+func (s *KeywordSet) Add(keywords ...string) {
+	for _, keyword := range keywords {
+		key := s.options.keywordKey(keyword)
+		if key == "" {
+			continue
+		}
+		if _, ok := s.index[key]; ok {
+			continue
+		}
+		s.index[key] = len(s.keywords)
+		s.keywords = append(s.keywords, keyword)
+	}
+}
+
+// Remove keywords from the set. Keywords that are not in the set are ignored.
+func (s *KeywordSet) Remove(keywords ...string) {
+	removed := false
+	for _, keyword := range keywords {
+		key := s.options.keywordKey(keyword)
+		if i, ok := s.index[key]; ok {
+			s.keywords[i] = ""
+			delete(s.index, key)
+			removed = true
+		}
+	}
+	if !removed {
+		return
+	}
+
+	// Close the gaps
+	remaining := s.keywords[:0]
+	for _, keyword := range s.keywords {
+		if keyword != "" {
+			s.index[s.options.keywordKey(keyword)] = len(remaining)
+			remaining = append(remaining, keyword)
+		}
+	}
+	s.keywords = remaining
+}
+
+// Replace a keyword with others at the same position. If the keyword is not in the set, then the others are added to
+// the end of it.
+func (s *KeywordSet) Replace(keyword string, replacements ...string) {
+	i, ok := s.index[s.options.keywordKey(keyword)]
+	if !ok {
+		s.Add(replacements...)
+		return
+	}
+
+	before := NewKeywordSet(s.keywords[:i], s.options)
+	after := s.keywords[i+1:]
+	afterSet := NewKeywordSet(after, s.options)
+	for _, replacement := range replacements {
+		if !afterSet.Contains(replacement) {
+			before.Add(replacement)
+		}
+	}
+	before.Add(after...)
+
+	s.keywords = before.keywords
+	s.index = before.index
+}
+
+// Is the keyword in the set?
+func (s *KeywordSet) Contains(keyword string) bool {
+	_, ok := s.index[s.options.keywordKey(keyword)]
+	return ok
+}
+
+// The keywords in the order in which they were added
+func (s *KeywordSet) Keywords() []string {
+	keywords := make([]string, len(s.keywords))
+	copy(keywords, s.keywords)
+	return keywords
+}
+
+func (s *KeywordSet) Len() int {
+	return len(s.keywords)
+}
+
+// The keywords in the set that are also in `keywords`, in the order of the set
+func (s *KeywordSet) Intersection(keywords []string) []string {
+	other := NewKeywordSet(keywords, s.options)
+	var result []string
+	for _, keyword := range s.keywords {
+		if other.Contains(keyword) {
+			result = append(result, keyword)
+		}
+	}
+	return result
+}
+
+// The keywords in the set that are not in `keywords`, in the order of the set
+func (s *KeywordSet) Difference(keywords []string) []string {
+	other := NewKeywordSet(keywords, s.options)
+	var result []string
+	for _, keyword := range s.keywords {
+		if !other.Contains(keyword) {
+			result = append(result, keyword)
+		}
+	}
+	return result
+}
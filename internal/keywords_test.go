@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+var (
+	caseSensitive   = Keywords{}
+	caseInsensitive = Keywords{CaseInsensitive: true}
+)
+
+// "café" with a precomposed "é" (NFC) and with "e" followed by a combining acute accent (NFD)
+const (
+	cafeNFC = "caf\u00e9"
+	cafeNFD = "cafe\u0301"
+)
+
+// Compare keyword lists, treating nil and empty lists as the same
+func assertKeywords(t *testing.T, name string, got []string, want []string) {
+	t.Helper()
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %q, want %q", name, got, want)
+	}
+}
+
+func TestNewKeywordSet(t *testing.T) {
+	tests := []struct {
+		name     string
+		keywords []string
+		options  Keywords
+		want     []string
+	}{
+		{"empty", nil, caseSensitive, nil},
+		{"keeps order", []string{"zebra", "apple", "mango"}, caseSensitive, []string{"zebra", "apple", "mango"}},
+		{"removes duplicates", []string{"a", "b", "a", "c", "b"}, caseSensitive, []string{"a", "b", "c"}},
+		{"keeps first of duplicates", []string{"NYC", "nyc"}, caseInsensitive, []string{"NYC"}},
+		{"case differs", []string{"NYC", "nyc"}, caseSensitive, []string{"NYC", "nyc"}},
+		{"NFC and NFD are the same", []string{cafeNFD, cafeNFC}, caseSensitive, []string{cafeNFD}},
+		{"ignores empty keywords", []string{"", "a", "  "}, caseSensitive, []string{"a"}},
+		{"ignores surrounding space", []string{"a", " a "}, caseSensitive, []string{"a"}},
+		{"multi-word keywords", []string{"New York", "New", "York"}, caseSensitive, []string{"New York", "New", "York"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			set := NewKeywordSet(test.keywords, test.options)
+			assertKeywords(t, "Keywords()", set.Keywords(), test.want)
+			if set.Len() != len(test.want) {
+				t.Errorf("Len() = %d, want %d", set.Len(), len(test.want))
+			}
+		})
+	}
+}
+
+func TestKeywordSetContains(t *testing.T) {
+	tests := []struct {
+		name     string
+		keywords []string
+		options  Keywords
+		keyword  string
+		want     bool
+	}{
+		{"exact match", []string{"art"}, caseSensitive, "art", true},
+		{"not a substring", []string{"party"}, caseSensitive, "art", false},
+		{"not a superstring", []string{"art"}, caseSensitive, "party", false},
+		{"not part of a multi-word keyword", []string{"New York"}, caseSensitive, "York", false},
+		{"multi-word keyword", []string{"New York"}, caseSensitive, "New York", true},
+		{"case sensitive", []string{"NYC"}, caseSensitive, "nyc", false},
+		{"case insensitive", []string{"NYC"}, caseInsensitive, "nyc", true},
+		{"case folding", []string{"Straße"}, caseInsensitive, "STRASSE", true},
+		{"NFD in set, NFC looked up", []string{cafeNFD}, caseSensitive, cafeNFC, true},
+		{"NFC in set, NFD looked up", []string{cafeNFC}, caseSensitive, cafeNFD, true},
+		{"NFD and case", []string{cafeNFD}, caseInsensitive, "CAFÉ", true},
+		{"accent matters", []string{cafeNFC}, caseInsensitive, "cafe", false},
+		{"empty set", nil, caseSensitive, "art", false},
+		{"empty keyword", []string{"art"}, caseSensitive, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			set := NewKeywordSet(test.keywords, test.options)
+			if got := set.Contains(test.keyword); got != test.want {
+				t.Errorf("Contains(%q) = %v, want %v", test.keyword, got, test.want)
+			}
+		})
+	}
+}
+
+func TestKeywordSetAdd(t *testing.T) {
+	tests := []struct {
+		name     string
+		keywords []string
+		options  Keywords
+		add      []string
+		want     []string
+	}{
+		{"adds to the end", []string{"a", "b"}, caseSensitive, []string{"c", "d"}, []string{"a", "b", "c", "d"}},
+		{"skips existing", []string{"a", "b"}, caseSensitive, []string{"b", "c"}, []string{"a", "b", "c"}},
+		{"skips duplicates", nil, caseSensitive, []string{"c", "c"}, []string{"c"}},
+		{"skips existing in another case", []string{"NYC"}, caseInsensitive, []string{"nyc"}, []string{"NYC"}},
+		{"adds another case", []string{"NYC"}, caseSensitive, []string{"nyc"}, []string{"NYC", "nyc"}},
+		{"skips another normal form", []string{cafeNFC}, caseSensitive, []string{cafeNFD}, []string{cafeNFC}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			set := NewKeywordSet(test.keywords, test.options)
+			set.Add(test.add...)
+			assertKeywords(t, "Keywords()", set.Keywords(), test.want)
+		})
+	}
+}
+
+// Keywords are deleted from the tags by removing them from a set, as rule evaluation does
+func TestKeywordSetRemove(t *testing.T) {
+	tests := []struct {
+		name     string
+		keywords []string
+		options  Keywords
+		remove   []string
+		want     []string
+	}{
+		{"removes keyword", []string{"a", "private", "b"}, caseSensitive, []string{"private"}, []string{"a", "b"}},
+		{"removes several", []string{"a", "b", "c", "d"}, caseSensitive, []string{"d", "b"}, []string{"a", "c"}},
+		{"ignores missing", []string{"a", "b"}, caseSensitive, []string{"c"}, []string{"a", "b"}},
+		{"doesn't remove substrings", []string{"party", "art"}, caseSensitive, []string{"art"}, []string{"party"}},
+		{"doesn't remove superstrings", []string{"party", "art"}, caseSensitive, []string{"party"}, []string{"art"}},
+		{"doesn't remove words of a multi-word keyword", []string{"New York", "York"}, caseSensitive,
+			[]string{"York"}, []string{"New York"}},
+		{"case sensitive", []string{"Private", "a"}, caseSensitive, []string{"private"}, []string{"Private", "a"}},
+		{"case insensitive", []string{"Private", "a"}, caseInsensitive, []string{"private"}, []string{"a"}},
+		{"other normal form", []string{cafeNFC, "a"}, caseSensitive, []string{cafeNFD}, []string{"a"}},
+		{"removes all", []string{"a", "b"}, caseSensitive, []string{"b", "a"}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			set := NewKeywordSet(test.keywords, test.options)
+			set.Remove(test.remove...)
+			assertKeywords(t, "Keywords()", set.Keywords(), test.want)
+
+			for _, keyword := range test.remove {
+				if set.Contains(keyword) {
+					t.Errorf("Contains(%q) = true after it was removed", keyword)
+				}
+			}
+			for _, keyword := range test.want {
+				if !set.Contains(keyword) {
+					t.Errorf("Contains(%q) = false but it wasn't removed", keyword)
+				}
+			}
+
+			// The set is still usable after keywords have been removed
+			set.Add("added")
+			assertKeywords(t, "Keywords() after Add", set.Keywords(), append(append([]string{}, test.want...), "added"))
+		})
+	}
+}
+
+func TestKeywordSetReplace(t *testing.T) {
+	tests := []struct {
+		name         string
+		keywords     []string
+		options      Keywords
+		keyword      string
+		replacements []string
+		want         []string
+	}{
+		{"keeps position", []string{"a", "b", "c"}, caseSensitive, "b", []string{"x"}, []string{"a", "x", "c"}},
+		{"several replacements", []string{"a", "b", "c"}, caseSensitive, "b", []string{"x", "y"},
+			[]string{"a", "x", "y", "c"}},
+		{"no replacements removes", []string{"a", "b", "c"}, caseSensitive, "b", nil, []string{"a", "c"}},
+		{"missing keyword adds", []string{"a"}, caseSensitive, "b", []string{"x"}, []string{"a", "x"}},
+		{"replacement already before", []string{"x", "b", "c"}, caseSensitive, "b", []string{"x"},
+			[]string{"x", "c"}},
+		{"replacement already after", []string{"a", "b", "x"}, caseSensitive, "b", []string{"x"},
+			[]string{"a", "x"}},
+		{"case insensitive", []string{"a", "NYC"}, caseInsensitive, "nyc", []string{"New York"},
+			[]string{"a", "New York"}},
+		{"same keyword in another case", []string{"nyc"}, caseSensitive, "nyc", []string{"NYC"}, []string{"NYC"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			set := NewKeywordSet(test.keywords, test.options)
+			set.Replace(test.keyword, test.replacements...)
+			assertKeywords(t, "Keywords()", set.Keywords(), test.want)
+		})
+	}
+}
+
+func TestKeywordSetIntersectionAndDifference(t *testing.T) {
+	tests := []struct {
+		name         string
+		keywords     []string
+		options      Keywords
+		other        []string
+		intersection []string
+		difference   []string
+	}{
+		{"order of the set", []string{"c", "a", "b"}, caseSensitive, []string{"b", "c"},
+			[]string{"c", "b"}, []string{"a"}},
+		{"no overlap", []string{"a", "b"}, caseSensitive, []string{"c"}, nil, []string{"a", "b"}},
+		{"not substrings", []string{"party"}, caseSensitive, []string{"art"}, nil, []string{"party"}},
+		{"multi-word keywords", []string{"New York", "York"}, caseSensitive, []string{"New York"},
+			[]string{"New York"}, []string{"York"}},
+		{"case sensitive", []string{"NYC"}, caseSensitive, []string{"nyc"}, nil, []string{"NYC"}},
+		{"case insensitive", []string{"NYC"}, caseInsensitive, []string{"nyc"}, []string{"NYC"}, nil},
+		{"normal forms", []string{cafeNFD}, caseSensitive, []string{cafeNFC}, []string{cafeNFD}, nil},
+		{"not symmetric", []string{"a"}, caseSensitive, []string{"a", "b"}, []string{"a"}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			set := NewKeywordSet(test.keywords, test.options)
+			assertKeywords(t, "Intersection()", set.Intersection(test.other), test.intersection)
+			assertKeywords(t, "Difference()", set.Difference(test.other), test.difference)
+		})
+	}
+}
+
+// The order of the keywords must not depend on map iteration order
+func TestKeywordSetStableOrder(t *testing.T) {
+	keywords := []string{"m", "b", "x", "a", "q", "c", "z", "d", "k", "e"}
+	for i := 0; i < 20; i++ {
+		set := NewKeywordSet(keywords, caseSensitive)
+		set.Remove("x", "k")
+		set.Add("n")
+		assertKeywords(t, "Keywords()", set.Keywords(), []string{"m", "b", "a", "q", "c", "z", "d", "e", "n"})
+		assertKeywords(t, "Difference()", set.Difference([]string{"a", "z"}),
+			[]string{"m", "b", "q", "c", "d", "e", "n"})
+	}
+}
+
+func TestKeywordSetKeywordsIsACopy(t *testing.T) {
+	set := NewKeywordSet([]string{"a", "b"}, caseSensitive)
+	keywords := set.Keywords()
+	keywords[0] = "changed"
+	assertKeywords(t, "Keywords()", set.Keywords(), []string{"a", "b"})
+}
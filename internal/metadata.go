@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
@@ -12,18 +11,20 @@ import (
 )
 
 type ImageInfo struct {
-	Width        uint        `json:"ImageWidth"`
-	Height       uint        `json:"ImageHeight"`
-	Title        string      `json:"Title"`
-	Description  string      `json:"Description"`
-	Keywords     stringArray `json:"Keywords"`
-	Date         *time.Time
-	Make         string                 `json:"Make"`
-	Model        string                 `json:"Model"`
-	ShutterSpeed string                 `json:"ShutterSpeedValue"`
-	Aperture     json.Number            `json:"ApertureValue"`
-	ISO          json.Number            `json:"ISO"`
-	X            map[string]interface{} `json:"-"`
+	Width       uint        `json:"ImageWidth"`
+	Height      uint        `json:"ImageHeight"`
+	Title       string      `json:"Title"`
+	Description string      `json:"Description"`
+	Keywords    stringArray `json:"Keywords"`
+	// Hierarchical keywords, e.g. "Animals|Birds|Heron"
+	HierarchicalSubject stringArray `json:"HierarchicalSubject"`
+	Date                *time.Time
+	Make                string                 `json:"Make"`
+	Model               string                 `json:"Model"`
+	ShutterSpeed        string                 `json:"ShutterSpeedValue"`
+	Aperture            json.Number            `json:"ApertureValue"`
+	ISO                 json.Number            `json:"ISO"`
+	X                   map[string]interface{} `json:"-"`
 }
 
 func (info *ImageInfo) UnmarshalJSON(data []byte) error {
@@ -60,6 +61,18 @@ func (info *ImageInfo) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// The tree of the image's hierarchical keywords
+func (info *ImageInfo) KeywordTree(options Keywords) *KeywordTree {
+	return NewKeywordTree(info.HierarchicalSubject, options)
+}
+
+// The keywords that rules match: the image's keywords and every level of its hierarchical keywords, e.g. "Animals",
+// "Animals|Birds" and "Animals|Birds|Heron", so that a rule can match any level
+func (info *ImageInfo) MatchKeywords() []string {
+	keywords := append([]string{}, info.Keywords...)
+	return append(keywords, info.KeywordTree(Keywords{}).Paths()...)
+}
+
 // A stringArray is an array of strings that has been unmarshalled from a JSON
 // property that could be either a string or an array of string
 type stringArray []string
@@ -96,27 +109,78 @@ func (sa *stringArray) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-// Read metadata (Exif/IPTC) from image using exiftool
-func GetImageInfo(filename string, exiftool string) (*ImageInfo, error) {
-	cmd := exec.Command(exiftool, "-j", filename)
+// A MetadataReader reads the metadata of image files
+type MetadataReader interface {
+	ReadMetadata(filename string) (*ImageInfo, error)
+}
+
+// The metadata readers that can be set in the config
+const (
+	NativeMetadataReader   = "native"
+	ExiftoolMetadataReader = "exiftool"
+)
+
+// Create the metadata reader that is set in the config. `exiftool` is nil if exiftool is not configured.
+func NewMetadataReader(config *Config, exiftool *Exiftool) (MetadataReader, error) {
+	var reader MetadataReader
+	switch config.MetadataReaderName() {
+	case NativeMetadataReader:
+		reader = NativeReader{}
+	case ExiftoolMetadataReader:
+		if exiftool == nil {
+			return nil, fmt.Errorf("cmd.exiftool needs to be configured to use the exiftool metadata reader")
+		}
+		reader = ExiftoolReader{Exiftool: exiftool}
+	default:
+		return nil, fmt.Errorf("unknown metadata.reader '%s': it must be %s or %s", config.Metadata.Reader,
+			NativeMetadataReader, ExiftoolMetadataReader)
+	}
+
+	switch config.Metadata.Sidecar {
+	case SidecarPrefer, SidecarFallback:
+		return SidecarReader{Reader: reader, Precedence: config.Metadata.Sidecar}, nil
+	case SidecarIgnore:
+		return reader, nil
+	}
+	return nil, fmt.Errorf("unknown metadata.sidecar '%s': it must be %s, %s or %s", config.Metadata.Sidecar,
+		SidecarPrefer, SidecarFallback, SidecarIgnore)
+}
+
+// An ExiftoolReader reads metadata using exiftool, which supports many more file types than NativeReader
+type ExiftoolReader struct {
+	Exiftool *Exiftool
+}
 
-	out, err := cmd.Output()
+// Read metadata (Exif/IPTC/XMP) from image using exiftool
+func (r ExiftoolReader) ReadMetadata(filename string) (*ImageInfo, error) {
+	out, err := r.Exiftool.Execute("-j", filename)
 	if err != nil {
-		fmt.Printf("%s\n", err.(*exec.ExitError).Stderr)
 		return nil, err
 	}
 
 	// Exiftool always returns an array but as we only passed in one filename we know that there's only one element.
-	// Remove the surrounding `[` and `]` from the JSON string to convert to a single object.
-	out = out[1 : len(out)-2]
+	var tags []map[string]interface{}
+	if err := json.Unmarshal(out, &tags); err != nil || len(tags) != 1 {
+		return nil, fmt.Errorf("%s: unable to read the output of exiftool: %v", filename, err)
+	}
+
+	return imageInfoFromTags(tags[0])
+}
+
+// Create the ImageInfo for the metadata tags of an image, which are named as exiftool names them
+func imageInfoFromTags(tags map[string]interface{}) (*ImageInfo, error) {
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return nil, err
+	}
 
 	info := ImageInfo{}
-	if err := json.Unmarshal(out, &info); err != nil {
+	if err := json.Unmarshal(data, &info); err != nil {
 		log.Println(err)
 	}
 
 	// unmarshall everything into info.X
-	if err := json.Unmarshal(out, &info.X); err != nil {
+	if err := json.Unmarshal(data, &info.X); err != nil {
 		log.Println(err)
 	}
 
@@ -125,9 +189,15 @@ func GetImageInfo(filename string, exiftool string) (*ImageInfo, error) {
 	return &info, nil
 }
 
+// The offset from UTC at the end of a date, e.g. "+01:00" or "-05:00"
+var dateOffsetPattern = regexp.MustCompile(`[+-]\d{2}:?\d{2}$`)
+
 func setImageInfoDate(info *ImageInfo) {
 	// Set DateTimeOriginal with offset from OffsetTimeOriginal if it's set and is an offset
-	dateTimeOriginal := info.X["DateTimeOriginal"].(string)
+	dateTimeOriginal, ok := info.X["DateTimeOriginal"].(string)
+	if !ok {
+		return
+	}
 
 	// Determine timezone
 	tz := time.FixedZone("UTC", 0)
@@ -140,10 +210,10 @@ func setImageInfoDate(info *ImageInfo) {
 	}
 
 	// remove hour offset if there is one
-	if idx := strings.Index(dateTimeOriginal, "+"); idx != -1 {
-		offset := dateTimeOriginal[idx:]
+	if idx := dateOffsetPattern.FindStringIndex(dateTimeOriginal); idx != nil {
+		offset := dateTimeOriginal[idx[0]:]
 		tz = getTimeZoneFromOffset(offset, tz)
-		dateTimeOriginal = dateTimeOriginal[:idx]
+		dateTimeOriginal = dateTimeOriginal[:idx[0]]
 	}
 
 	// remove a trailing Z if there is one
@@ -0,0 +1,376 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A MetadataUpdate is a set of changes to the metadata of an image. The fields that are not set are not changed.
+type MetadataUpdate struct {
+	AddKeywords     []string
+	RemoveKeywords  []string // every variant of each keyword is removed, e.g. both "NYC" and "nyc" if case is ignored
+	ReplaceKeywords []KeywordReplacement
+	Title           *string
+	Description     *string
+	GPS             *GPSPosition
+}
+
+// A KeywordReplacement replaces a keyword with another one
+type KeywordReplacement struct {
+	From string
+	To   string
+}
+
+// A GPSPosition is where an image was taken, in decimal degrees. Latitudes south of the equator and longitudes west of
+// Greenwich are negative.
+type GPSPosition struct {
+	Latitude  float64
+	Longitude float64
+	Altitude  *float64 // in metres, negative if below sea level
+}
+
+// Whether the update changes anything
+func (u MetadataUpdate) IsEmpty() bool {
+	return len(u.AddKeywords) == 0 && len(u.RemoveKeywords) == 0 && len(u.ReplaceKeywords) == 0 && u.Title == nil &&
+		u.Description == nil && u.GPS == nil
+}
+
+// A MetadataWriter changes the metadata of image files
+type MetadataWriter interface {
+	WriteMetadata(filename string, source string, update MetadataUpdate) error
+}
+
+// Where metadata is written, which can be set in the config
+const (
+	MetadataTargetFile    = "file"    // the image itself
+	MetadataTargetSidecar = "sidecar" // the image's XMP sidecar, which is created if it doesn't exist
+	MetadataTargetBoth    = "both"    // the image and, if it has one, its XMP sidecar
+)
+
+// The suffix of the copy of the original file that is kept when metadata.backup is set, which is the same as exiftool
+// uses
+const metadataBackupSuffix = "_original"
+
+// Create the metadata writer that is set in the config. `exiftool` is nil if exiftool is not configured.
+func NewMetadataWriter(config *Config, exiftool *Exiftool) (MetadataWriter, error) {
+	if exiftool == nil {
+		return nil, fmt.Errorf("cmd.exiftool needs to be configured to write metadata")
+	}
+	switch config.Metadata.WriteTo {
+	case MetadataTargetFile, MetadataTargetSidecar, MetadataTargetBoth:
+	default:
+		return nil, fmt.Errorf("unknown metadata.write_to '%s': it must be %s, %s or %s", config.Metadata.WriteTo,
+			MetadataTargetFile, MetadataTargetSidecar, MetadataTargetBoth)
+	}
+	return ExiftoolWriter{
+		Exiftool: exiftool,
+		Target:   config.Metadata.WriteTo,
+		Backup:   config.Metadata.Backup,
+		Keywords: config.Keywords,
+	}, nil
+}
+
+// An ExiftoolWriter writes metadata using exiftool.
+//
+// Keywords are written to IPTC Keywords and XMP Subject and are removed from those and from XMP HierarchicalSubject,
+// where an entry is removed if either the whole of it or its last level matches, e.g. removing "Heron" removes
+// "Animals|Birds|Heron". A sidecar only has the XMP tags.
+//
+// Each write is checked by reading the keywords back. If exiftool fails or the keywords are not as expected, then the
+// file is restored to how it was before.
+type ExiftoolWriter struct {
+	Exiftool *Exiftool
+	Target   string   // MetadataTargetFile, MetadataTargetSidecar or MetadataTargetBoth
+	Backup   bool     // keep a copy of the original file, with metadataBackupSuffix, the first time that it is changed
+	Keywords Keywords // how keywords are compared
+}
+
+// The keyword tags of a file
+type fileKeywords struct {
+	Keywords            stringArray `json:"Keywords"`
+	Subject             stringArray `json:"Subject"`
+	HierarchicalSubject stringArray `json:"HierarchicalSubject"`
+}
+
+// A file that a write changes
+type writeTarget struct {
+	filename  string
+	isSidecar bool
+	created   bool // the sidecar was created by this write
+	restore   func() error
+	cleanUp   func()
+}
+
+// Change the metadata of the image `filename` and/or of the sidecar of `source`, which is the file that the image was
+// converted from, or the same as `filename` if it wasn't. Either all of the files are changed or none of them are.
+func (w ExiftoolWriter) WriteMetadata(filename string, source string, update MetadataUpdate) error {
+	if update.IsEmpty() {
+		return nil
+	}
+
+	var targets []*writeTarget
+	if w.Target == MetadataTargetFile || w.Target == MetadataTargetBoth {
+		targets = append(targets, &writeTarget{filename: filename})
+	}
+	switch w.Target {
+	case MetadataTargetSidecar:
+		target := &writeTarget{filename: SidecarFilename(source), isSidecar: true}
+		if _, err := os.Stat(target.filename); os.IsNotExist(err) {
+			// Create the sidecar with the XMP metadata of the image
+			if _, err := w.Exiftool.Execute("-o", target.filename, source); err != nil {
+				return fmt.Errorf("unable to create the sidecar %s: %v", target.filename, err)
+			}
+			target.created = true
+		} else if err != nil {
+			return err
+		}
+		targets = append(targets, target)
+	case MetadataTargetBoth:
+		// Only a sidecar that already exists is changed
+		if sidecar := FindSidecar(source); sidecar != "" {
+			targets = append(targets, &writeTarget{filename: sidecar, isSidecar: true})
+		}
+	}
+
+	// Back up all of the files first so that they can all be restored if writing to any of them fails
+	for _, target := range targets {
+		if w.Backup && !target.created {
+			if err := backupFile(target.filename); err != nil {
+				return fmt.Errorf("unable to back up %s: %v", target.filename, err)
+			}
+		}
+		var err error
+		target.restore, target.cleanUp, err = snapshotFile(target.filename, target.created)
+		if err != nil {
+			return err
+		}
+		defer target.cleanUp()
+	}
+
+	for i, target := range targets {
+		if err := w.write(target, update); err != nil {
+			err = fmt.Errorf("%s: %v", target.filename, err)
+			for _, written := range targets[:i+1] {
+				if restoreErr := written.restore(); restoreErr != nil {
+					return fmt.Errorf("%v; and unable to restore %s: %v", err, written.filename, restoreErr)
+				}
+			}
+			return fmt.Errorf("%v; the files have been restored", err)
+		}
+	}
+	return nil
+}
+
+// Change the metadata of one file and check the keywords
+func (w ExiftoolWriter) write(target *writeTarget, update MetadataUpdate) error {
+	current, err := w.readKeywords(target.filename)
+	if err != nil {
+		return err
+	}
+	add, remove := w.keywordChanges(update)
+
+	parameters := []string{"-overwrite_original"}
+	parameters = append(parameters, w.keywordParameters(current, add, remove, target.isSidecar)...)
+	parameters = append(parameters, metadataParameters(update, target.isSidecar)...)
+	parameters = append(parameters, target.filename)
+	if _, err := w.Exiftool.Execute(parameters...); err != nil {
+		return err
+	}
+	return w.checkKeywords(target.filename, add, remove, target.isSidecar)
+}
+
+// The keywords to add and remove, including those that are replaced
+func (w ExiftoolWriter) keywordChanges(update MetadataUpdate) (*KeywordSet, *KeywordSet) {
+	add := NewKeywordSet(update.AddKeywords, w.Keywords)
+	remove := NewKeywordSet(update.RemoveKeywords, w.Keywords)
+	for _, r := range update.ReplaceKeywords {
+		remove.Add(r.From)
+		add.Add(r.To)
+	}
+	return add, remove
+}
+
+// Read the keyword tags of a file
+func (w ExiftoolWriter) readKeywords(filename string) (*fileKeywords, error) {
+	out, err := w.Exiftool.Execute("-j", "-Keywords", "-Subject", "-HierarchicalSubject", filename)
+	if err != nil {
+		return nil, err
+	}
+	var keywords []fileKeywords
+	if err := json.Unmarshal(out, &keywords); err != nil || len(keywords) != 1 {
+		return nil, fmt.Errorf("%s: unable to read the output of exiftool: %v", filename, err)
+	}
+	return &keywords[0], nil
+}
+
+// The exiftool parameters that remove every variant of the keywords in `remove` that the file has and then add
+// those in `add`
+func (w ExiftoolWriter) keywordParameters(current *fileKeywords, add *KeywordSet, remove *KeywordSet,
+	isSidecar bool) []string {
+	var parameters []string
+	lists := []struct {
+		tag    string
+		values []string
+	}{
+		{"Keywords", current.Keywords},
+		{"Subject", current.Subject},
+		{"HierarchicalSubject", current.HierarchicalSubject},
+	}
+	for _, list := range lists {
+		if isSidecar && list.tag == "Keywords" {
+			continue
+		}
+		for _, value := range list.values {
+			// The variants of a keyword that is added are removed so that it is only in the list once
+			isAdded := list.tag != "HierarchicalSubject" && add.Contains(value)
+			if w.matchesKeyword(value, list.tag, remove) || isAdded {
+				parameters = append(parameters, fmt.Sprintf("-%s-=%s", list.tag, value))
+			}
+		}
+	}
+
+	for _, keyword := range add.Keywords() {
+		if !isSidecar {
+			parameters = append(parameters, fmt.Sprintf("-Keywords-=%s", keyword))
+			parameters = append(parameters, fmt.Sprintf("-Keywords+=%s", keyword))
+		}
+		parameters = append(parameters, fmt.Sprintf("-Subject-=%s", keyword))
+		parameters = append(parameters, fmt.Sprintf("-Subject+=%s", keyword))
+	}
+	return parameters
+}
+
+// Whether a value of a keyword tag is one of the keywords. A hierarchical subject also matches by its last level.
+func (w ExiftoolWriter) matchesKeyword(value string, tag string, keywords *KeywordSet) bool {
+	if keywords.Contains(value) {
+		return true
+	}
+	if tag == "HierarchicalSubject" {
+		levels := strings.Split(value, "|")
+		return keywords.Contains(levels[len(levels)-1])
+	}
+	return false
+}
+
+// Check that the file has the keywords that were added and none of those that were removed
+func (w ExiftoolWriter) checkKeywords(filename string, add *KeywordSet, remove *KeywordSet, isSidecar bool) error {
+	current, err := w.readKeywords(filename)
+	if err != nil {
+		return err
+	}
+	removed := NewKeywordSet(remove.Difference(add.Keywords()), w.Keywords)
+
+	lists := map[string][]string{
+		"Subject":             current.Subject,
+		"HierarchicalSubject": current.HierarchicalSubject,
+	}
+	if !isSidecar {
+		lists["Keywords"] = current.Keywords
+	}
+	for tag, values := range lists {
+		has := NewKeywordSet(values, w.Keywords)
+		if tag != "HierarchicalSubject" {
+			for _, keyword := range add.Keywords() {
+				if !has.Contains(keyword) {
+					return fmt.Errorf("keyword '%s' was not added to %s", keyword, tag)
+				}
+			}
+		}
+		for _, value := range values {
+			if w.matchesKeyword(value, tag, removed) {
+				return fmt.Errorf("keyword '%s' was not removed from %s", value, tag)
+			}
+		}
+	}
+	return nil
+}
+
+// The exiftool parameters that set the title, description and GPS position
+func metadataParameters(update MetadataUpdate, isSidecar bool) []string {
+	var parameters []string
+	if update.Title != nil {
+		parameters = append(parameters, "-Title="+*update.Title)
+		if !isSidecar {
+			parameters = append(parameters, "-ObjectName="+*update.Title)
+		}
+	}
+	if update.Description != nil {
+		parameters = append(parameters, "-Description="+*update.Description)
+		if !isSidecar {
+			parameters = append(parameters, "-Caption-Abstract="+*update.Description)
+			parameters = append(parameters, "-ImageDescription="+*update.Description)
+		}
+	}
+	if gps := update.GPS; gps != nil {
+		// The * also sets the reference tags, e.g. GPSLatitudeRef, from the sign of the value
+		parameters = append(parameters, fmt.Sprintf("-GPSLatitude*=%f", gps.Latitude))
+		parameters = append(parameters, fmt.Sprintf("-GPSLongitude*=%f", gps.Longitude))
+		if gps.Altitude != nil {
+			parameters = append(parameters, fmt.Sprintf("-GPSAltitude*=%f", *gps.Altitude))
+		}
+	}
+	return parameters
+}
+
+// Copy a file to its backup, unless there already is one, so that the backup is always the original
+func backupFile(filename string) error {
+	backup := filename + metadataBackupSuffix
+	if _, err := os.Stat(backup); err == nil {
+		return nil
+	}
+	return copyFile(filename, backup)
+}
+
+// Copy a file so that it can be restored if writing to it fails. `restore` puts the copy back or, if the file has just
+// been created, removes it and `cleanUp` removes the copy.
+func snapshotFile(filename string, created bool) (restore func() error, cleanUp func(), err error) {
+	if created {
+		return func() error { return os.Remove(filename) }, func() {}, nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".rodeo")
+	if err != nil {
+		return nil, nil, err
+	}
+	tmp.Close()
+	if err := copyFile(filename, tmp.Name()); err != nil {
+		_ = os.Remove(tmp.Name())
+		return nil, nil, err
+	}
+
+	restore = func() error {
+		return os.Rename(tmp.Name(), filename)
+	}
+	cleanUp = func() {
+		_ = os.Remove(tmp.Name())
+	}
+	return restore, cleanUp, nil
+}
+
+// Copy a file, keeping its permissions
+func copyFile(from string, to string) error {
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	stat, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	destination, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destination, source); err != nil {
+		_ = destination.Close()
+		return err
+	}
+	return destination.Close()
+}
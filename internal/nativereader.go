@@ -0,0 +1,367 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A NativeReader reads the Exif, IPTC and XMP metadata of JPEG, PNG and TIFF files, and XMP sidecars, without using
+// exiftool. The tags in ImageInfo.X have the same names and, for the tags that Rodeo uses, the same values as
+// `exiftool -j` gives.
+type NativeReader struct{}
+
+// A tagSet is a set of metadata tags by name. The first value set for a tag is kept.
+type tagSet map[string]interface{}
+
+func (t tagSet) set(name string, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return
+		}
+	case []string:
+		if len(v) == 0 {
+			return
+		}
+	}
+	if _, ok := t[name]; !ok {
+		t[name] = value
+	}
+}
+
+// The metadata of an image from each of the places that it is stored
+type metadataSources struct {
+	file tagSet // properties of the file and the image itself, such as its size
+	exif tagSet
+	iptc tagSet
+	xmp  tagSet
+}
+
+func newMetadataSources() *metadataSources {
+	return &metadataSources{file: tagSet{}, exif: tagSet{}, iptc: tagSet{}, xmp: tagSet{}}
+}
+
+// Merge the metadata. If a tag is in more than one place, then the file's properties take precedence over Exif, which
+// takes precedence over IPTC and then XMP.
+func (s *metadataSources) merge() tagSet {
+	tags := tagSet{}
+	for _, source := range []tagSet{s.file, s.exif, s.iptc, s.xmp} {
+		for name, value := range source {
+			tags.set(name, value)
+		}
+	}
+	return tags
+}
+
+// The largest PNG chunk that is read
+const maxPNGChunkSize = 64 << 20
+
+var (
+	jpegSignature             = []byte{0xff, 0xd8}
+	tiffSignatureLittleEndian = []byte("II*\x00")
+	tiffSignatureBigEndian    = []byte("MM\x00*")
+
+	jpegExifPrefix      = []byte("Exif\x00\x00")
+	jpegXMPPrefix       = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegPhotoshopPrefix = []byte("Photoshop 3.0\x00")
+)
+
+// Read the metadata of an image file
+func (NativeReader) ReadMetadata(filename string) (*ImageInfo, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	sources := newMetadataSources()
+	sources.file.set("FileName", filepath.Base(filename))
+	sources.file.set("Directory", filepath.Dir(filename))
+	sources.file.set("FileSize", formatFileSize(stat.Size()))
+
+	r := bufio.NewReader(file)
+	signature, err := r.Peek(8)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(signature, jpegSignature):
+		sources.file.set("FileType", "JPEG")
+		sources.file.set("MIMEType", "image/jpeg")
+		err = readJPEG(r, sources)
+	case bytes.HasPrefix(signature, pngSignature):
+		sources.file.set("FileType", "PNG")
+		sources.file.set("MIMEType", "image/png")
+		err = readPNG(r, sources)
+	case bytes.HasPrefix(signature, tiffSignatureLittleEndian) || bytes.HasPrefix(signature, tiffSignatureBigEndian):
+		sources.file.set("FileType", "TIFF")
+		sources.file.set("MIMEType", "image/tiff")
+		var data []byte
+		data, err = ioutil.ReadAll(r)
+		if err == nil {
+			err = parseTIFF(data, sources, true)
+		}
+	case isXMPFile(signature):
+		sources.file.set("FileType", "XMP")
+		sources.file.set("MIMEType", "application/rdf+xml")
+		var data []byte
+		data, err = ioutil.ReadAll(r)
+		if err == nil {
+			err = parseXMP(data, sources.xmp)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported file type: only JPEG, PNG, TIFF and XMP files can be read without "+
+			"exiftool", filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	return imageInfoFromTags(sources.merge())
+}
+
+// Whether a file that starts with `signature` is an XMP file, such as a sidecar, which is XML
+func isXMPFile(signature []byte) bool {
+	signature = bytes.TrimPrefix(signature, []byte("\xef\xbb\xbf"))
+	signature = bytes.TrimLeft(signature, " \t\r\n")
+	return len(signature) > 0 && signature[0] == '<'
+}
+
+// Read the segments of a JPEG file up to the image data
+func readJPEG(r *bufio.Reader, sources *metadataSources) error {
+	if _, err := r.Discard(len(jpegSignature)); err != nil {
+		return err
+	}
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0xff {
+			return errors.New("invalid JPEG data")
+		}
+		marker, err := r.ReadByte()
+		for err == nil && marker == 0xff {
+			// Fill bytes
+			marker, err = r.ReadByte()
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case marker == 0x01 || marker == 0xd8 || (marker >= 0xd0 && marker <= 0xd7):
+			// Markers without a segment
+			continue
+		case marker == 0xd9 || marker == 0xda:
+			// End of image or start of the image data: there is no more metadata
+			return nil
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return err
+		}
+		if length < 2 {
+			return errors.New("invalid JPEG segment")
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return err
+		}
+
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(segment, jpegExifPrefix):
+			err = parseTIFF(segment[len(jpegExifPrefix):], sources, false)
+		case marker == 0xe1 && bytes.HasPrefix(segment, jpegXMPPrefix):
+			err = parseXMP(segment[len(jpegXMPPrefix):], sources.xmp)
+		case marker == 0xed && bytes.HasPrefix(segment, jpegPhotoshopPrefix):
+			err = parsePhotoshop(segment[len(jpegPhotoshopPrefix):], sources)
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			// Start of frame
+			if len(segment) >= 5 {
+				sources.file.set("ImageHeight", binary.BigEndian.Uint16(segment[1:3]))
+				sources.file.set("ImageWidth", binary.BigEndian.Uint16(segment[3:5]))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Read the chunks of a PNG file
+func readPNG(r *bufio.Reader, sources *metadataSources) error {
+	if _, err := r.Discard(len(pngSignature)); err != nil {
+		return err
+	}
+
+	for {
+		var header struct {
+			Length uint32
+			Type   [4]byte
+		}
+		if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		chunkType := string(header.Type[:])
+
+		switch chunkType {
+		case "IHDR", "eXIf", "iTXt", "tEXt", "zTXt":
+		case "IEND":
+			return nil
+		default:
+			// Skip the chunk and its CRC
+			if _, err := io.CopyN(ioutil.Discard, r, int64(header.Length)+4); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if header.Length > maxPNGChunkSize {
+			return fmt.Errorf("PNG %s chunk is too large", chunkType)
+		}
+		data := make([]byte, header.Length+4)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		data = data[:header.Length]
+
+		var err error
+		switch chunkType {
+		case "IHDR":
+			if len(data) >= 8 {
+				sources.file.set("ImageWidth", binary.BigEndian.Uint32(data[0:4]))
+				sources.file.set("ImageHeight", binary.BigEndian.Uint32(data[4:8]))
+			}
+		case "eXIf":
+			err = parseTIFF(data, sources, false)
+		case "iTXt":
+			err = readPNGInternationalText(data, sources)
+		case "tEXt", "zTXt":
+			err = readPNGText(chunkType, data, sources)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Read XMP from an iTXt chunk
+func readPNGInternationalText(data []byte, sources *metadataSources) error {
+	// keyword \0 compression flag, compression method, language tag \0 translated keyword \0 text
+	parts := bytes.SplitN(data, []byte{0}, 2)
+	if len(parts) != 2 || string(parts[0]) != "XML:com.adobe.xmp" || len(parts[1]) < 2 {
+		return nil
+	}
+	compressed := parts[1][0] == 1
+	parts = bytes.SplitN(parts[1][2:], []byte{0}, 3)
+	if len(parts) != 3 {
+		return errors.New("invalid PNG iTXt chunk")
+	}
+	text := parts[2]
+	if compressed {
+		var err error
+		if text, err = inflate(text); err != nil {
+			return err
+		}
+	}
+	return parseXMP(text, sources.xmp)
+}
+
+// Read the metadata that ImageMagick and exiftool store in tEXt and zTXt chunks as hex encoded "raw profiles"
+func readPNGText(chunkType string, data []byte, sources *metadataSources) error {
+	parts := bytes.SplitN(data, []byte{0}, 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	keyword, text := string(parts[0]), parts[1]
+	if !strings.HasPrefix(keyword, "Raw profile type ") {
+		return nil
+	}
+	if chunkType == "zTXt" {
+		if len(text) < 1 {
+			return errors.New("invalid PNG zTXt chunk")
+		}
+		var err error
+		if text, err = inflate(text[1:]); err != nil {
+			return err
+		}
+	}
+
+	profile, err := decodeRawProfile(text)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(strings.TrimPrefix(keyword, "Raw profile type ")) {
+	case "exif", "app1":
+		return parseTIFF(bytes.TrimPrefix(profile, jpegExifPrefix), sources, false)
+	case "iptc":
+		if bytes.HasPrefix(profile, []byte(photoshopResourceSignature)) {
+			return parsePhotoshop(profile, sources)
+		}
+		return parseIPTC(profile, sources.iptc)
+	case "8bim":
+		return parsePhotoshop(profile, sources)
+	case "xmp":
+		return parseXMP(profile, sources.xmp)
+	}
+	return nil
+}
+
+// Decode a raw profile, which is "\n<type>\n<length>\n" followed by the profile in hex, split across lines
+func decodeRawProfile(text []byte) ([]byte, error) {
+	fields := strings.Fields(string(text))
+	if len(fields) < 2 {
+		return nil, errors.New("invalid PNG raw profile")
+	}
+	profile, err := hex.DecodeString(strings.Join(fields[2:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PNG raw profile: %v", err)
+	}
+	return profile, nil
+}
+
+func inflate(data []byte) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(io.LimitReader(reader, maxPNGChunkSize))
+}
+
+// Format the size of a file as exiftool does, e.g. "2.3 MB"
+func formatFileSize(size int64) string {
+	switch {
+	case size < 2048:
+		return fmt.Sprintf("%d bytes", size)
+	case size < 10240:
+		return fmt.Sprintf("%.1f kB", float64(size)/1024)
+	case size < 2097152:
+		return fmt.Sprintf("%.0f kB", float64(size)/1024)
+	case size < 10485760:
+		return fmt.Sprintf("%.1f MB", float64(size)/1048576)
+	}
+	return fmt.Sprintf("%.0f MB", float64(size)/1048576)
+}
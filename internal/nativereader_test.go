@@ -0,0 +1,355 @@
+package internal
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A JPEG segment with its marker and length
+func jpegSegment(marker byte, data ...[]byte) []byte {
+	segment := joinBytes(data...)
+	header := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(segment)+2))
+	return append(header, segment...)
+}
+
+// A JPEG start of frame segment for an image of this size
+func jpegStartOfFrame(width uint16, height uint16) []byte {
+	frame := []byte{8, 0, 0, 0, 0, 1, 1, 0x11, 0}
+	binary.BigEndian.PutUint16(frame[1:], height)
+	binary.BigEndian.PutUint16(frame[3:], width)
+	return jpegSegment(0xc0, frame)
+}
+
+// A JPEG with Exif, XMP and IPTC metadata, up to the start of the image data
+func testJPEG() []byte {
+	exif := newTestTIFF(binary.BigEndian)
+	xmp := strings.Replace(testXMP, `tiff:Make="Nikon"`,
+		`tiff:Make="Nikon" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:Label="Red"`, 1)
+	iptc := joinBytes(iptcDataset(2, 25, "heron"), iptcDataset(2, 25, "bird"), iptcDataset(2, 90, "London"))
+	return joinBytes(
+		jpegSignature,
+		jpegSegment(0xe0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")),
+		jpegSegment(0xe1, jpegExifPrefix, exif.bytes()),
+		jpegSegment(0xe1, jpegXMPPrefix, []byte(xmp)),
+		jpegSegment(0xed, jpegPhotoshopPrefix, photoshopBlock(photoshopIPTCResource, "", iptc)),
+		jpegSegment(0xdb, make([]byte, 65)),
+		jpegStartOfFrame(640, 480),
+		jpegSegment(0xda, []byte{1, 1, 0, 0, 0x3f, 0}),
+		[]byte{0x12, 0x34, 0xff, 0xd9},
+	)
+}
+
+// A PNG chunk with its length and CRC
+func pngChunk(chunkType string, data ...[]byte) []byte {
+	chunk := joinBytes(data...)
+	var out bytes.Buffer
+	_ = binary.Write(&out, binary.BigEndian, uint32(len(chunk)))
+	out.WriteString(chunkType)
+	out.Write(chunk)
+	_ = binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(chunkType), chunk...)))
+	return out.Bytes()
+}
+
+func pngHeader(width uint32, height uint32) []byte {
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header[0:], width)
+	binary.BigEndian.PutUint32(header[4:], height)
+	copy(header[8:], []byte{8, 2, 0, 0, 0})
+	return pngChunk("IHDR", header)
+}
+
+// A raw profile, as ImageMagick writes in tEXt and zTXt chunks
+func pngRawProfile(profileType string, profile []byte) []byte {
+	encoded := hex.EncodeToString(profile)
+	var lines []string
+	for len(encoded) > 72 {
+		lines = append(lines, encoded[:72])
+		encoded = encoded[72:]
+	}
+	lines = append(lines, encoded)
+	return []byte(fmt.Sprintf("\n%s\n%8d\n%s\n", profileType, len(profile), strings.Join(lines, "\n")))
+}
+
+func deflate(data []byte) []byte {
+	var out bytes.Buffer
+	w := zlib.NewWriter(&out)
+	_, _ = w.Write(data)
+	_ = w.Close()
+	return out.Bytes()
+}
+
+// A PNG with Exif in an eXIf chunk, XMP in an iTXt chunk and IPTC in a compressed raw profile
+func testPNG() []byte {
+	exif := newTestTIFF(binary.LittleEndian)
+	iptc := joinBytes(iptcDataset(2, 25, "heron"), iptcDataset(2, 90, "London"))
+	return joinBytes(
+		pngSignature,
+		pngHeader(800, 600),
+		pngChunk("gAMA", []byte{0, 0, 0xb1, 0x8f}),
+		pngChunk("eXIf", exif.bytes()),
+		pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"), []byte(testXMP)),
+		pngChunk("zTXt", []byte("Raw profile type iptc\x00\x00"), deflate(pngRawProfile("iptc", iptc))),
+		pngChunk("IDAT", []byte{0x78, 0x9c, 0x63, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01}),
+		pngChunk("IEND"),
+	)
+}
+
+// Write a test file and return its name
+func writeTestFile(t *testing.T, dir string, name string, data []byte) string {
+	t.Helper()
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func createTestDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "rodeo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func assertTag(t *testing.T, info *ImageInfo, name string, want interface{}) {
+	t.Helper()
+	if got := info.X[name]; !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %#v, want %#v", name, got, want)
+	}
+}
+
+func TestNativeReaderJPEG(t *testing.T) {
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+
+	info, err := NativeReader{}.ReadMetadata(writeTestFile(t, dir, "heron.jpg", testJPEG()))
+	if err != nil {
+		t.Fatalf("ReadMetadata() error: %v", err)
+	}
+
+	if info.Width != 640 || info.Height != 480 {
+		t.Errorf("size = %dx%d, want 640x480", info.Width, info.Height)
+	}
+	if info.Title != "Heron" {
+		t.Errorf("Title = %q, want %q", info.Title, "Heron")
+	}
+	assertKeywords(t, "Keywords", info.Keywords, []string{"heron", "bird"})
+	assertKeywords(t, "HierarchicalSubject", info.HierarchicalSubject, []string{"Animals|Birds|Heron"})
+	if info.Date == nil || info.Date.Format("2006-01-02 15:04:05 -07:00") != "2020-05-06 07:08:09 +01:00" {
+		t.Errorf("Date = %v, want 2020-05-06 07:08:09 +01:00", info.Date)
+	}
+
+	assertTag(t, info, "FileType", "JPEG")
+	assertTag(t, info, "MIMEType", "image/jpeg")
+	assertTag(t, info, "FileName", "heron.jpg")
+	// Exif takes precedence over XMP
+	assertTag(t, info, "Make", "Canon")
+	assertTag(t, info, "Orientation", "Rotate 90 CW")
+	assertTag(t, info, "ISO", 200.0)
+	assertTag(t, info, "GPSPosition", `51 deg 30' 26.00" N, 0 deg 7' 39.60" W`)
+	assertTag(t, info, "City", "London")
+	assertTag(t, info, "Label", "Red")
+}
+
+func TestNativeReaderPNG(t *testing.T) {
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+
+	info, err := NativeReader{}.ReadMetadata(writeTestFile(t, dir, "heron.png", testPNG()))
+	if err != nil {
+		t.Fatalf("ReadMetadata() error: %v", err)
+	}
+
+	if info.Width != 800 || info.Height != 600 {
+		t.Errorf("size = %dx%d, want 800x600", info.Width, info.Height)
+	}
+	if info.Title != "Heron" {
+		t.Errorf("Title = %q, want %q", info.Title, "Heron")
+	}
+	assertKeywords(t, "Keywords", info.Keywords, []string{"heron"})
+	assertTag(t, info, "FileType", "PNG")
+	assertTag(t, info, "Make", "Canon")
+	assertTag(t, info, "City", "London")
+	assertTag(t, info, "Subject", []interface{}{"heron", "bird"})
+}
+
+func TestNativeReaderPNGText(t *testing.T) {
+	exif := newTestTIFF(binary.BigEndian).bytes()
+	xmp := []byte(testXMP)
+	iptc := iptcDataset(2, 25, "heron")
+
+	tests := []struct {
+		name  string
+		chunk []byte
+		tag   string
+		want  interface{}
+	}{
+		{"compressed iTXt XMP", pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x01\x00en\x00\x00"), deflate(xmp)),
+			"Title", "Heron"},
+		{"tEXt Exif", pngChunk("tEXt", []byte("Raw profile type exif\x00"), pngRawProfile("exif", exif)),
+			"Make", "Canon"},
+		{"tEXt APP1 with the Exif prefix", pngChunk("tEXt", []byte("Raw profile type APP1\x00"),
+			pngRawProfile("APP1", joinBytes(jpegExifPrefix, exif))), "Make", "Canon"},
+		{"tEXt XMP", pngChunk("tEXt", []byte("Raw profile type xmp\x00"), pngRawProfile("xmp", xmp)),
+			"Title", "Heron"},
+		{"tEXt IPTC", pngChunk("tEXt", []byte("Raw profile type iptc\x00"), pngRawProfile("iptc", iptc)),
+			"Keywords", "heron"},
+		{"tEXt IPTC in Photoshop resources", pngChunk("tEXt", []byte("Raw profile type iptc\x00"),
+			pngRawProfile("iptc", photoshopBlock(photoshopIPTCResource, "", iptc))), "Keywords", "heron"},
+		{"tEXt 8BIM", pngChunk("tEXt", []byte("Raw profile type 8bim\x00"),
+			pngRawProfile("8bim", photoshopBlock(photoshopIPTCResource, "", iptc))), "Keywords", "heron"},
+		{"tEXt that isn't a raw profile", pngChunk("tEXt", []byte("Title\x00Heron")), "Title", nil},
+		{"iTXt that isn't XMP", pngChunk("iTXt", []byte("Title\x00\x00\x00\x00\x00Heron")), "Title", nil},
+	}
+
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := joinBytes(pngSignature, pngHeader(1, 1), test.chunk, pngChunk("IEND"))
+			info, err := NativeReader{}.ReadMetadata(writeTestFile(t, dir, "test.png", data))
+			if err != nil {
+				t.Fatalf("ReadMetadata() error: %v", err)
+			}
+			assertTag(t, info, test.tag, test.want)
+		})
+	}
+}
+
+func TestNativeReaderTIFF(t *testing.T) {
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+
+	f := newTestTIFF(binary.LittleEndian)
+	f.ifd0 = append(f.ifd0, f.undefined(tiffXMP, []byte(testXMP)))
+
+	info, err := NativeReader{}.ReadMetadata(writeTestFile(t, dir, "heron.tif", f.bytes()))
+	if err != nil {
+		t.Fatalf("ReadMetadata() error: %v", err)
+	}
+	if info.Width != 4000 || info.Height != 3000 {
+		t.Errorf("size = %dx%d, want 4000x3000", info.Width, info.Height)
+	}
+	if info.Title != "Heron" {
+		t.Errorf("Title = %q, want %q", info.Title, "Heron")
+	}
+	assertTag(t, info, "FileType", "TIFF")
+	assertTag(t, info, "Make", "Canon")
+}
+
+func TestNativeReaderXMP(t *testing.T) {
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, prefix := range []string{"", "\ufeff", "\n  "} {
+		info, err := NativeReader{}.ReadMetadata(writeTestFile(t, dir, "heron.xmp", []byte(prefix+testXMP)))
+		if err != nil {
+			t.Fatalf("ReadMetadata(%q + XMP) error: %v", prefix, err)
+		}
+		if info.Title != "Heron" {
+			t.Errorf("Title = %q, want %q", info.Title, "Heron")
+		}
+		assertTag(t, info, "FileType", "XMP")
+		assertTag(t, info, "Make", "Nikon")
+	}
+}
+
+func TestNativeReaderInvalid(t *testing.T) {
+	jpeg := testJPEG()
+	png := testPNG()
+	exifStart := bytes.Index(jpeg, jpegExifPrefix)
+	pngExifStart := bytes.Index(png, []byte("eXIf"))
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "unsupported file type"},
+		{"GIF", []byte("GIF89a\x01\x00\x01\x00"), "unsupported file type"},
+
+		{"JPEG truncated in a segment", jpeg[:exifStart+20], "unexpected EOF"},
+		{"JPEG truncated between segments", jpeg[:len(jpegSignature)], "EOF"},
+		{"JPEG without a marker", joinBytes(jpegSignature, []byte{0x00, 0xe1}), "invalid JPEG data"},
+		{"JPEG segment length too short", joinBytes(jpegSignature, []byte{0xff, 0xe1, 0x00, 0x01}),
+			"invalid JPEG segment"},
+		{"JPEG with invalid Exif", joinBytes(jpegSignature, jpegSegment(0xe1, jpegExifPrefix, []byte("II*\x00"))),
+			errInvalidTIFF.Error()},
+		{"JPEG with invalid XMP", joinBytes(jpegSignature, jpegSegment(0xe1, jpegXMPPrefix, []byte("<x:xmpmeta>"))),
+			"invalid XMP data"},
+		{"JPEG with invalid IPTC", joinBytes(jpegSignature,
+			jpegSegment(0xed, jpegPhotoshopPrefix, photoshopBlock(photoshopIPTCResource, "", []byte("heron")))),
+			errInvalidIPTC.Error()},
+
+		{"PNG truncated in a chunk", png[:pngExifStart+20], "unexpected EOF"},
+		{"PNG truncated in a skipped chunk", png[:bytes.Index(png, []byte("gAMA"))+6], "EOF"},
+		{"PNG chunk too large", joinBytes(pngSignature, []byte("\x7f\x00\x00\x00eXIf")), "eXIf chunk is too large"},
+		{"PNG with invalid Exif", joinBytes(pngSignature, pngChunk("eXIf", []byte("MM\x00*\x00\x00\x00\x08"))),
+			errInvalidTIFF.Error()},
+		{"PNG iTXt without a text", joinBytes(pngSignature, pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00en"))),
+			"invalid PNG iTXt chunk"},
+		{"PNG iTXt that isn't compressed", joinBytes(pngSignature,
+			pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x01\x00\x00\x00"), []byte(testXMP))), "zlib"},
+		{"PNG zTXt that is empty", joinBytes(pngSignature, pngChunk("zTXt", []byte("Raw profile type exif\x00"))),
+			"invalid PNG zTXt chunk"},
+		{"PNG raw profile without a length", joinBytes(pngSignature,
+			pngChunk("tEXt", []byte("Raw profile type exif\x00\nexif\n"))), "invalid PNG raw profile"},
+		{"PNG raw profile that isn't hex", joinBytes(pngSignature,
+			pngChunk("tEXt", []byte("Raw profile type exif\x00\nexif\n 4\nxyz\n"))), "invalid PNG raw profile"},
+
+		{"TIFF truncated", newTestTIFF(binary.BigEndian).bytes()[:20], errInvalidTIFF.Error()},
+		{"XMP truncated", []byte(testXMP[:100]), "invalid XMP data"},
+	}
+
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := writeTestFile(t, dir, "test", test.data)
+			info, err := NativeReader{}.ReadMetadata(filename)
+			if err == nil {
+				t.Fatalf("ReadMetadata() = %+v, want an error", info)
+			}
+			if !strings.HasPrefix(err.Error(), filename+": ") || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("ReadMetadata() error = %q, want %q with the filename", err, test.want)
+			}
+		})
+	}
+}
+
+func TestNativeReaderMissingFile(t *testing.T) {
+	if _, err := (NativeReader{}).ReadMetadata(filepath.Join("testdata", "missing.jpg")); !os.IsNotExist(err) {
+		t.Errorf("ReadMetadata() error = %v, want a file not found error", err)
+	}
+}
+
+func TestNativeReaderEndOfPNG(t *testing.T) {
+	// The metadata is read from a PNG without an IEND chunk, as other tools do
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+
+	png := testPNG()
+	png = png[:bytes.Index(png, []byte("IEND"))-4]
+	info, err := NativeReader{}.ReadMetadata(writeTestFile(t, dir, "heron.png", png))
+	if err != nil {
+		t.Fatalf("ReadMetadata() error: %v", err)
+	}
+	if info.Title != "Heron" {
+		t.Errorf("Title = %q, want %q", info.Title, "Heron")
+	}
+}
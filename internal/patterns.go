@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The prefix of a keyword pattern that is a regular expression
+const regexPatternPrefix = "re:"
+
+// A KeywordPattern matches keywords. It is one of:
+//
+//   - a regular expression, prefixed with `re:`, e.g. `re:^client:.*`
+//   - a glob pattern, containing `*`, `?` or `[...]`, e.g. `_internal*`
+//   - a keyword, which only matches itself
+//
+// Keywords are matched as for a KeywordSet: they are Unicode normalised and, if the Keywords config has
+// CaseInsensitive set, case is ignored.
+type KeywordPattern struct {
+	source  string
+	options Keywords
+	key     string         // the keyword's key, if the pattern is a keyword
+	re      *regexp.Regexp // nil if the pattern is a keyword
+}
+
+// Parse a keyword pattern
+func ParseKeywordPattern(source string, options Keywords) (KeywordPattern, error) {
+	pattern := KeywordPattern{source: source, options: options, key: options.keywordKey(source)}
+
+	flags := ""
+	if options.CaseInsensitive {
+		flags = "(?i)"
+	}
+
+	if strings.HasPrefix(source, regexPatternPrefix) {
+		re, err := regexp.Compile(flags + norm.NFC.String(source[len(regexPatternPrefix):]))
+		if err != nil {
+			return pattern, fmt.Errorf("invalid regular expression in '%s': %v", source, err)
+		}
+		pattern.re = re
+		return pattern, nil
+	}
+
+	if strings.ContainsAny(source, "*?[") {
+		re, err := globToRegexp(flags, norm.NFC.String(source))
+		if err != nil {
+			return pattern, fmt.Errorf("invalid pattern '%s': %v", source, err)
+		}
+		pattern.re = re
+	}
+	return pattern, nil
+}
+
+// Parse a list of keyword patterns
+func ParseKeywordPatterns(sources []string, options Keywords) ([]KeywordPattern, error) {
+	var patterns []KeywordPattern
+	for _, source := range sources {
+		pattern, err := ParseKeywordPattern(source, options)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func (p KeywordPattern) String() string {
+	return p.source
+}
+
+// Does the keyword match the pattern?
+func (p KeywordPattern) Matches(keyword string) bool {
+	if p.re != nil {
+		return p.re.MatchString(norm.NFC.String(strings.TrimSpace(keyword)))
+	}
+	return p.options.keywordKey(keyword) == p.key
+}
+
+// Get the replacement for a keyword that matches the pattern. If the pattern is a regular expression, then the part
+// of the keyword that it matches is replaced and the replacement can refer to submatches, e.g. `$1`. Otherwise the
+// whole keyword is replaced.
+func (p KeywordPattern) Replace(keyword string, replacement string) string {
+	if p.re != nil && strings.HasPrefix(p.source, regexPatternPrefix) {
+		return p.re.ReplaceAllString(norm.NFC.String(strings.TrimSpace(keyword)), replacement)
+	}
+	return replacement
+}
+
+// Get the keywords that match the pattern
+func (p KeywordPattern) Match(keywords []string) []string {
+	var matched []string
+	for _, keyword := range keywords {
+		if p.Matches(keyword) {
+			matched = append(matched, keyword)
+		}
+	}
+	return matched
+}
+
+// Match each pattern against the keywords. Returns the keywords that matched any of the patterns, in the order of
+// `keywords`, and the number of patterns that matched at least one keyword.
+func MatchKeywordPatterns(patterns []KeywordPattern, keywords []string) ([]string, int) {
+	patternsMatched := 0
+	isMatched := make([]bool, len(keywords))
+	for _, pattern := range patterns {
+		found := false
+		for i, keyword := range keywords {
+			if pattern.Matches(keyword) {
+				isMatched[i] = true
+				found = true
+			}
+		}
+		if found {
+			patternsMatched++
+		}
+	}
+
+	var matched []string
+	for i, keyword := range keywords {
+		if isMatched[i] {
+			matched = append(matched, keyword)
+		}
+	}
+	return matched, patternsMatched
+}
+
+// Convert a glob pattern to an anchored regular expression. `*` matches any characters, `?` matches one character and
+// `[...]` matches one of a set of characters.
+func globToRegexp(flags string, glob string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString(flags + "^")
+	runes := []rune(glob)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; r {
+		case '*':
+			re.WriteString(".*")
+		case '?':
+			re.WriteString(".")
+		case '[':
+			end := i + 1
+			for end < len(runes) && runes[end] != ']' {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("missing ']'")
+			}
+			class := string(runes[i+1 : end])
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i = end
+		default:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func parsePattern(t *testing.T, source string, options Keywords) KeywordPattern {
+	t.Helper()
+	pattern, err := ParseKeywordPattern(source, options)
+	if err != nil {
+		t.Fatalf("ParseKeywordPattern(%q) error: %v", source, err)
+	}
+	return pattern
+}
+
+func TestKeywordPatternMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		options Keywords
+		keyword string
+		want    bool
+	}{
+		{"keyword", "art", caseSensitive, "art", true},
+		{"keyword is not a substring", "art", caseSensitive, "party", false},
+		{"keyword ignores surrounding space", "art", caseSensitive, " art ", true},
+		{"keyword case sensitive", "Art", caseSensitive, "art", false},
+		{"keyword case insensitive", "Art", caseInsensitive, "art", true},
+		{"keyword normal forms", cafeNFD, caseSensitive, cafeNFC, true},
+
+		{"* prefix", "client:*", caseSensitive, "client:acme", true},
+		{"* empty", "client:*", caseSensitive, "client:", true},
+		{"* is anchored at the start", "client:*", caseSensitive, "myclient:acme", false},
+		{"* is anchored at the end", "*:acme", caseSensitive, "client:acme:old", false},
+		{"* in the middle", "a*z", caseSensitive, "abcz", true},
+		{"? one character", "?at", caseSensitive, "cat", true},
+		{"? not zero characters", "?at", caseSensitive, "at", false},
+		{"? not two characters", "?at", caseSensitive, "chat", false},
+		{"? one non-ASCII character", "caf?", caseSensitive, cafeNFD, true},
+		{"[...] in set", "[cb]at", caseSensitive, "bat", true},
+		{"[...] not in set", "[cb]at", caseSensitive, "rat", false},
+		{"[a-z] range", "IMG_[0-9]*", caseSensitive, "IMG_1234", true},
+		{"[!...] negated", "[!cb]at", caseSensitive, "rat", true},
+		{"[!...] negated in set", "[!cb]at", caseSensitive, "bat", false},
+		{"glob case sensitive", "CLIENT:*", caseSensitive, "client:acme", false},
+		{"glob case insensitive", "CLIENT:*", caseInsensitive, "client:acme", true},
+		{"glob normal forms", cafeNFD + "*", caseSensitive, cafeNFC + "s", true},
+		{"glob ignores surrounding space", "client:*", caseSensitive, " client:acme ", true},
+
+		// Characters that have a meaning in regular expressions but not in globs match themselves
+		{". is literal", "a.b*", caseSensitive, "a.bc", true},
+		{". is not any character", "a.b*", caseSensitive, "axbc", false},
+		{"+ is literal", "a+b*", caseSensitive, "a+b", true},
+		{"+ does not repeat", "a+b*", caseSensitive, "aab", false},
+		{"( ) are literal", "(draft)*", caseSensitive, "(draft) v2", true},
+		{"| is literal", "a|b*", caseSensitive, "a|bc", true},
+		{"| is not alternation", "a|b*", caseSensitive, "b", false},
+		{"^ is literal", "^a*", caseSensitive, "^abc", true},
+		{"^ is not an anchor", "^a*", caseSensitive, "abc", false},
+		{"$ is literal", "$*", caseSensitive, "$100", true},
+		{"{ } are literal", "a{2}*", caseSensitive, "a{2}", true},
+		{"{ } do not repeat", "a{2}*", caseSensitive, "aa", false},
+		{"\\ is literal", `a\b*`, caseSensitive, `a\b`, true},
+		{"\\ in a set", `[\]x*`, caseSensitive, `\x`, true},
+
+		{"re: unanchored", "re:client", caseSensitive, "myclient", true},
+		{"re: anchored", "re:^client:.*", caseSensitive, "client:acme", true},
+		{"re: anchored no match", "re:^client:.*", caseSensitive, "myclient:acme", false},
+		{"re: alternation", "re:^(draft|wip)$", caseSensitive, "wip", true},
+		{"re: case sensitive", "re:^JOB", caseSensitive, "job-1", false},
+		{"re: case insensitive", "re:^JOB", caseInsensitive, "job-1", true},
+		{"re: ignores surrounding space", "re:^art$", caseSensitive, " art ", true},
+		{"re: empty matches everything", "re:", caseSensitive, "anything", true},
+		{"re prefix needs the colon", "re*", caseSensitive, "red", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pattern := parsePattern(t, test.pattern, test.options)
+			if got := pattern.Matches(test.keyword); got != test.want {
+				t.Errorf("%q.Matches(%q) = %v, want %v", test.pattern, test.keyword, got, test.want)
+			}
+			if pattern.String() != test.pattern {
+				t.Errorf("String() = %q, want %q", pattern.String(), test.pattern)
+			}
+		})
+	}
+}
+
+func TestParseKeywordPatternErrors(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"re:[", "invalid regular expression in 're:['"},
+		{"re:(client", "invalid regular expression in 're:(client'"},
+		{"re:a**", "invalid regular expression"},
+		{"[abc", "invalid pattern '[abc': missing ']'"},
+		{"client[", "invalid pattern 'client[': missing ']'"},
+		{"[]", "invalid pattern '[]'"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			_, err := ParseKeywordPattern(test.pattern, caseSensitive)
+			if err == nil {
+				t.Fatalf("ParseKeywordPattern() succeeded, want an error")
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("ParseKeywordPattern() error = %q, want it to contain %q", err, test.want)
+			}
+		})
+	}
+
+	if _, err := ParseKeywordPatterns([]string{"holiday", "re:[", "beach"}, caseSensitive); err == nil {
+		t.Errorf("ParseKeywordPatterns() succeeded with an invalid pattern, want an error")
+	}
+}
+
+func TestKeywordPatternReplace(t *testing.T) {
+	tests := []struct {
+		name        string
+		pattern     string
+		keyword     string
+		replacement string
+		want        string
+	}{
+		{"keyword", "nyc", "nyc", "New York", "New York"},
+		{"glob replaces the whole keyword", "client:*", "client:acme", "client", "client"},
+		{"re: submatch", "re:^client:(.*)$", "client:acme", "customer:$1", "customer:acme"},
+		{"re: replaces the matched part", "re:nyc", "nyc-2020", "NYC", "NYC-2020"},
+		{"re: replaces every match", "re:_", "a_b_c", " ", "a b c"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pattern := parsePattern(t, test.pattern, caseSensitive)
+			if got := pattern.Replace(test.keyword, test.replacement); got != test.want {
+				t.Errorf("Replace(%q, %q) = %q, want %q", test.keyword, test.replacement, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMatchKeywordPatterns(t *testing.T) {
+	tests := []struct {
+		name            string
+		patterns        []string
+		keywords        []string
+		want            []string
+		patternsMatched int
+		firstMatches    []string // the keywords that the first pattern matches on its own
+	}{
+		{"no patterns", nil, []string{"a"}, nil, 0, nil},
+		{"no keywords", []string{"a"}, nil, nil, 0, nil},
+		{"in the order of the keywords", []string{"b", "a*"}, []string{"apple", "b", "c", "avocado"},
+			[]string{"apple", "b", "avocado"}, 2, []string{"b"}},
+		{"pattern that matches nothing", []string{"a*", "zzz"}, []string{"apple"}, []string{"apple"}, 1,
+			[]string{"apple"}},
+		{"keyword matched by two patterns", []string{"a*", "re:e$"}, []string{"apple"}, []string{"apple"}, 2,
+			[]string{"apple"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patterns, err := ParseKeywordPatterns(test.patterns, caseSensitive)
+			if err != nil {
+				t.Fatalf("ParseKeywordPatterns() error: %v", err)
+			}
+			matched, count := MatchKeywordPatterns(patterns, test.keywords)
+			assertKeywords(t, "matched", matched, test.want)
+			if count != test.patternsMatched {
+				t.Errorf("patterns matched = %d, want %d", count, test.patternsMatched)
+			}
+			if len(patterns) > 0 {
+				assertKeywords(t, "Match()", patterns[0].Match(test.keywords), test.firstMatches)
+			}
+		})
+	}
+}
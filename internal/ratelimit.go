@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// A RateLimiter spaces out calls so that no more than a given number are made each second
+type RateLimiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// Create a RateLimiter that allows `perSecond` calls each second. If perSecond is not positive, then there is no limit.
+func NewRateLimiter(perSecond float64) *RateLimiter {
+	limiter := &RateLimiter{}
+	if perSecond > 0 {
+		limiter.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return limiter
+}
+
+// Wait until the next call is allowed
+func (l *RateLimiter) Wait() {
+	l.mutex.Lock()
+	now := time.Now()
+	wait := l.next.Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+	l.next = now.Add(wait + l.interval)
+	l.mutex.Unlock()
+
+	time.Sleep(wait)
+}
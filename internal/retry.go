@@ -0,0 +1,403 @@
+// Retrying of Flickr API calls that fail with a transient error
+package internal
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/masci/flickr.v2"
+	"gopkg.in/masci/flickr.v2/photos"
+	"gopkg.in/masci/flickr.v2/photosets"
+)
+
+// The names used for Flickr's upload and replace APIs, which are not REST methods, alongside the API method names
+const (
+	flickrUploadMethod  = "upload"
+	flickrReplaceMethod = "replace"
+)
+
+// Flickr error codes that are worth retrying, by the method that returns them. Any other error code that Flickr
+// returns is permanent. Apart from the codes that every method shares, the codes are specific to the method: e.g. 3
+// is "General upload failure" for uploads but "Too many sets" for flickr.photosets.create.
+var transientFlickrErrorCodes = map[string]map[int]bool{
+	"": {
+		105: true, // Service currently unavailable
+		106: true, // Write operation failed
+	},
+	flickrUploadMethod: {
+		3: true, // General upload failure
+	},
+	flickrReplaceMethod: {
+		3: true, // General upload failure
+	},
+}
+
+// Methods that do something new each time they are called, so they are only retried if Flickr certainly did not act
+// on the failed call
+var nonIdempotentFlickrMethods = map[string]bool{
+	flickrUploadMethod:        true,
+	"flickr.photosets.create": true,
+}
+
+// The error code that the Flickr client uses when Flickr's response is not an API response, such as an HTML error
+// page or the plain text of an OAuth error like "oauth_problem=signature_invalid"
+const unparsedResponseErrorCode = -1
+
+// Flickr error code returned by flickr.photosets.addPhoto if the photo is already in the photoset
+const photoAlreadyInSetErrorCode = 3
+
+// Flickr error code returned by flickr.photos.getInfo if the photo does not exist or belongs to someone else
+const photoNotFoundErrorCode = 1
+
+// A FlickrError is a call to the Flickr API that failed
+type FlickrError struct {
+	Operation string // What we were trying to do, e.g. "upload photo"
+	Code      int    // Flickr's error code or 0 if there was no response from Flickr
+	Message   string
+	Status    int  // The HTTP status of Flickr's response or 0 if there was no response
+	Transient bool // If true, then the call failed for a reason that may go away if it is tried again
+	// If true, then the call may have succeeded even though no successful response was received, e.g. the
+	// connection dropped after the photo was sent, so it is not retried
+	MayHaveSucceeded bool
+	Attempts         int // How many times the call was tried
+	Err              error
+}
+
+func (e *FlickrError) Error() string {
+	message := e.Message
+	if e.Code != 0 {
+		message = fmt.Sprintf("%s (code %d)", message, e.Code)
+	}
+	if e.Attempts > 1 {
+		message = fmt.Sprintf("%s after %d attempts", message, e.Attempts)
+	}
+	return fmt.Sprintf("%s: %s", e.Operation, message)
+}
+
+func (e *FlickrError) Unwrap() error {
+	return e.Err
+}
+
+// Classify the result of a call to a Flickr API method. `status` is the HTTP status of Flickr's response, or 0 if
+// there was none. Returns nil if the call succeeded.
+//
+// If Flickr returned an API error, then its error code for this method determines whether the error is transient. If
+// Flickr's response was not an API response, then it is transient if the HTTP status is a server error or "too many
+// requests"; OAuth errors, such as an invalid signature or a rejected token, are permanent. Otherwise no response was
+// received and the error is transient unless it is caused by a local file problem.
+//
+// A transient error from a method that isn't idempotent, such as an upload, is only retried if Flickr certainly did
+// not act on the call: it returned an API error, refused the call or could not be connected to. Otherwise the call may
+// have succeeded, e.g. the connection timed out after the photo was sent, and trying it again could duplicate it.
+func ClassifyFlickrError(operation string, method string, response flickr.FlickrResponse, err error,
+	status int) *FlickrError {
+	if err == nil && (response == nil || !response.HasErrors()) {
+		return nil
+	}
+
+	flickrErr := &FlickrError{Operation: operation, Status: status, Err: err}
+
+	// The response is not filled in if the request failed before Flickr replied
+	if response != nil && response.HasErrors() && (response.ErrorCode() != 0 || response.ErrorMsg() != "") {
+		flickrErr.Code = response.ErrorCode()
+		flickrErr.Message = response.ErrorMsg()
+		if flickrErr.Code != unparsedResponseErrorCode {
+			flickrErr.Transient = transientFlickrErrorCodes[""][flickrErr.Code] ||
+				transientFlickrErrorCodes[method][flickrErr.Code]
+			return flickrErr
+		}
+
+		flickrErr.Code = 0
+		flickrErr.Transient = status >= 500 || status == http.StatusTooManyRequests
+		flickrErr.Message = "unexpected response from Flickr"
+		if status != 0 {
+			flickrErr.Message = fmt.Sprintf("%s (HTTP %d)", flickrErr.Message, status)
+		}
+		// An OAuth error is a short line of text, such as "oauth_problem=token_rejected", which says what is wrong
+		if text := strings.TrimSpace(response.ErrorMsg()); text != "" && len(text) < 200 &&
+			!strings.ContainsAny(text, "<\n") {
+			flickrErr.Message = fmt.Sprintf("%s: %s", flickrErr.Message, text)
+		}
+		if flickrErr.Transient && nonIdempotentFlickrMethods[method] && status != http.StatusServiceUnavailable &&
+			status != http.StatusTooManyRequests {
+			flickrErr.MayHaveSucceeded = true
+		}
+		return flickrErr
+	}
+
+	if err == nil {
+		err = errors.New("no response from Flickr")
+	}
+	flickrErr.Message = err.Error()
+	var pathErr *os.PathError
+	flickrErr.Transient = !errors.As(err, &pathErr)
+	if flickrErr.Transient && nonIdempotentFlickrMethods[method] && !isConnectionError(err) {
+		flickrErr.MayHaveSucceeded = true
+	}
+	return flickrErr
+}
+
+// Whether the error is a failure to connect to Flickr, so the request was never sent
+func isConnectionError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// An httpStatusRecorder is an http.RoundTripper that records the HTTP status of the last response, which the Flickr
+// client does not make available
+type httpStatusRecorder struct {
+	transport http.RoundTripper
+	mutex     sync.Mutex
+	status    int
+}
+
+func (r *httpStatusRecorder) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := r.transport.RoundTrip(request)
+	if response != nil {
+		r.mutex.Lock()
+		r.status = response.StatusCode
+		r.mutex.Unlock()
+	}
+	return response, err
+}
+
+// The status of the last response and then forget it, so that it isn't used for a request that gets no response
+func (r *httpStatusRecorder) take() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	status := r.status
+	r.status = 0
+	return status
+}
+
+// A RetryingClient makes calls to the Flickr API, retrying those that fail with a transient error using jittered
+// exponential backoff
+type RetryingClient struct {
+	Client     *flickr.FlickrClient
+	retry      Retry
+	out        io.Writer
+	limiter    *RateLimiter
+	httpClient *http.Client
+	status     *httpStatusRecorder
+}
+
+// Create a RetryingClient that writes a message to `out` whenever it retries a call
+func NewRetryingClient(client *flickr.FlickrClient, retry Retry, out io.Writer) *RetryingClient {
+	// Flickr's upload API doesn't work over HTTP/2, so HTTP/1.1 is used, as the Flickr client does for uploads
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) http.RoundTripper)
+	status := &httpStatusRecorder{transport: transport}
+	httpClient := &http.Client{Transport: status}
+	client.HTTPClient = httpClient
+	return &RetryingClient{Client: client, retry: retry, out: out, httpClient: httpClient, status: status}
+}
+
+// Limit the rate at which calls are made, including retries
+func (c *RetryingClient) SetRateLimiter(limiter *RateLimiter) {
+	c.limiter = limiter
+}
+
+// Upload a photo and return its ID
+func (c *RetryingClient) UploadFile(filename string, params *flickr.UploadParams) (string, error) {
+	var photoId string
+	err := c.call("upload photo", flickrUploadMethod, func() (flickr.FlickrResponse, error) {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		response, err := flickr.UploadReaderWithClient(c.Client, file, file.Name(), params, c.httpClient)
+		if response == nil {
+			return nil, err
+		}
+		photoId = response.ID
+		return response, err
+	})
+	return photoId, err
+}
+
+// Set the date posted of a photo
+func (c *RetryingClient) SetDatePosted(photoId string, datePosted string) error {
+	return c.call("set date posted", "flickr.photos.setDates", func() (flickr.FlickrResponse, error) {
+		response, err := photos.SetDates(c.Client, photoId, datePosted, "")
+		if response == nil {
+			return nil, err
+		}
+		return response, err
+	})
+}
+
+// Create a photoset with this photo as its primary photo and return the photoset's ID
+func (c *RetryingClient) CreatePhotoset(title string, primaryPhotoId string) (string, error) {
+	var photosetId string
+	err := c.call("create album "+title, "flickr.photosets.create", func() (flickr.FlickrResponse, error) {
+		response, err := photosets.Create(c.Client, title, "", primaryPhotoId)
+		if response == nil {
+			return nil, err
+		}
+		photosetId = response.Set.Id
+		return response, err
+	})
+	return photosetId, err
+}
+
+// Add a photo to a photoset. If the photo is already in the photoset, for instance because an earlier attempt
+// succeeded but its response was lost, then this is not an error.
+func (c *RetryingClient) AddPhotoToPhotoset(photosetId string, photoId string) error {
+	return c.call("add photo to album "+photosetId, "flickr.photosets.addPhoto", func() (flickr.FlickrResponse, error) {
+		response, err := photosets.AddPhoto(c.Client, photosetId, photoId)
+		if response == nil {
+			return nil, err
+		}
+		if response.HasErrors() && response.ErrorCode() == photoAlreadyInSetErrorCode {
+			return nil, nil
+		}
+		return response, err
+	})
+}
+
+// Replace the image of an existing photo
+func (c *RetryingClient) ReplaceFile(photoId string, filename string) error {
+	return c.call("replace photo", flickrReplaceMethod, func() (flickr.FlickrResponse, error) {
+		response, err := ReplaceFile(c.Client, photoId, filename)
+		if response == nil {
+			return nil, err
+		}
+		return response, err
+	})
+}
+
+// Set the title and description of a photo
+func (c *RetryingClient) SetPhotoMeta(photoId string, title string, description string) error {
+	return c.call("set title and description", "flickr.photos.setMeta", func() (flickr.FlickrResponse, error) {
+		response, err := SetPhotoMeta(c.Client, photoId, title, description)
+		if response == nil {
+			return nil, err
+		}
+		return response, err
+	})
+}
+
+// Replace the tags of a photo
+func (c *RetryingClient) SetPhotoTags(photoId string, tags []string) error {
+	return c.call("set tags", "flickr.photos.setTags", func() (flickr.FlickrResponse, error) {
+		response, err := SetPhotoTags(c.Client, photoId, tags)
+		if response == nil {
+			return nil, err
+		}
+		return response, err
+	})
+}
+
+// Set the license of a photo
+func (c *RetryingClient) SetLicense(photoId string, licenseId int) error {
+	return c.call("set license", "flickr.photos.licenses.setLicense", func() (flickr.FlickrResponse, error) {
+		response, err := SetLicense(c.Client, photoId, licenseId)
+		if response == nil {
+			return nil, err
+		}
+		return response, err
+	})
+}
+
+// Get a page of the photos in the user's photostream
+func (c *RetryingClient) GetMyPhotos(page int, perPage int) (*PhotoListResponse, error) {
+	var list *PhotoListResponse
+	err := c.call(fmt.Sprintf("get page %d of photos", page), "flickr.people.getPhotos", func() (flickr.FlickrResponse, error) {
+		response, err := GetMyPhotos(c.Client, page, perPage)
+		if response == nil {
+			return nil, err
+		}
+		list = response
+		return response, err
+	})
+	return list, err
+}
+
+// Check whether a photo exists on Flickr
+func (c *RetryingClient) PhotoExists(photoId string) (bool, error) {
+	exists := true
+	err := c.call("get photo "+photoId, "flickr.photos.getInfo", func() (flickr.FlickrResponse, error) {
+		response, err := GetPhotoInfo(c.Client, photoId)
+		if response == nil {
+			return nil, err
+		}
+		if response.HasErrors() && response.ErrorCode() == photoNotFoundErrorCode {
+			exists = false
+			return nil, nil
+		}
+		return response, err
+	})
+	return exists, err
+}
+
+// Call `fn`, which calls the Flickr API `method`, until it succeeds, fails with a permanent error or we run out of
+// attempts
+func (c *RetryingClient) call(operation string, method string, fn func() (flickr.FlickrResponse, error)) error {
+	maxAttempts := c.retry.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		if c.limiter != nil {
+			c.limiter.Wait()
+		}
+		c.status.take()
+		response, err := fn()
+		flickrErr := ClassifyFlickrError(operation, method, response, err, c.status.take())
+		if flickrErr == nil {
+			return nil
+		}
+		flickrErr.Attempts = attempt
+
+		if !flickrErr.Transient || flickrErr.MayHaveSucceeded || attempt >= maxAttempts {
+			return flickrErr
+		}
+
+		delay := c.retry.backoff(attempt)
+		if c.out != nil {
+			fmt.Fprintf(c.out, "Retrying %s in %v (attempt %d of %d): %s\n", operation, delay.Round(time.Millisecond),
+				attempt+1, maxAttempts, flickrErr.Message)
+		}
+		time.Sleep(delay)
+	}
+}
+
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+var jitterMutex sync.Mutex
+
+// The delay before the next attempt. This doubles for each attempt up to MaxDelay and then a random amount of up to
+// half of it is removed so that concurrent uploads that failed together don't all retry at the same moment.
+func (r Retry) backoff(attempt int) time.Duration {
+	delay := r.InitialDelay
+	for i := 1; i < attempt && delay < r.MaxDelay; i++ {
+		delay *= 2
+	}
+	if r.MaxDelay > 0 && delay > r.MaxDelay {
+		delay = r.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	jitterMutex.Lock()
+	jitter := time.Duration(jitterRand.Int63n(int64(delay/2) + 1))
+	jitterMutex.Unlock()
+
+	return delay - jitter
+}
@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"gopkg.in/masci/flickr.v2"
+)
+
+// A response from Flickr with an API error
+func flickrFailure(code int, message string) *flickr.BasicResponse {
+	response := &flickr.BasicResponse{}
+	response.SetErrorStatus(true)
+	response.SetErrorCode(code)
+	response.SetErrorMsg(message)
+	return response
+}
+
+func flickrSuccess() *flickr.BasicResponse {
+	response := &flickr.BasicResponse{}
+	response.SetErrorStatus(false)
+	return response
+}
+
+var (
+	errTimeout    = &net.OpError{Op: "read", Net: "tcp", Err: errors.New("i/o timeout")}
+	errRefused    = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	errNoSuchHost = &net.DNSError{Err: "no such host", Name: "up.flickr.com"}
+	errNoFile     = &os.PathError{Op: "open", Path: "heron.jpg", Err: os.ErrNotExist}
+)
+
+func TestClassifyFlickrError(t *testing.T) {
+	const (
+		upload    = flickrUploadMethod
+		replace   = flickrReplaceMethod
+		createSet = "flickr.photosets.create"
+		setMeta   = "flickr.photos.setMeta"
+	)
+
+	tests := []struct {
+		name             string
+		method           string
+		response         flickr.FlickrResponse
+		err              error
+		status           int
+		transient        bool
+		mayHaveSucceeded bool
+		code             int
+		message          string
+	}{
+		// Flickr API errors: never MayHaveSucceeded, as Flickr replied that it failed
+		{"service unavailable", setMeta, flickrFailure(105, "Service currently unavailable"), nil, 200, true, false,
+			105, "Service currently unavailable"},
+		{"service unavailable upload", upload, flickrFailure(105, "Service currently unavailable"), nil, 200, true,
+			false, 105, "Service currently unavailable"},
+		{"write failed", createSet, flickrFailure(106, "Write operation failed"), nil, 200, true, false, 106,
+			"Write operation failed"},
+		{"general upload failure", upload, flickrFailure(3, "General upload failure"), nil, 200, true, false, 3,
+			"General upload failure"},
+		{"general replace failure", replace, flickrFailure(3, "General upload failure"), nil, 200, true, false, 3,
+			"General upload failure"},
+		{"too many sets", createSet, flickrFailure(3, "Too many sets"), nil, 200, false, false, 3, "Too many sets"},
+		{"code 3 of another method", setMeta, flickrFailure(3, "Not a code"), nil, 200, false, false, 3,
+			"Not a code"},
+		{"photo not found", setMeta, flickrFailure(1, "Photo not found"), nil, 200, false, false, 1,
+			"Photo not found"},
+		{"invalid API key", upload, flickrFailure(100, "Invalid API Key"), nil, 200, false, false, 100,
+			"Invalid API Key"},
+		{"API error with a Go error", upload, flickrFailure(105, "Service currently unavailable"),
+			errors.New("flickr error"), 200, true, false, 105, "Service currently unavailable"},
+
+		// Responses that aren't API responses: transient for a server error or too many requests
+		{"HTTP 500", setMeta, flickrFailure(unparsedResponseErrorCode, "<html>"), nil, 500, true, false, 0,
+			"unexpected response from Flickr (HTTP 500)"},
+		{"HTTP 500 upload", upload, flickrFailure(unparsedResponseErrorCode, "<html>"), nil, 500, true, true, 0,
+			"unexpected response from Flickr (HTTP 500)"},
+		{"HTTP 502 create set", createSet, flickrFailure(unparsedResponseErrorCode, "Bad gateway\n"), nil, 502,
+			true, true, 0, "unexpected response from Flickr (HTTP 502): Bad gateway"},
+		{"HTTP 504 replace", replace, flickrFailure(unparsedResponseErrorCode, ""), nil, 504, true, false, 0,
+			"unexpected response from Flickr (HTTP 504)"},
+		{"HTTP 503 upload", upload, flickrFailure(unparsedResponseErrorCode, "<html>"), nil, 503, true, false, 0,
+			"unexpected response from Flickr (HTTP 503)"},
+		{"HTTP 429 upload", upload, flickrFailure(unparsedResponseErrorCode, "Too many requests"), nil, 429, true,
+			false, 0, "unexpected response from Flickr (HTTP 429): Too many requests"},
+		{"HTTP 429", setMeta, flickrFailure(unparsedResponseErrorCode, ""), nil, 429, true, false, 0,
+			"unexpected response from Flickr (HTTP 429)"},
+		{"OAuth error", upload, flickrFailure(unparsedResponseErrorCode, "oauth_problem=token_rejected"), nil, 401,
+			false, false, 0, "unexpected response from Flickr (HTTP 401): oauth_problem=token_rejected"},
+		{"HTTP 400", setMeta, flickrFailure(unparsedResponseErrorCode, "<html>\n<body>"), nil, 400, false, false, 0,
+			"unexpected response from Flickr (HTTP 400)"},
+		{"HTTP 200 that isn't an API response", upload, flickrFailure(unparsedResponseErrorCode, "<html>"), nil,
+			200, false, false, 0, "unexpected response from Flickr (HTTP 200)"},
+		{"no HTTP status", upload, flickrFailure(unparsedResponseErrorCode, "oauth_problem=signature_invalid"),
+			nil, 0, false, false, 0, "unexpected response from Flickr: oauth_problem=signature_invalid"},
+
+		// No response: transient unless it's a local file problem, and a non-idempotent call may have succeeded
+		// unless Flickr couldn't be connected to
+		{"timeout", setMeta, nil, errTimeout, 0, true, false, 0, errTimeout.Error()},
+		{"timeout upload", upload, nil, errTimeout, 0, true, true, 0, errTimeout.Error()},
+		{"timeout replace", replace, nil, errTimeout, 0, true, false, 0, errTimeout.Error()},
+		{"timeout create set", createSet, nil, errTimeout, 0, true, true, 0, errTimeout.Error()},
+		{"unexpected EOF upload", upload, nil, io.ErrUnexpectedEOF, 0, true, true, 0, "unexpected EOF"},
+		{"connection refused upload", upload, nil, errRefused, 0, true, false, 0, errRefused.Error()},
+		{"wrapped connection refused upload", upload, nil, fmt.Errorf("post: %w", errRefused), 0, true, false, 0,
+			"post: " + errRefused.Error()},
+		{"DNS error upload", upload, nil, errNoSuchHost, 0, true, false, 0, errNoSuchHost.Error()},
+		{"DNS error create set", createSet, nil, errNoSuchHost, 0, true, false, 0, errNoSuchHost.Error()},
+		{"missing file upload", upload, nil, errNoFile, 0, false, false, 0, errNoFile.Error()},
+		{"missing file replace", replace, nil, errNoFile, 0, false, false, 0, errNoFile.Error()},
+		{"failed response without an error", upload, &flickr.BasicResponse{Status: "fail"}, nil, 0, true, true, 0,
+			"no response from Flickr"},
+		{"timeout with an empty response", setMeta, &flickr.BasicResponse{}, errTimeout, 0, true, false, 0,
+			errTimeout.Error()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ClassifyFlickrError("test", test.method, test.response, test.err, test.status)
+			if got == nil {
+				t.Fatalf("ClassifyFlickrError() = nil, want an error")
+			}
+			if got.Transient != test.transient {
+				t.Errorf("Transient = %v, want %v", got.Transient, test.transient)
+			}
+			if got.MayHaveSucceeded != test.mayHaveSucceeded {
+				t.Errorf("MayHaveSucceeded = %v, want %v", got.MayHaveSucceeded, test.mayHaveSucceeded)
+			}
+			if got.Code != test.code {
+				t.Errorf("Code = %d, want %d", got.Code, test.code)
+			}
+			if got.Message != test.message {
+				t.Errorf("Message = %q, want %q", got.Message, test.message)
+			}
+			if got.Status != test.status {
+				t.Errorf("Status = %d, want %d", got.Status, test.status)
+			}
+			if got.Err != test.err {
+				t.Errorf("Err = %v, want %v", got.Err, test.err)
+			}
+		})
+	}
+}
+
+func TestClassifyFlickrErrorSuccess(t *testing.T) {
+	for _, response := range []flickr.FlickrResponse{nil, flickrSuccess()} {
+		for _, method := range []string{flickrUploadMethod, "flickr.photos.setMeta"} {
+			if got := ClassifyFlickrError("test", method, response, nil, 200); got != nil {
+				t.Errorf("ClassifyFlickrError(%s, %v) = %v, want nil", method, response, got)
+			}
+		}
+	}
+}
+
+func TestFlickrErrorError(t *testing.T) {
+	tests := []struct {
+		err  *FlickrError
+		want string
+	}{
+		{&FlickrError{Operation: "upload photo", Message: "i/o timeout"}, "upload photo: i/o timeout"},
+		{&FlickrError{Operation: "upload photo", Message: "General upload failure", Code: 3},
+			"upload photo: General upload failure (code 3)"},
+		{&FlickrError{Operation: "set tags", Message: "Service currently unavailable", Code: 105, Attempts: 3},
+			"set tags: Service currently unavailable (code 105) after 3 attempts"},
+		{&FlickrError{Operation: "set tags", Message: "i/o timeout", Attempts: 1}, "set tags: i/o timeout"},
+	}
+
+	for _, test := range tests {
+		if got := test.err.Error(); got != test.want {
+			t.Errorf("Error() = %q, want %q", got, test.want)
+		}
+	}
+
+	err := fmt.Errorf("uploading: %w", &FlickrError{Operation: "upload photo", Err: errTimeout})
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Errorf("errors.As() can't find the cause of a FlickrError")
+	}
+}
+
+func TestRetryingClientCall(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		results  []error // the result of each attempt; nil is success
+		attempts int
+		wantErr  bool
+	}{
+		{"success", "flickr.photos.setMeta", []error{nil}, 1, false},
+		{"transient then success", "flickr.photos.setMeta", []error{errTimeout, errTimeout, nil}, 3, false},
+		{"transient every time", "flickr.photos.setMeta", []error{errTimeout, errTimeout, errTimeout}, 3, true},
+		{"permanent", "flickr.photos.setMeta", []error{errNoFile}, 1, true},
+		{"upload that may have succeeded", flickrUploadMethod, []error{errTimeout}, 1, true},
+		{"upload that was refused", flickrUploadMethod, []error{errRefused, nil}, 2, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &RetryingClient{retry: Retry{MaxAttempts: 3}, status: &httpStatusRecorder{}}
+			attempts := 0
+			err := client.call("test", test.method, func() (flickr.FlickrResponse, error) {
+				attempts++
+				if attempts > len(test.results) {
+					t.Fatalf("attempt %d was not expected", attempts)
+				}
+				return nil, test.results[attempts-1]
+			})
+			if attempts != test.attempts {
+				t.Errorf("attempts = %d, want %d", attempts, test.attempts)
+			}
+			if (err != nil) != test.wantErr {
+				t.Fatalf("call() error = %v, want an error: %v", err, test.wantErr)
+			}
+			if flickrErr, ok := err.(*FlickrError); test.wantErr && (!ok || flickrErr.Attempts != test.attempts) {
+				t.Errorf("call() error = %#v, want a FlickrError after %d attempts", err, test.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	retry := Retry{MaxAttempts: 10, InitialDelay: time.Second, MaxDelay: 5 * time.Second}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{9, 5 * time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			// Up to half of the delay is removed at random
+			if got := retry.backoff(test.attempt); got < test.max/2 || got > test.max {
+				t.Errorf("backoff(%d) = %v, want between %v and %v", test.attempt, got, test.max/2, test.max)
+			}
+		}
+	}
+
+	if got := (Retry{}).backoff(3); got != 0 {
+		t.Errorf("backoff() without a delay = %v, want 0", got)
+	}
+}
@@ -0,0 +1,289 @@
+package rules
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	. "github.com/akrabat/rodeo/internal"
+)
+
+// Options for evaluating the rules
+type Options struct {
+	Keywords Keywords // how keywords are compared
+	Upload   Upload   // how the privacy of the rules that apply is combined and the defaults for the other settings
+}
+
+// A Plan is what the rules say should happen to an image when it is uploaded
+type Plan struct {
+	Tags                 []string // the Flickr tags
+	TagsChanged          bool     // whether the tags have been added to, renamed or flattened, or have hierarchical keywords
+	KeywordsToRemove     []string // deleted from both the Flickr tags and the file
+	FileKeywordsToRemove []string
+	FileKeywordsToAdd    []string
+	Title                string
+	Privacy              Permissions
+	SafetyLevel          string // e.g. "safe", see SafetyLevels
+	ContentType          string // e.g. "photo", see ContentTypes
+	Hidden               bool
+	License              *int // Flickr license ID, if set
+	Albums               []Album
+	Applied              []AppliedRule
+	Trace                []RuleTrace // how each rule that was evaluated was evaluated
+	StoppedBy            string      // the rule with `stop` that ended the evaluation
+}
+
+// An AppliedRule is a rule that applied to the image and the image's keywords that its conditions matched
+type AppliedRule struct {
+	Name     string
+	Keywords []string
+}
+
+// A RuleTrace records the conditions of a rule that were checked and the actions that it took
+type RuleTrace struct {
+	Name       string
+	Conditions []ConditionTrace
+	Applied    bool
+	Actions    []string
+}
+
+// A ConditionTrace records whether a condition of a rule passed and the image's keywords that it matched
+type ConditionTrace struct {
+	Name     string // as in the config, e.g. "includes_any"
+	Passed   bool
+	Keywords []string
+}
+
+func (t *RuleTrace) addAction(format string, a ...interface{}) {
+	t.Actions = append(t.Actions, fmt.Sprintf(format, a...))
+}
+
+// Apply the rules to an image, in order, and get the plan for uploading it. The image is not changed.
+func Evaluate(rules []Rule, info *ImageInfo, options Options) Plan {
+	var plan Plan
+	plan.Privacy.SetDefaults()
+	plan.Title = imageTitle(info)
+	plan.SafetyLevel = options.Upload.SafetyLevel
+	plan.ContentType = options.Upload.ContentType
+	plan.Hidden = options.Upload.Hidden
+	plan.License = options.Upload.License
+	privacySet := false
+
+	// Rules match the keywords and every level of the hierarchical keywords. The tags start as the keywords and the
+	// hierarchical keywords, which are converted to tags at the end according to `hierarchical_tags`.
+	keywords := NewKeywordSet(info.MatchKeywords(), options.Keywords).Keywords()
+	tags := NewKeywordSet(info.Keywords, options.Keywords)
+	tags.Add(info.HierarchicalSubject...)
+	hierarchical := NewKeywordSet(info.HierarchicalSubject, options.Keywords).Difference(info.Keywords)
+	keywordsToRemove := NewKeywordSet(nil, options.Keywords)
+	fileKeywordsToRemove := NewKeywordSet(nil, options.Keywords)
+	fileKeywordsToAdd := NewKeywordSet(nil, options.Keywords)
+
+	for _, rule := range rules {
+		trace := RuleTrace{Name: rule.Name}
+
+		// Every condition is checked, so that the trace shows all of the reasons why a rule does not apply
+		check := func(name string, passed bool, matched []string) {
+			trace.Conditions = append(trace.Conditions, ConditionTrace{Name: name, Passed: passed, Keywords: matched})
+		}
+
+		// If the list of keywords for this image has all of `excludesAll`, then the rule is ignored
+		if len(rule.excludesAll) > 0 {
+			matched, patternsMatched := MatchKeywordPatterns(rule.excludesAll, keywords)
+			check("excludes_all", patternsMatched != len(rule.excludesAll), matched)
+		}
+
+		// If the list of keywords for this image has any from `excludesAny`, then the rule is ignored
+		if len(rule.excludesAny) > 0 {
+			matched, patternsMatched := MatchKeywordPatterns(rule.excludesAny, keywords)
+			check("excludes_any", patternsMatched == 0, matched)
+		}
+
+		// Each of `includesAll`, `includesAny` and `when` that is set must be met for the rule to apply
+		applicable := NewKeywordSet(nil, options.Keywords)
+		processRules := false
+		if len(rule.includesAll) > 0 {
+			//  info.Keywords must contain all keywords in `includesAll`
+			matched, patternsMatched := MatchKeywordPatterns(rule.includesAll, keywords)
+			check("includes_all", patternsMatched == len(rule.includesAll), matched)
+			applicable.Add(matched...)
+			processRules = true
+		}
+
+		if len(rule.includesAny) > 0 {
+			//  info.Keywords must contain at least one keyword in `includesAny`
+			matched, patternsMatched := MatchKeywordPatterns(rule.includesAny, keywords)
+			check("includes_any", patternsMatched > 0, matched)
+			applicable.Add(matched...)
+			processRules = true
+		}
+
+		if rule.when != nil {
+			matches, whenKeywords := rule.when.Evaluate(info)
+			check("when", matches, whenKeywords)
+			applicable.Add(whenKeywords...)
+			processRules = true
+		}
+
+		for _, condition := range trace.Conditions {
+			if !condition.Passed {
+				processRules = false
+			}
+		}
+
+		if !processRules {
+			plan.Trace = append(plan.Trace, trace)
+			continue
+		}
+
+		trace.Applied = true
+		plan.Applied = append(plan.Applied, AppliedRule{Name: rule.Name, Keywords: applicable.Keywords()})
+		if rule.Action.Delete {
+			deleted := hierarchicalDeletions(applicable.Keywords(), tags, options.Keywords)
+			keywordsToRemove.Add(deleted...)
+			tags.Remove(deleted...)
+			fileKeywordsToRemove.Add(deleted...)
+			trace.addAction("delete: %s", strings.Join(deleted, ", "))
+		}
+
+		// Changes to the tags
+		replace := func(keyword string, replacements ...string) {
+			tags.Replace(keyword, replacements...)
+			plan.TagsChanged = true
+			if rule.Action.WriteToFile {
+				fileKeywordsToRemove.Add(keyword)
+				fileKeywordsToAdd.Add(replacements...)
+			}
+		}
+		for _, r := range rule.renames {
+			for _, keyword := range tags.Keywords() {
+				if r.from.Matches(keyword) {
+					renamed := r.from.Replace(keyword, r.to)
+					replace(keyword, renamed)
+					trace.addAction("rename: %s to %s", keyword, renamed)
+				}
+			}
+		}
+		if rule.Action.Flatten != "" {
+			for _, keyword := range tags.Keywords() {
+				if strings.Contains(keyword, HierarchySeparator) {
+					flattened := HierarchicalTags(keyword, rule.Action.Flatten)
+					replace(keyword, flattened...)
+					trace.addAction("flatten: %s to %s", keyword, strings.Join(flattened, ", "))
+				}
+			}
+		}
+		if len(rule.Action.Add) > 0 {
+			replace("", rule.Action.Add...)
+			trace.addAction("add: %s", strings.Join(rule.Action.Add, ", "))
+		}
+		if len(rule.Action.MachineTags) > 0 {
+			replace("", rule.Action.MachineTags...)
+			trace.addAction("machine tags: %s", strings.Join(rule.Action.MachineTags, ", "))
+		}
+
+		if rule.Action.Privacy != nil {
+			privacy := *rule.Action.Privacy
+			switch {
+			case !privacySet || options.Upload.PrivacyMerge == PrivacyMergeLast:
+				plan.Privacy = privacy
+			case options.Upload.PrivacyMerge == PrivacyMergeMostRestrictive:
+				plan.Privacy.Family = plan.Privacy.Family && privacy.Family
+				plan.Privacy.Friends = plan.Privacy.Friends && privacy.Friends
+				plan.Privacy.Public = plan.Privacy.Public && privacy.Public
+			}
+			privacySet = true
+			trace.addAction("privacy: Family: %v, Friends: %v, Public: %v", privacy.Family, privacy.Friends,
+				privacy.Public)
+		}
+
+		// The last rule to set each of these wins
+		if rule.Action.SafetyLevel != "" {
+			plan.SafetyLevel = rule.Action.SafetyLevel
+			trace.addAction("safety level: %s", plan.SafetyLevel)
+		}
+		if rule.Action.ContentType != "" {
+			plan.ContentType = rule.Action.ContentType
+			trace.addAction("content type: %s", plan.ContentType)
+		}
+		if rule.Action.Hidden != nil {
+			plan.Hidden = *rule.Action.Hidden
+			trace.addAction("hidden: %v", plan.Hidden)
+		}
+		if rule.Action.License != nil {
+			license := *rule.Action.License
+			plan.License = &license
+			trace.addAction("license: %d", license)
+		}
+
+		for _, album := range rule.Action.Albums {
+			plan.Albums = AppendAlbum(plan.Albums, album)
+			trace.addAction("album: %s", album)
+		}
+
+		plan.Trace = append(plan.Trace, trace)
+		if rule.Stop {
+			plan.StoppedBy = rule.Name
+			break
+		}
+	}
+
+	// The hierarchical keywords that are still tags become tags as set by `hierarchical_tags`
+	for _, keyword := range hierarchical {
+		if tags.Contains(keyword) {
+			converted := HierarchicalTags(keyword, options.Keywords.HierarchicalTags)
+			tags.Replace(keyword, converted...)
+			if len(converted) > 0 {
+				plan.TagsChanged = true
+			}
+		}
+	}
+
+	plan.Tags = tags.Keywords()
+	plan.KeywordsToRemove = keywordsToRemove.Keywords()
+	plan.FileKeywordsToRemove = fileKeywordsToRemove.Difference(fileKeywordsToAdd.Keywords())
+	plan.FileKeywordsToAdd = fileKeywordsToAdd.Keywords()
+	return plan
+}
+
+// The keywords that deleting `keywords` deletes. Deleting a level of a hierarchical keyword, e.g. "Animals" or
+// "Animals|Birds", also deletes the keywords below it, e.g. "Animals|Birds|Heron", and the flat keyword that is the
+// last level of each, e.g. "Heron", unless a hierarchical keyword that is kept also ends with it.
+func hierarchicalDeletions(keywords []string, tags *KeywordSet, options Keywords) []string {
+	deleted := NewKeywordSet(keywords, options)
+	for _, tag := range tags.Keywords() {
+		for _, keyword := range keywords {
+			if IsHierarchicalDescendant(tag, keyword, options) {
+				deleted.Add(tag)
+			}
+		}
+	}
+
+	kept := NewKeywordSet(nil, options)
+	for _, tag := range tags.Keywords() {
+		if strings.Contains(tag, HierarchySeparator) && !deleted.Contains(tag) {
+			kept.Add(HierarchicalTags(tag, HierarchicalTagsLeaf)...)
+		}
+	}
+	for _, keyword := range deleted.Keywords() {
+		if !strings.Contains(keyword, HierarchySeparator) {
+			continue
+		}
+		for _, leaf := range HierarchicalTags(keyword, HierarchicalTagsLeaf) {
+			if tags.Contains(leaf) && !kept.Contains(leaf) {
+				deleted.Add(leaf)
+			}
+		}
+	}
+	return deleted.Keywords()
+}
+
+// The title of the image or, if it doesn't have one, its filename without the extension
+func imageTitle(info *ImageInfo) string {
+	title := strings.Trim(info.Title, " ")
+	if title != "" {
+		return title
+	}
+	filename, _ := info.X["FileName"].(string)
+	return strings.TrimSuffix(filename, path.Ext(filename))
+}
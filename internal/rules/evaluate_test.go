@@ -0,0 +1,525 @@
+package rules
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/akrabat/rodeo/internal"
+)
+
+// The image that the rules are tested against unless a test says otherwise
+func testImage() *ImageInfo {
+	return &ImageInfo{
+		Keywords: []string{"holiday", "beach", "family"},
+		Model:    "X100V",
+		X:        map[string]interface{}{"FileName": "IMG_0001.jpg"},
+	}
+}
+
+func testOptions() Options {
+	return Options{Upload: Upload{PrivacyMerge: PrivacyMergeLast, SafetyLevel: "safe", ContentType: "photo"}}
+}
+
+func compileRules(t *testing.T, configRules []Rules, options Keywords) []Rule {
+	t.Helper()
+	compiled, err := New(configRules, options)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	return compiled
+}
+
+// Compare string lists, treating nil and empty lists as the same
+func assertStrings(t *testing.T, name string, got []string, want []string) {
+	t.Helper()
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %q, want %q", name, got, want)
+	}
+}
+
+// Each condition of a rule can be absent, met or not met by testImage()
+type conditionState int
+
+const (
+	absent conditionState = iota
+	met
+	notMet
+)
+
+func (s conditionState) String() string {
+	return [...]string{"absent", "met", "not met"}[s]
+}
+
+// The conditions, in the order in which they are checked, with a value of each that testImage() meets and one that
+// it doesn't
+var testConditions = []struct {
+	name string
+	set  func(rule *Rules, state conditionState)
+}{
+	{"excludes_all", func(rule *Rules, state conditionState) {
+		rule.Condition.ExcludesAll = map[conditionState][]string{
+			met: {"family", "missing"}, notMet: {"family", "holiday"}}[state]
+	}},
+	{"excludes_any", func(rule *Rules, state conditionState) {
+		rule.Condition.ExcludesAny = map[conditionState][]string{
+			met: {"missing"}, notMet: {"missing", "family"}}[state]
+	}},
+	{"includes_all", func(rule *Rules, state conditionState) {
+		rule.Condition.IncludesAll = map[conditionState][]string{
+			met: {"holiday", "beach"}, notMet: {"holiday", "missing"}}[state]
+	}},
+	{"includes_any", func(rule *Rules, state conditionState) {
+		rule.Condition.IncludesAny = map[conditionState][]string{
+			met: {"missing", "beach"}, notMet: {"missing", "absent"}}[state]
+	}},
+	{"when", func(rule *Rules, state conditionState) {
+		rule.When = map[conditionState]string{met: "camera = 'X100V'", notMet: "camera = 'GFX100'"}[state]
+	}},
+}
+
+// Every combination of the conditions being absent, met or not met. A rule applies if it has at least one of
+// includes_all, includes_any and when, and every condition that it has is met.
+func TestEvaluateConditionCombinations(t *testing.T) {
+	combinations := 1
+	for range testConditions {
+		combinations *= 3
+	}
+
+	for combination := 0; combination < combinations; combination++ {
+		states := make([]conditionState, len(testConditions))
+		n := combination
+		for i := range testConditions {
+			states[i] = conditionState(n % 3)
+			n /= 3
+		}
+
+		rule := Rules{Name: "rule", Action: Action{Add: []string{"added"}}}
+		var description []string
+		hasInclusion := false
+		allMet := true
+		var wantConditions []ConditionTrace
+		for i, condition := range testConditions {
+			condition.set(&rule, states[i])
+			description = append(description, fmt.Sprintf("%s %s", condition.name, states[i]))
+			if states[i] == absent {
+				continue
+			}
+			if condition.name == "includes_all" || condition.name == "includes_any" || condition.name == "when" {
+				hasInclusion = true
+			}
+			if states[i] == notMet {
+				allMet = false
+			}
+			wantConditions = append(wantConditions, ConditionTrace{Name: condition.name, Passed: states[i] == met})
+		}
+		wantApplied := hasInclusion && allMet
+
+		t.Run(strings.Join(description, ", "), func(t *testing.T) {
+			plan := Evaluate(compileRules(t, []Rules{rule}, Keywords{}), testImage(), testOptions())
+
+			if got := len(plan.Applied) == 1; got != wantApplied {
+				t.Errorf("applied = %v, want %v", got, wantApplied)
+			}
+			wantTags := []string{"holiday", "beach", "family"}
+			if wantApplied {
+				wantTags = append(wantTags, "added")
+			}
+			assertStrings(t, "Tags", plan.Tags, wantTags)
+
+			if len(plan.Trace) != 1 {
+				t.Fatalf("len(Trace) = %d, want 1", len(plan.Trace))
+			}
+			trace := plan.Trace[0]
+			if trace.Applied != wantApplied {
+				t.Errorf("Trace.Applied = %v, want %v", trace.Applied, wantApplied)
+			}
+			if len(trace.Conditions) != len(wantConditions) {
+				t.Fatalf("Trace.Conditions = %+v, want %+v", trace.Conditions, wantConditions)
+			}
+			for i, want := range wantConditions {
+				got := trace.Conditions[i]
+				if got.Name != want.Name || got.Passed != want.Passed {
+					t.Errorf("Trace.Conditions[%d] = %s passed %v, want %s passed %v", i, got.Name, got.Passed,
+						want.Name, want.Passed)
+				}
+			}
+		})
+	}
+}
+
+// The keywords that an applied rule records are those that its inclusion conditions matched
+func TestEvaluateAppliedKeywords(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rules
+		want []string
+	}{
+		{"includes_all", Rules{Condition: Condition{IncludesAll: []string{"holiday", "beach"}}},
+			[]string{"holiday", "beach"}},
+		{"includes_any", Rules{Condition: Condition{IncludesAny: []string{"missing", "family"}}}, []string{"family"}},
+		{"when", Rules{When: "holiday and not private"}, []string{"holiday"}},
+		{"glob", Rules{Condition: Condition{IncludesAny: []string{"b*"}}}, []string{"beach"}},
+		{"combined", Rules{Condition: Condition{IncludesAll: []string{"holiday"}, IncludesAny: []string{"beach"}},
+			When: "family"}, []string{"holiday", "beach", "family"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.rule.Name = test.name
+			plan := Evaluate(compileRules(t, []Rules{test.rule}, Keywords{}), testImage(), testOptions())
+			if len(plan.Applied) != 1 {
+				t.Fatalf("Applied = %+v, want the rule to apply", plan.Applied)
+			}
+			assertStrings(t, "Applied[0].Keywords", plan.Applied[0].Keywords, test.want)
+		})
+	}
+}
+
+func TestEvaluatePrivacy(t *testing.T) {
+	familyOnly := &Permissions{Family: true}
+	friendsAndFamily := &Permissions{Family: true, Friends: true}
+	public := &Permissions{Family: true, Friends: true, Public: true}
+	private := &Permissions{}
+
+	privacyRule := func(name string, keyword string, privacy *Permissions) Rules {
+		return Rules{Name: name, Condition: Condition{IncludesAny: []string{keyword}}, Action: Action{Privacy: privacy}}
+	}
+
+	tests := []struct {
+		name  string
+		merge string
+		rules []Rules
+		want  Permissions
+	}{
+		{"default when no rule sets it", PrivacyMergeLast, []Rules{
+			{Name: "no privacy", Condition: Condition{IncludesAny: []string{"holiday"}}},
+		}, Permissions{Family: true, Friends: true, Public: true}},
+		{"rule that doesn't apply", PrivacyMergeLast, []Rules{
+			privacyRule("private", "missing", private),
+		}, Permissions{Family: true, Friends: true, Public: true}},
+
+		{"last: one rule", PrivacyMergeLast, []Rules{
+			privacyRule("family", "holiday", familyOnly),
+		}, *familyOnly},
+		{"last: last rule wins", PrivacyMergeLast, []Rules{
+			privacyRule("family", "holiday", familyOnly),
+			privacyRule("public", "beach", public),
+		}, *public},
+		{"last: last rule that applies wins", PrivacyMergeLast, []Rules{
+			privacyRule("family", "holiday", familyOnly),
+			privacyRule("private", "missing", private),
+		}, *familyOnly},
+
+		{"first: one rule", PrivacyMergeFirst, []Rules{
+			privacyRule("family", "holiday", familyOnly),
+		}, *familyOnly},
+		{"first: first rule wins", PrivacyMergeFirst, []Rules{
+			privacyRule("family", "holiday", familyOnly),
+			privacyRule("public", "beach", public),
+		}, *familyOnly},
+		{"first: first rule that applies wins", PrivacyMergeFirst, []Rules{
+			privacyRule("private", "missing", private),
+			privacyRule("public", "beach", public),
+		}, *public},
+
+		{"most restrictive: one rule", PrivacyMergeMostRestrictive, []Rules{
+			privacyRule("friends", "holiday", friendsAndFamily),
+		}, *friendsAndFamily},
+		{"most restrictive: each permission only if every rule gives it", PrivacyMergeMostRestrictive, []Rules{
+			privacyRule("public", "holiday", public),
+			privacyRule("friends", "beach", friendsAndFamily),
+			privacyRule("family", "family", familyOnly),
+		}, *familyOnly},
+		{"most restrictive: order doesn't matter", PrivacyMergeMostRestrictive, []Rules{
+			privacyRule("family", "family", familyOnly),
+			privacyRule("public", "holiday", public),
+		}, *familyOnly},
+		{"most restrictive: permissions that no rule gives together", PrivacyMergeMostRestrictive, []Rules{
+			privacyRule("family", "holiday", &Permissions{Family: true, Public: true}),
+			privacyRule("friends", "beach", &Permissions{Friends: true, Public: true}),
+		}, Permissions{Public: true}},
+		{"most restrictive: rule that doesn't apply", PrivacyMergeMostRestrictive, []Rules{
+			privacyRule("public", "holiday", public),
+			privacyRule("private", "missing", private),
+		}, *public},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := testOptions()
+			options.Upload.PrivacyMerge = test.merge
+			plan := Evaluate(compileRules(t, test.rules, Keywords{}), testImage(), options)
+			if plan.Privacy != test.want {
+				t.Errorf("Privacy = %+v, want %+v", plan.Privacy, test.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateTitle(t *testing.T) {
+	tests := []struct {
+		name     string
+		title    string
+		filename string
+		want     string
+	}{
+		{"image title", "Sunset over the bay", "IMG_0001.jpg", "Sunset over the bay"},
+		{"trimmed", "  Sunset  ", "IMG_0001.jpg", "Sunset"},
+		{"filename without extension", "", "IMG_0001.jpg", "IMG_0001"},
+		{"blank title", "   ", "IMG_0001.jpg", "IMG_0001"},
+		{"filename with dots", "", "2020.05.06 beach.tiff", "2020.05.06 beach"},
+		{"no title or filename", "", "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info := testImage()
+			info.Title = test.title
+			info.X["FileName"] = test.filename
+			plan := Evaluate(nil, info, testOptions())
+			if plan.Title != test.want {
+				t.Errorf("Title = %q, want %q", plan.Title, test.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateAlbums(t *testing.T) {
+	beach := Album{Id: "1", Name: "Beach"}
+	holidays := Album{Id: "2", Name: "Holidays"}
+	newAlbum := Album{Name: "New album"}
+
+	albumRule := func(name string, keyword string, albums ...Album) Rules {
+		return Rules{Name: name, Condition: Condition{IncludesAny: []string{keyword}}, Action: Action{Albums: albums}}
+	}
+
+	tests := []struct {
+		name  string
+		rules []Rules
+		want  []Album
+	}{
+		{"none", []Rules{albumRule("no albums", "holiday")}, nil},
+		{"one rule", []Rules{albumRule("beach", "beach", beach)}, []Album{beach}},
+		{"in the order of the rules", []Rules{
+			albumRule("holiday", "holiday", holidays),
+			albumRule("beach", "beach", beach),
+		}, []Album{holidays, beach}},
+		{"higher priority first", []Rules{
+			albumRule("holiday", "holiday", holidays),
+			{Name: "beach", Priority: 10, Condition: Condition{IncludesAny: []string{"beach"}},
+				Action: Action{Albums: []Album{beach}}},
+		}, []Album{beach, holidays}},
+		{"duplicates by ID", []Rules{
+			albumRule("beach", "beach", beach),
+			albumRule("beach again", "holiday", Album{Id: "1", Name: "Renamed"}, holidays),
+		}, []Album{beach, holidays}},
+		{"duplicates of new albums by name", []Rules{
+			albumRule("new", "beach", newAlbum),
+			albumRule("new again", "holiday", newAlbum),
+		}, []Album{newAlbum}},
+		{"rule that doesn't apply", []Rules{
+			albumRule("missing", "missing", holidays),
+			albumRule("beach", "beach", beach),
+		}, []Album{beach}},
+		{"stop", []Rules{
+			{Name: "beach", Stop: true, Condition: Condition{IncludesAny: []string{"beach"}},
+				Action: Action{Albums: []Album{beach}}},
+			albumRule("holiday", "holiday", holidays),
+		}, []Album{beach}},
+		{"stop on a rule that doesn't apply", []Rules{
+			{Name: "missing", Stop: true, Condition: Condition{IncludesAny: []string{"missing"}},
+				Action: Action{Albums: []Album{beach}}},
+			albumRule("holiday", "holiday", holidays),
+		}, []Album{holidays}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := Evaluate(compileRules(t, test.rules, Keywords{}), testImage(), testOptions())
+			if len(plan.Albums) != 0 || len(test.want) != 0 {
+				if !reflect.DeepEqual(plan.Albums, test.want) {
+					t.Errorf("Albums = %+v, want %+v", plan.Albums, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluateStop(t *testing.T) {
+	rules := []Rules{
+		{Name: "first", Condition: Condition{IncludesAny: []string{"holiday"}}, Action: Action{Add: []string{"one"}}},
+		{Name: "stop", Stop: true, Condition: Condition{IncludesAny: []string{"beach"}},
+			Action: Action{Add: []string{"two"}}},
+		{Name: "after", Condition: Condition{IncludesAny: []string{"family"}}, Action: Action{Add: []string{"three"}}},
+	}
+
+	plan := Evaluate(compileRules(t, rules, Keywords{}), testImage(), testOptions())
+	if plan.StoppedBy != "stop" {
+		t.Errorf("StoppedBy = %q, want %q", plan.StoppedBy, "stop")
+	}
+	assertStrings(t, "Tags", plan.Tags, []string{"holiday", "beach", "family", "one", "two"})
+	if len(plan.Trace) != 2 {
+		t.Errorf("len(Trace) = %d, want 2", len(plan.Trace))
+	}
+}
+
+// The last rule that sets each of the safety level, content type, hidden and license wins over the defaults
+func TestEvaluateUploadSettings(t *testing.T) {
+	hidden := true
+	license := 4
+	otherLicense := 1
+	rules := []Rules{
+		{Name: "first", Condition: Condition{IncludesAny: []string{"holiday"}},
+			Action: Action{SafetyLevel: "moderate", ContentType: "screenshot", License: &otherLicense}},
+		{Name: "second", Condition: Condition{IncludesAny: []string{"beach"}},
+			Action: Action{SafetyLevel: "restricted", Hidden: &hidden, License: &license}},
+		{Name: "not applied", Condition: Condition{IncludesAny: []string{"missing"}},
+			Action: Action{SafetyLevel: "safe", ContentType: "other"}},
+	}
+
+	plan := Evaluate(compileRules(t, rules, Keywords{}), testImage(), testOptions())
+	if plan.SafetyLevel != "restricted" {
+		t.Errorf("SafetyLevel = %q, want restricted", plan.SafetyLevel)
+	}
+	if plan.ContentType != "screenshot" {
+		t.Errorf("ContentType = %q, want screenshot", plan.ContentType)
+	}
+	if !plan.Hidden {
+		t.Errorf("Hidden = false, want true")
+	}
+	if plan.License == nil || *plan.License != 4 {
+		t.Errorf("License = %v, want 4", plan.License)
+	}
+
+	plan = Evaluate(nil, testImage(), testOptions())
+	if plan.SafetyLevel != "safe" || plan.ContentType != "photo" || plan.Hidden || plan.License != nil {
+		t.Errorf("defaults = %q, %q, %v, %v, want safe, photo, false, nil", plan.SafetyLevel, plan.ContentType,
+			plan.Hidden, plan.License)
+	}
+}
+
+func TestEvaluateDelete(t *testing.T) {
+	deleteRule := func(keywords ...string) Rules {
+		return Rules{Name: "delete", Condition: Condition{IncludesAny: keywords}, Action: Action{Delete: true}}
+	}
+
+	tests := []struct {
+		name         string
+		keywords     []string
+		hierarchical []string
+		options      Keywords
+		rules        []Rules
+		wantTags     []string
+		wantRemove   []string
+	}{
+		{"keyword", []string{"holiday", "private", "beach"}, nil, Keywords{},
+			[]Rules{deleteRule("private")}, []string{"holiday", "beach"}, []string{"private"}},
+		{"several keywords", []string{"holiday", "private", "secret", "beach"}, nil, Keywords{},
+			[]Rules{deleteRule("private", "secret")}, []string{"holiday", "beach"}, []string{"private", "secret"}},
+		{"glob", []string{"holiday", "client:acme", "client:bigco"}, nil, Keywords{},
+			[]Rules{deleteRule("client:*")}, []string{"holiday"}, []string{"client:acme", "client:bigco"}},
+		{"regular expression", []string{"holiday", "job-1234"}, nil, Keywords{},
+			[]Rules{deleteRule("re:^job-[0-9]+$")}, []string{"holiday"}, []string{"job-1234"}},
+		{"not substrings", []string{"party", "art"}, nil, Keywords{},
+			[]Rules{deleteRule("art")}, []string{"party"}, []string{"art"}},
+		{"case sensitive", []string{"Private", "holiday"}, nil, Keywords{},
+			nil, []string{"Private", "holiday"}, nil},
+		{"case insensitive", []string{"Private", "holiday"}, nil, Keywords{CaseInsensitive: true},
+			[]Rules{deleteRule("private")}, []string{"holiday"}, []string{"Private"}},
+		{"by several rules", []string{"holiday", "private", "secret"}, nil, Keywords{},
+			[]Rules{deleteRule("private"), deleteRule("secret")}, []string{"holiday"}, []string{"private", "secret"}},
+		{"hierarchical keyword and its descendants", []string{"Heron", "Cat"},
+			[]string{"Animals|Birds|Heron", "Animals|Cat"}, Keywords{HierarchicalTags: HierarchicalTagsPath},
+			[]Rules{deleteRule("Animals|Birds")}, []string{"Cat", "Animals|Cat"},
+			[]string{"Animals|Birds", "Animals|Birds|Heron", "Heron"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info := testImage()
+			info.Keywords = test.keywords
+			info.HierarchicalSubject = test.hierarchical
+			options := testOptions()
+			options.Keywords = test.options
+
+			plan := Evaluate(compileRules(t, test.rules, test.options), info, options)
+			assertStrings(t, "Tags", plan.Tags, test.wantTags)
+			assertStrings(t, "KeywordsToRemove", plan.KeywordsToRemove, test.wantRemove)
+			assertStrings(t, "FileKeywordsToRemove", plan.FileKeywordsToRemove, test.wantRemove)
+			assertStrings(t, "FileKeywordsToAdd", plan.FileKeywordsToAdd, nil)
+		})
+	}
+}
+
+// Deleted keywords can be matched by later rules, as the rules match the image's keywords
+func TestEvaluateDeleteThenMatch(t *testing.T) {
+	rules := []Rules{
+		{Name: "delete", Condition: Condition{IncludesAny: []string{"private"}}, Action: Action{Delete: true}},
+		{Name: "private album", Condition: Condition{IncludesAny: []string{"private"}},
+			Action: Action{Albums: []Album{{Id: "1", Name: "Private"}}}},
+	}
+	info := testImage()
+	info.Keywords = []string{"holiday", "private"}
+
+	plan := Evaluate(compileRules(t, rules, Keywords{}), info, testOptions())
+	assertStrings(t, "Tags", plan.Tags, []string{"holiday"})
+	if len(plan.Albums) != 1 {
+		t.Errorf("Albums = %+v, want the Private album", plan.Albums)
+	}
+}
+
+func TestEvaluateWriteToFile(t *testing.T) {
+	rules := []Rules{
+		{Name: "rename", Condition: Condition{IncludesAny: []string{"nyc"}}, Action: Action{
+			Rename: []Rename{{From: "nyc", To: "New York"}}, Add: []string{"USA"}, WriteToFile: true}},
+		{Name: "tags only", Condition: Condition{IncludesAny: []string{"holiday"}}, Action: Action{
+			Add: []string{"travel"}}},
+	}
+	info := testImage()
+	info.Keywords = []string{"holiday", "nyc"}
+
+	plan := Evaluate(compileRules(t, rules, Keywords{}), info, testOptions())
+	assertStrings(t, "Tags", plan.Tags, []string{"holiday", "New York", "USA", "travel"})
+	if !plan.TagsChanged {
+		t.Errorf("TagsChanged = false, want true")
+	}
+	assertStrings(t, "FileKeywordsToAdd", plan.FileKeywordsToAdd, []string{"New York", "USA"})
+	assertStrings(t, "FileKeywordsToRemove", plan.FileKeywordsToRemove, []string{"nyc"})
+	assertStrings(t, "KeywordsToRemove", plan.KeywordsToRemove, nil)
+}
+
+func TestEvaluateHierarchicalTags(t *testing.T) {
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{HierarchicalTagsFlat, []string{"sunset"}},
+		{HierarchicalTagsLeaf, []string{"sunset", "Heron", "UK"}},
+		{HierarchicalTagsAll, []string{"sunset", "Animals", "Birds", "Heron", "Places", "UK"}},
+		{HierarchicalTagsPath, []string{"sunset", "Animals|Birds|Heron", "Places|UK"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			info := testImage()
+			info.Keywords = []string{"sunset"}
+			info.HierarchicalSubject = []string{"Animals|Birds|Heron", "Places|UK"}
+			options := testOptions()
+			options.Keywords.HierarchicalTags = test.mode
+			rules := []Rules{{Name: "animals", Condition: Condition{IncludesAny: []string{"Animals|*"}}}}
+
+			plan := Evaluate(compileRules(t, rules, options.Keywords), info, options)
+			assertStrings(t, "Tags", plan.Tags, test.want)
+			if len(plan.Applied) != 1 {
+				t.Fatalf("Applied = %+v, want the rule to apply", plan.Applied)
+			}
+			assertStrings(t, "Applied[0].Keywords", plan.Applied[0].Keywords,
+				[]string{"Animals|Birds", "Animals|Birds|Heron"})
+		})
+	}
+}
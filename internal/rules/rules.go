@@ -0,0 +1,131 @@
+/*
+Package rules implements the upload rules: compiling the rules in the config and
+evaluating them against an image's metadata to get the plan for uploading it.
+*/
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	. "github.com/akrabat/rodeo/internal"
+)
+
+// A Rule is a rule from the config with its keyword patterns and `when` expression parsed
+type Rule struct {
+	Rules
+	excludesAll []KeywordPattern
+	excludesAny []KeywordPattern
+	includesAll []KeywordPattern
+	includesAny []KeywordPattern
+	when        *Expression
+	renames     []rename
+}
+
+type rename struct {
+	from KeywordPattern
+	to   string
+}
+
+// Flickr machine tags are of the form namespace:predicate=value
+var machineTagPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*:[A-Za-z_][A-Za-z0-9_]*=.+$`)
+
+// Compile the rules in the config and sort them into the order in which they are evaluated: highest priority first
+// and then in the order of the config. Keywords are compared according to `options`.
+func New(configRules []Rules, options Keywords) ([]Rule, error) {
+	var rules []Rule
+	for _, configRule := range configRules {
+		rule, err := Compile(configRule, options)
+		if err != nil {
+			return nil, fmt.Errorf("Rule '%s' %v", configRule.Name, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority > rules[j].Priority
+	})
+	return rules, nil
+}
+
+// Parse the keyword patterns and `when` expression of a rule and check its actions
+func Compile(configRule Rules, options Keywords) (Rule, error) {
+	rule := Rule{Rules: configRule}
+
+	lists := []struct {
+		name     string
+		sources  []string
+		patterns *[]KeywordPattern
+	}{
+		{"excludes_all", configRule.Condition.ExcludesAll, &rule.excludesAll},
+		{"excludes_any", configRule.Condition.ExcludesAny, &rule.excludesAny},
+		{"includes_all", configRule.Condition.IncludesAll, &rule.includesAll},
+		{"includes_any", configRule.Condition.IncludesAny, &rule.includesAny},
+	}
+	for _, list := range lists {
+		patterns, err := ParseKeywordPatterns(list.sources, options)
+		if err != nil {
+			return rule, fmt.Errorf("has an invalid keyword in `%s`: %v", list.name, err)
+		}
+		*list.patterns = patterns
+	}
+
+	if strings.TrimSpace(configRule.When) != "" {
+		when, err := ParseExpression(configRule.When, options)
+		if err != nil {
+			return rule, fmt.Errorf("has an invalid `when` condition: %v", err)
+		}
+		rule.when = when
+	}
+
+	for _, r := range configRule.Action.Rename {
+		from, err := ParseKeywordPattern(r.From, options)
+		if err != nil {
+			return rule, fmt.Errorf("has an invalid keyword in `rename`: %v", err)
+		}
+		if strings.TrimSpace(r.To) == "" {
+			return rule, fmt.Errorf("renames '%s' to an empty keyword", r.From)
+		}
+		rule.renames = append(rule.renames, rename{from: from, to: r.To})
+	}
+
+	switch configRule.Action.Flatten {
+	case "", HierarchicalTagsLeaf, HierarchicalTagsAll:
+	default:
+		return rule, fmt.Errorf("has an invalid `flatten` action '%s': it must be leaf or all", configRule.Action.Flatten)
+	}
+
+	if level := configRule.Action.SafetyLevel; level != "" {
+		if _, ok := SafetyLevels[level]; !ok {
+			return rule, fmt.Errorf("has an invalid `safety_level` action '%s': it must be safe, moderate or restricted", level)
+		}
+	}
+	if contentType := configRule.Action.ContentType; contentType != "" {
+		if _, ok := ContentTypes[contentType]; !ok {
+			return rule, fmt.Errorf("has an invalid `content_type` action '%s': it must be photo, screenshot or other", contentType)
+		}
+	}
+	if license := configRule.Action.License; license != nil && *license < 0 {
+		return rule, fmt.Errorf("has an invalid `license` action %d: it must be a Flickr license ID", *license)
+	}
+
+	for _, tag := range configRule.Action.MachineTags {
+		if !machineTagPattern.MatchString(tag) {
+			return rule, fmt.Errorf("has an invalid machine tag '%s': it must be of the form namespace:predicate=value", tag)
+		}
+	}
+
+	return rule, nil
+}
+
+// Add an album to the list, unless it is already in it
+func AppendAlbum(albums []Album, album Album) []Album {
+	for _, existing := range albums {
+		if existing.Id == album.Id && (album.Id != "" || existing.Name == album.Name) {
+			return albums
+		}
+	}
+	return append(albums, album)
+}
@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The file that earlier versions kept the upload session in
+const uploadSessionBaseFilename = "rodeo-upload-session.json"
+
+// A SessionAlbum is an album that a photo in the upload session is to be added to
+type SessionAlbum struct {
+	Id    string `json:"id"`
+	Name  string `json:"name"`
+	Added bool   `json:"added"`
+}
+
+// A SessionEntry records how far a file has got through the steps of being uploaded to Flickr
+type SessionEntry struct {
+	Filename   string         `json:"filename"`
+	Title      string         `json:"title"`
+	PhotoId    string         `json:"photo_id,omitempty"`
+	DatePosted string         `json:"date_posted,omitempty"` // Unix timestamp to set as the date posted on Flickr
+	DatesSet   bool           `json:"dates_set"`
+	License    *int           `json:"license,omitempty"` // Flickr license ID to set on the photo
+	LicenseSet bool           `json:"license_set"`
+	Albums     []SessionAlbum `json:"albums,omitempty"`
+	Started    time.Time      `json:"started"`
+}
+
+// Is every step for this file done?
+func (e *SessionEntry) IsComplete() bool {
+	if e.PhotoId == "" {
+		return false
+	}
+	if e.DatePosted != "" && !e.DatesSet {
+		return false
+	}
+	if e.License != nil && !e.LicenseSet {
+		return false
+	}
+	for _, album := range e.Albums {
+		if !album.Added {
+			return false
+		}
+	}
+	return true
+}
+
+// An UploadSession is the journal of files that are being uploaded. It is kept in the upload history database and
+// each change is written in its own transaction, so that if Rodeo is interrupted, the incomplete steps can be finished
+// later with `rodeo upload --resume`, and so that Rodeo processes running at the same time don't lose each other's
+// entries.
+type UploadSession struct {
+	history *History
+}
+
+// Open the upload session journal. A journal in the JSON file used by earlier versions is moved into the database.
+func OpenUploadSession() (*UploadSession, error) {
+	history, err := GetHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &UploadSession{history: history}
+	if err := session.importJournal(ConfigDir() + "/" + uploadSessionBaseFilename); err != nil {
+		return nil, fmt.Errorf("unable to import the upload session %s: %v", uploadSessionBaseFilename, err)
+	}
+	return session, nil
+}
+
+// Move the entries of a JSON journal into the database, keeping any entry for the same file that is already there
+func (s *UploadSession) importJournal(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries map[string]*SessionEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	err = s.history.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionBucket)
+		for _, entry := range entries {
+			entry.Filename = sessionKey(entry.Filename)
+			if bucket.Get([]byte(entry.Filename)) != nil {
+				continue
+			}
+			if err := putSessionEntry(bucket, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// The key used for an image file in the journal is its absolute path
+func sessionKey(filename string) string {
+	if absFilename, err := filepath.Abs(filename); err == nil {
+		return absFilename
+	}
+	return filename
+}
+
+// Get the entry for this file. Returns nil if the file is not in the session.
+func (s *UploadSession) Get(filename string) *SessionEntry {
+	var entry *SessionEntry
+	_ = s.history.view(func(tx *bolt.Tx) error {
+		var err error
+		entry, err = getSessionEntry(tx.Bucket(sessionBucket), sessionKey(filename))
+		return err
+	})
+	return entry
+}
+
+// Start recording this file in the session, replacing any previous entry for it
+func (s *UploadSession) Start(entry SessionEntry) error {
+	entry.Filename = sessionKey(entry.Filename)
+	entry.Started = time.Now()
+	return s.history.update(func(tx *bolt.Tx) error {
+		return putSessionEntry(tx.Bucket(sessionBucket), &entry)
+	})
+}
+
+// Apply `update` to the entry for this file and save the session. Once every step for the file is complete, it is
+// removed from the session.
+func (s *UploadSession) Update(filename string, update func(entry *SessionEntry)) error {
+	key := sessionKey(filename)
+	return s.history.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionBucket)
+		entry, err := getSessionEntry(bucket, key)
+		if entry == nil {
+			return err
+		}
+
+		update(entry)
+		if entry.IsComplete() {
+			return bucket.Delete([]byte(key))
+		}
+		return putSessionEntry(bucket, entry)
+	})
+}
+
+// Remove this file from the session
+func (s *UploadSession) Remove(filename string) error {
+	return s.history.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionBucket).Delete([]byte(sessionKey(filename)))
+	})
+}
+
+// Get the entries that have steps still to do, sorted by filename. This includes the entries of uploads that were
+// started but have no photo ID because Rodeo stopped before Flickr replied.
+func (s *UploadSession) Incomplete() []SessionEntry {
+	var entries []SessionEntry
+	_ = s.history.view(func(tx *bolt.Tx) error {
+		// The keys are the filenames, so they are already in order
+		return tx.Bucket(sessionBucket).ForEach(func(key, data []byte) error {
+			var entry SessionEntry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return nil
+			}
+			if !entry.IsComplete() {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+	})
+	return entries
+}
+
+func getSessionEntry(bucket *bolt.Bucket, key string) (*SessionEntry, error) {
+	data := bucket.Get([]byte(key))
+	if data == nil {
+		return nil, nil
+	}
+	var entry SessionEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func putSessionEntry(bucket *bolt.Bucket, entry *SessionEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(entry.Filename), data)
+}
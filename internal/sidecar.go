@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// An XMP sidecar is a file next to an image that holds its XMP metadata, which is how RAW files are usually
+// catalogued. Lightroom and Capture One name it after the image without its extension, e.g. IMG_1234.xmp, and
+// darktable with it, e.g. IMG_1234.CR2.xmp.
+
+// Find the XMP sidecar of an image, or "" if it doesn't have one
+func FindSidecar(filename string) string {
+	for _, sidecar := range sidecarFilenames(filename) {
+		if stat, err := os.Stat(sidecar); err == nil && stat.Mode().IsRegular() {
+			return sidecar
+		}
+	}
+	return ""
+}
+
+// The filename of the XMP sidecar of an image: the existing one if there is one and otherwise the one that
+// Lightroom would create
+func SidecarFilename(filename string) string {
+	if sidecar := FindSidecar(filename); sidecar != "" {
+		return sidecar
+	}
+	return sidecarFilenames(filename)[0]
+}
+
+// The filenames that the sidecar of an image could have, in the order in which they are looked for
+func sidecarFilenames(filename string) []string {
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	return []string{base + ".xmp", base + ".XMP", filename + ".xmp", filename + ".XMP"}
+}
+
+// How the metadata in a sidecar is combined with the metadata in the image, which can be set in the config
+const (
+	SidecarPrefer   = "prefer"   // the sidecar's tags replace the image's
+	SidecarFallback = "fallback" // the sidecar's tags are only used if the image doesn't have them
+	SidecarIgnore   = "ignore"   // sidecars are not read
+)
+
+// Tags that describe the file rather than the image, so are always those of the image
+var fileTags = map[string]bool{
+	"SourceFile": true, "FileName": true, "Directory": true, "FileSize": true, "FileModifyDate": true,
+	"FileAccessDate": true, "FileInodeChangeDate": true, "FilePermissions": true, "FileType": true,
+	"FileTypeExtension": true, "MIMEType": true, "ExifToolVersion": true, "ImageWidth": true, "ImageHeight": true,
+	"ImageSize": true,
+}
+
+// The image's tags that a sidecar's XMP tag stands for, e.g. a sidecar's keywords replace both the IPTC Keywords and
+// the XMP Subject of the image
+var sidecarEquivalentTags = map[string][]string{
+	"Subject":     {"Keywords"},
+	"Title":       {"ObjectName"},
+	"Description": {"Caption-Abstract", "ImageDescription"},
+}
+
+// A SidecarReader reads the metadata of an image and merges the metadata of its XMP sidecar, if it has one
+type SidecarReader struct {
+	Reader     MetadataReader // reads both the image and the sidecar
+	Precedence string         // SidecarPrefer or SidecarFallback
+}
+
+// Read the metadata of an image and its sidecar
+func (r SidecarReader) ReadMetadata(filename string) (*ImageInfo, error) {
+	return r.ReadMetadataWithSidecarOf(filename, filename)
+}
+
+// Read the metadata of an image and the sidecar of `source`, which is the file that the image was converted from
+func (r SidecarReader) ReadMetadataWithSidecarOf(filename string, source string) (*ImageInfo, error) {
+	info, err := r.Reader.ReadMetadata(filename)
+	if err != nil {
+		return nil, err
+	}
+	sidecar := FindSidecar(source)
+	if sidecar == "" {
+		return info, nil
+	}
+	sidecarInfo, err := r.Reader.ReadMetadata(sidecar)
+	if err != nil {
+		return nil, err
+	}
+	return imageInfoFromTags(mergeSidecarTags(info.X, sidecarInfo.X, r.Precedence))
+}
+
+// Merge the tags of a sidecar into those of an image
+func mergeSidecarTags(image map[string]interface{}, sidecar map[string]interface{},
+	precedence string) map[string]interface{} {
+	tags := make(map[string]interface{}, len(image))
+	for name, value := range image {
+		tags[name] = value
+	}
+
+	for name, value := range sidecar {
+		if fileTags[name] {
+			continue
+		}
+		if precedence == SidecarPrefer {
+			tags[name] = value
+			for _, equivalent := range sidecarEquivalentTags[name] {
+				delete(tags, equivalent)
+			}
+			continue
+		}
+
+		if _, ok := tags[name]; ok {
+			continue
+		}
+		hasEquivalent := false
+		for _, equivalent := range sidecarEquivalentTags[name] {
+			if _, ok := tags[equivalent]; ok {
+				hasEquivalent = true
+			}
+		}
+		if !hasEquivalent {
+			tags[name] = value
+		}
+	}
+	return tags
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const UploadedListBaseFilename = "rodeo-uploaded-files.json"
+
+// The current version of the uploaded list file format. Version 1 was a JSON object mapping the image's filename to
+// its photo ID.
+const uploadedListVersion = 2
+
+// An UploadRecord is an image that has been uploaded to Flickr.
+//
+// Records imported from version 1 of the uploaded list only have Filename and PhotoId set.
+type UploadRecord struct {
+	Id         uint64     `json:"-"` // key of the record in the upload history
+	Filename   string     `json:"filename"`
+	Path       string     `json:"path,omitempty"`
+	Size       int64      `json:"size,omitempty"`
+	Hash       string     `json:"hash,omitempty"` // hash of the image data, see ImageHash()
+	PhotoId    string     `json:"photo_id"`
+	Title      string     `json:"title,omitempty"`
+	DateTaken  *time.Time `json:"date_taken,omitempty"`
+	UploadedAt *time.Time `json:"uploaded_at,omitempty"`
+	Albums     []Album    `json:"albums,omitempty"` // albums that Rodeo added the photo to
+}
+
+// An UploadedList is the list of images that had been uploaded to Flickr by earlier versions of Rodeo. These lists are
+// now only read so that they can be imported into the upload history.
+type UploadedList struct {
+	Version int            `json:"version"`
+	Uploads []UploadRecord `json:"uploads"`
+}
+
+// Get the filename of the global uploaded list that earlier versions of Rodeo stored in the config directory
+func GlobalUploadedListFilename() string {
+	return ConfigDir() + "/" + UploadedListBaseFilename
+}
+
+// Get the filename of the uploaded list that an earlier version of Rodeo stored in this image's directory
+func UploadedListFilenameInImageDir(imageFilename string) string {
+	// File is stored in directory where image is and is hidden via a leading `.` on the imageFilename
+	return filepath.Dir(imageFilename) + "/." + UploadedListBaseFilename
+}
+
+// Read the uploaded list from `filename`. If the file does not exist, then the list is empty.
+//
+// Version 1 lists map each image's filename to its photo ID. As version 1 lists stored in an image directory only
+// contain images in that directory, the path of each one is known.
+func ReadUploadedList(filename string) (*UploadedList, error) {
+	list := &UploadedList{Version: uploadedListVersion}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return list, nil
+	}
+	if err != nil {
+		return list, err
+	}
+
+	var version1 map[string]string
+	if err := json.Unmarshal(data, &version1); err == nil {
+		inImageDir := filepath.Base(filename) == "."+UploadedListBaseFilename
+		for imageFilename, photoId := range version1 {
+			record := UploadRecord{Filename: imageFilename, PhotoId: photoId}
+			if inImageDir {
+				record.Path = filepath.Join(filepath.Dir(filename), imageFilename)
+			}
+			list.Uploads = append(list.Uploads, record)
+		}
+		sortUploadRecords(list.Uploads)
+		return list, nil
+	}
+
+	if err := json.Unmarshal(data, list); err != nil {
+		return list, err
+	}
+	return list, nil
+}
+
+// Create the record for an image that has been uploaded as photoId
+func NewUploadRecord(imageFilename string, photoId string, title string, dateTaken *time.Time) (UploadRecord, error) {
+	now := time.Now()
+	record := UploadRecord{
+		Filename:   filepath.Base(imageFilename),
+		PhotoId:    photoId,
+		Title:      title,
+		DateTaken:  dateTaken,
+		UploadedAt: &now,
+	}
+
+	err := record.SetFile(imageFilename)
+	return record, err
+}
+
+// Set the filename, path, size and hash of the record to those of this image
+func (r *UploadRecord) SetFile(imageFilename string) error {
+	path, err := filepath.Abs(imageFilename)
+	if err != nil {
+		return err
+	}
+	r.Filename = filepath.Base(imageFilename)
+	r.Path = path
+
+	stat, err := os.Stat(imageFilename)
+	if err != nil {
+		return err
+	}
+	r.Size = stat.Size()
+
+	r.Hash, err = ImageHash(imageFilename)
+	return err
+}
+
+// Sort records by filename so that version 1 lists are always imported in the same order
+func sortUploadRecords(records []UploadRecord) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Filename < records[j].Filename
+	})
+}
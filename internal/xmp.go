@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// XMP metadata is RDF/XML. Each property of an rdf:Description is either an attribute or a child element. Rodeo reads
+// properties with a simple value or an array of simple values, using the same names as exiftool: the property's name
+// with its first letter in upper case, e.g. dc:subject is "Subject" and lr:hierarchicalSubject is
+// "HierarchicalSubject".
+
+const (
+	rdfNamespace   = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	xmlNamespace   = "http://www.w3.org/XML/1998/namespace"
+	xmlnsNamespace = "xmlns"
+)
+
+// An xmlElement is an element of a parsed XML document
+type xmlElement struct {
+	name     xml.Name
+	attrs    []xml.Attr
+	children []*xmlElement
+	text     strings.Builder
+}
+
+// An XMP date, e.g. 2020-05-06T07:08:09+01:00, where all but the year are optional
+var xmpDatePattern = regexp.MustCompile(`^(\d{4})(?:-(\d{2})(?:-(\d{2})(?:T(\d{2}:\d{2}(?::\d{2}(?:\.\d+)?)?)(Z|[+-]\d{2}:\d{2})?)?)?)?$`)
+
+// Format an XMP date as exiftool does, e.g. 2020:05:06 07:08:09+01:00, and leave any other value as it is
+func xmpDate(value string) string {
+	parts := xmpDatePattern.FindStringSubmatch(value)
+	if parts == nil {
+		return value
+	}
+	date := parts[1]
+	for _, part := range parts[2:4] {
+		if part != "" {
+			date += ":" + part
+		}
+	}
+	if parts[4] != "" {
+		date += " " + parts[4] + parts[5]
+	}
+	return date
+}
+
+// Parse XMP data into `tags`
+func parseXMP(data []byte, tags tagSet) error {
+	root, err := parseXMLElements(data)
+	if err != nil {
+		return fmt.Errorf("invalid XMP data: %v", err)
+	}
+
+	for _, rdf := range root.findAll(rdfNamespace, "RDF") {
+		for _, description := range rdf.children {
+			if description.name.Space != rdfNamespace || description.name.Local != "Description" {
+				continue
+			}
+
+			for _, attr := range description.attrs {
+				if isXMPProperty(attr.Name) {
+					tags.set(xmpTagName(attr.Name.Local), xmpDate(strings.TrimSpace(attr.Value)))
+				}
+			}
+			for _, property := range description.children {
+				if value := xmpValue(property); value != nil {
+					tags.set(xmpTagName(property.name.Local), value)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Parse an XML document into a tree of elements
+func parseXMLElements(data []byte) (*xmlElement, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	root := &xmlElement{}
+	stack := []*xmlElement{root}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		parent := stack[len(stack)-1]
+		switch t := token.(type) {
+		case xml.StartElement:
+			element := &xmlElement{name: t.Name, attrs: t.Attr}
+			parent.children = append(parent.children, element)
+			stack = append(stack, element)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			parent.text.Write(t)
+		}
+	}
+	return root, nil
+}
+
+// Find all of the elements with this name in the tree
+func (e *xmlElement) findAll(space string, local string) []*xmlElement {
+	var found []*xmlElement
+	for _, child := range e.children {
+		if child.name.Space == space && child.name.Local == local {
+			found = append(found, child)
+		} else {
+			found = append(found, child.findAll(space, local)...)
+		}
+	}
+	return found
+}
+
+func (e *xmlElement) attr(space string, local string) string {
+	for _, attr := range e.attrs {
+		if attr.Name.Space == space && attr.Name.Local == local {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// Is the attribute of an rdf:Description a property, rather than part of the RDF or XML syntax?
+func isXMPProperty(name xml.Name) bool {
+	return name.Space != rdfNamespace && name.Space != xmlNamespace && name.Space != xmlnsNamespace &&
+		name.Space != "" && name.Local != ""
+}
+
+// The value of a property: a string, or a list of strings for an rdf:Bag or rdf:Seq. Structures are not supported,
+// so their value is nil.
+func xmpValue(property *xmlElement) interface{} {
+	if len(property.children) == 0 {
+		if property.attr(rdfNamespace, "parseType") == "Resource" {
+			return nil
+		}
+		return xmpDate(strings.TrimSpace(property.text.String()))
+	}
+
+	container := property.children[0]
+	if container.name.Space != rdfNamespace {
+		return nil
+	}
+	switch container.name.Local {
+	case "Bag", "Seq":
+		var values []string
+		for _, item := range container.children {
+			if item.name.Space == rdfNamespace && item.name.Local == "li" && len(item.children) == 0 {
+				if value := strings.TrimSpace(item.text.String()); value != "" {
+					values = append(values, value)
+				}
+			}
+		}
+		if len(values) == 1 {
+			return values[0]
+		}
+		return values
+	case "Alt":
+		// A language alternative: use the default language, or the first if there isn't one
+		var value string
+		for i, item := range container.children {
+			if item.name.Space != rdfNamespace || item.name.Local != "li" {
+				continue
+			}
+			if i == 0 || item.attr(xmlNamespace, "lang") == "x-default" {
+				value = strings.TrimSpace(item.text.String())
+			}
+		}
+		return value
+	}
+	return nil
+}
+
+// The exiftool name of a property, e.g. "Subject" for dc:subject
+func xmpTagName(local string) string {
+	r, size := utf8.DecodeRuneInString(local)
+	return string(unicode.ToUpper(r)) + local[size:]
+}
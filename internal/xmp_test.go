@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+// An XMP packet with properties as attributes and as elements
+const testXMP = `<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/" x:xmptk="XMP Core 5.6.0">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:lr="http://ns.adobe.com/lightroom/1.0/"
+    xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"
+    xmlns:tiff="http://ns.adobe.com/tiff/1.0/"
+    xmlns:Iptc4xmpCore="http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/"
+    photoshop:DateCreated="2020-05-06T07:08:09+01:00"
+    tiff:Make="Nikon">
+   <dc:title>
+    <rdf:Alt>
+     <rdf:li xml:lang="en-GB">Grey Heron</rdf:li>
+     <rdf:li xml:lang="x-default">Heron</rdf:li>
+    </rdf:Alt>
+   </dc:title>
+   <dc:description>
+    <rdf:Alt>
+     <rdf:li xml:lang="en-GB"> A heron by the river </rdf:li>
+    </rdf:Alt>
+   </dc:description>
+   <dc:subject>
+    <rdf:Bag>
+     <rdf:li>heron</rdf:li>
+     <rdf:li>bird</rdf:li>
+     <rdf:li> </rdf:li>
+    </rdf:Bag>
+   </dc:subject>
+   <lr:hierarchicalSubject>
+    <rdf:Bag>
+     <rdf:li>Animals|Birds|Heron</rdf:li>
+    </rdf:Bag>
+   </lr:hierarchicalSubject>
+   <dc:creator>
+    <rdf:Seq>
+     <rdf:li>Rob</rdf:li>
+     <rdf:li>Sam</rdf:li>
+    </rdf:Seq>
+   </dc:creator>
+   <photoshop:City>London</photoshop:City>
+   <Iptc4xmpCore:CreatorContactInfo rdf:parseType="Resource">
+    <Iptc4xmpCore:CiAdrCity>London</Iptc4xmpCore:CiAdrCity>
+   </Iptc4xmpCore:CreatorContactInfo>
+   <Iptc4xmpCore:Location rdf:parseType="Resource"/>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+func TestParseXMP(t *testing.T) {
+	tags := tagSet{}
+	if err := parseXMP([]byte(testXMP), tags); err != nil {
+		t.Fatalf("parseXMP() error: %v", err)
+	}
+	assertTags(t, "XMP", tags, tagSet{
+		"DateCreated":         "2020:05:06 07:08:09+01:00",
+		"Make":                "Nikon",
+		"Title":               "Heron",
+		"Description":         "A heron by the river",
+		"Subject":             []string{"heron", "bird"},
+		"HierarchicalSubject": "Animals|Birds|Heron",
+		"Creator":             []string{"Rob", "Sam"},
+		"City":                "London",
+	})
+}
+
+func TestParseXMPWithoutMetadata(t *testing.T) {
+	for _, data := range []string{
+		"",
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/"/>`,
+		`<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description rdf:about=""/></rdf:RDF>`,
+		// rdf:RDF in the wrong namespace
+		`<RDF><Description xmlns:dc="http://purl.org/dc/elements/1.1/" dc:format="image/jpeg"/></RDF>`,
+	} {
+		tags := tagSet{}
+		if err := parseXMP([]byte(data), tags); err != nil {
+			t.Errorf("parseXMP(%q) error: %v", data, err)
+		}
+		assertTags(t, "XMP", tags, tagSet{})
+	}
+}
+
+func TestParseXMPInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"truncated", testXMP[:len(testXMP)/2]},
+		{"mismatched elements", `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF></x:xmpmeta>`},
+		{"not XML", "<<<"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := parseXMP([]byte(test.data), tagSet{})
+			if err == nil {
+				t.Fatalf("parseXMP() succeeded, want an error")
+			}
+			if !strings.HasPrefix(err.Error(), "invalid XMP data: ") {
+				t.Errorf("parseXMP() error = %q, want it to start with %q", err, "invalid XMP data: ")
+			}
+		})
+	}
+}
+
+func TestXMPDate(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"2020", "2020"},
+		{"2020-05", "2020:05"},
+		{"2020-05-06", "2020:05:06"},
+		{"2020-05-06T07:08", "2020:05:06 07:08"},
+		{"2020-05-06T07:08:09", "2020:05:06 07:08:09"},
+		{"2020-05-06T07:08:09.25", "2020:05:06 07:08:09.25"},
+		{"2020-05-06T07:08:09Z", "2020:05:06 07:08:09Z"},
+		{"2020-05-06T07:08:09-05:00", "2020:05:06 07:08:09-05:00"},
+		{"heron", "heron"},
+		{"2020-05-06 07:08:09", "2020-05-06 07:08:09"},
+		{"20200506", "20200506"},
+	}
+
+	for _, test := range tests {
+		if got := xmpDate(test.value); got != test.want {
+			t.Errorf("xmpDate(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}